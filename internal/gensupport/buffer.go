@@ -6,7 +6,10 @@ package gensupport
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"sync"
+	"sync/atomic"
 
 	"google.golang.org/api/googleapi"
 )
@@ -15,41 +18,137 @@ import (
 // retryable chunks. It should be created with NewMediaBuffer.
 type MediaBuffer struct {
 	media io.Reader
+	// initialSize is the size of media when the buffer was created, or -1
+	// if it does not report one. See ResumableUpload.DetectSourceSizeChange.
+	initialSize int64
 
 	chunk []byte // The current chunk which is pending upload.  The capacity is the chunk size.
 	err   error  // Any error generated when populating chunk by reading media.
 
 	// The absolute position of chunk in the underlying media.
 	off int64
+
+	// pending holds data read from media beyond the end of chunk. It is
+	// returned at the start of the next chunk.
+	pending []byte
+	// pendingErr is an error from media to be returned once pending is
+	// consumed, set when the chunk it ended is shrunk.
+	pendingErr error
+	// flush is set by Flush to request that the chunk being loaded is cut
+	// short.
+	flush atomic.Bool
+	// spill, if set by SpillToDisk, holds the chunk in place of chunk.
+	spill *spillFile
+	// boundary, if set, chooses the length of each chunk. See
+	// ResumableUpload.ChunkBoundaryFunc.
+	boundary func(offset, maxChunk int64) int64
+	// prefetchNext enables reading the next chunk from media while the
+	// current one is sent. See ResumableUpload.PrefetchNextChunk.
+	prefetchNext bool
+	// peek limits the chunks loaded to a single byte, enough to tell whether
+	// the media has ended. See ResumableUpload.MaxChunks.
+	peek bool
+	// prefetch, if set, is the read ahead in progress.
+	prefetch *prefetched
+
+	mu    sync.Mutex
+	state bufferState // published by publish for DebugState; guarded by mu
 }
 
+// flushAlignment is the granularity to which chunks cut short by Flush, or
+// shrunk after timeouts, are aligned. It is a variable so that tests can overwrite it.
+var flushAlignment = googleapi.MinUploadChunkSize
+
 // NewMediaBuffer initializes a MediaBuffer.
 func NewMediaBuffer(media io.Reader, chunkSize int) *MediaBuffer {
-	return &MediaBuffer{media: media, chunk: make([]byte, 0, chunkSize)}
+	mb := &MediaBuffer{media: media, initialSize: -1, chunk: make([]byte, 0, chunkSize)}
+	if size, ok := sourceSize(media); ok {
+		mb.initialSize = size
+	}
+	mb.publish()
+	return mb
 }
 
 // Chunk returns the current buffered chunk, the offset in the underlying media
 // from which the chunk is drawn, and the size of the chunk.
 // Successive calls to Chunk return the same chunk between calls to Next.
 func (mb *MediaBuffer) Chunk() (chunk io.Reader, off int64, size int, err error) {
+	defer mb.publish()
+	if s := mb.spill; s != nil {
+		if mb.err == nil && s.n == 0 {
+			mb.err = mb.loadSpilledChunk()
+		}
+		return s.reader(), mb.off, s.n, mb.err
+	}
 	// There may already be data in chunk if Next has not been called since the previous call to Chunk.
 	if mb.err == nil && len(mb.chunk) == 0 {
 		mb.err = mb.loadChunk()
 	}
+	mb.startPrefetch()
 	return bytes.NewReader(mb.chunk), mb.off, len(mb.chunk), mb.err
 }
 
-// loadChunk will read from media into chunk, up to the capacity of chunk.
+// chunkSize returns the maximum size of the chunks returned by Chunk.
+func (mb *MediaBuffer) chunkSize() int {
+	if mb.spill != nil {
+		return mb.spill.size
+	}
+	return cap(mb.chunk)
+}
+
+// nextChunkSize returns the length of the next chunk to load: the chunk size,
+// or the length chosen by boundary, aligned to flushAlignment, or 1 to peek.
+func (mb *MediaBuffer) nextChunkSize() int {
+	if mb.peek {
+		return 1
+	}
+	size := mb.chunkSize()
+	if mb.boundary == nil {
+		return size
+	}
+	n := mb.boundary(mb.off, int64(size))
+	n -= n % int64(flushAlignment)
+	return int(min(max(n, int64(flushAlignment)), int64(size)))
+}
+
+// Flush requests that the chunk currently being read from the media is sent
+// without waiting for it to fill, which is useful when the media is being
+// produced live. Because non-final chunks must be a multiple of 256 KiB, only
+// the largest aligned prefix of the data read so far is sent; the remainder is
+// kept for the next chunk. If less than 256 KiB has been read, the flush takes
+// effect once enough data (or EOF) arrives.
+//
+// Flush may be called concurrently with an upload. The request is observed
+// after the current Read from the media returns.
+func (mb *MediaBuffer) Flush() {
+	mb.flush.Store(true)
+}
+
+// loadChunk will read from media into chunk, up to nextChunkSize bytes, or
+// until a requested flush can be satisfied.
 func (mb *MediaBuffer) loadChunk() error {
-	bufSize := cap(mb.chunk)
+	mb.awaitPrefetch()
+	bufSize := mb.nextChunkSize()
 	mb.chunk = mb.chunk[:bufSize]
 
-	read := 0
+	read := copy(mb.chunk, mb.pending)
+	mb.pending = mb.pending[read:]
 	var err error
+	if len(mb.pending) == 0 && mb.pendingErr != nil {
+		err, mb.pendingErr = mb.pendingErr, nil
+	}
 	for err == nil && read < bufSize {
 		var n int
 		n, err = mb.media.Read(mb.chunk[read:])
 		read += n
+		if err == nil && mb.flush.Load() {
+			if aligned := read - read%flushAlignment; aligned > 0 {
+				mb.flush.Store(false)
+				mb.pending = append(mb.pending, mb.chunk[aligned:read]...)
+				read = aligned
+				break
+			}
+		}
 	}
 	mb.chunk = mb.chunk[:read]
 	return err
@@ -57,11 +156,78 @@ func (mb *MediaBuffer) loadChunk() error {
 
 // Next advances to the next chunk, which will be returned by the next call to Chunk.
 // Calls to Next without a corresponding prior call to Chunk will have no effect.
+//
+// The media is read again for the next chunk even if it has reported io.EOF,
+// so that a source that grows after EOF is noticed, should the server not
+// take the chunk that ended at EOF as final.
 func (mb *MediaBuffer) Next() {
+	defer mb.publish()
+	if mb.err == io.EOF {
+		mb.err = nil
+	}
+	if s := mb.spill; s != nil {
+		mb.off += int64(s.n)
+		s.start += int64(s.n)
+		s.n = 0
+		if s.start == s.end {
+			s.remove()
+		}
+		return
+	}
 	mb.off += int64(len(mb.chunk))
 	mb.chunk = mb.chunk[0:0]
 }
 
+// shrink reduces the chunk size to size. If the current chunk is longer, it is
+// cut to size and the remainder is returned at the start of the next chunk.
+func (mb *MediaBuffer) shrink(size int) {
+	defer mb.publish()
+	if s := mb.spill; s != nil {
+		// The remainder stays in the spill file for the next chunk.
+		if size < s.n {
+			if mb.err != nil {
+				mb.pendingErr, mb.err = mb.err, nil
+			}
+			s.n = size
+		}
+		s.size = size
+		return
+	}
+	mb.awaitPrefetch()
+	if size < len(mb.chunk) {
+		rest := append([]byte(nil), mb.chunk[size:]...)
+		mb.pending = append(rest, mb.pending...)
+		if mb.err != nil {
+			mb.pendingErr, mb.err = mb.err, nil
+		}
+		mb.chunk = mb.chunk[:size]
+	}
+	mb.chunk = mb.chunk[:len(mb.chunk):size]
+}
+
+// rewind repositions the buffer at offset off in the media, discarding any
+// buffered data. It fails if the media does not implement io.Seeker.
+func (mb *MediaBuffer) rewind(off int64) error {
+	s, ok := mb.media.(io.Seeker)
+	if !ok {
+		return errors.New("media does not implement io.Seeker")
+	}
+	mb.awaitPrefetch()
+	defer mb.publish()
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	mb.off = off
+	if mb.spill != nil {
+		mb.spill.remove()
+	}
+	mb.chunk = mb.chunk[:0]
+	mb.pending = nil
+	mb.pendingErr = nil
+	mb.err = nil
+	return nil
+}
+
 type readerTyper struct {
 	io.Reader
 	googleapi.ContentTyper
@@ -0,0 +1,73 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"fmt"
+	"io"
+)
+
+// bufferState is a snapshot of the state of a MediaBuffer, published for
+// DebugState.
+type bufferState struct {
+	off         int64 // offset of the current chunk in the media
+	chunkSize   int   // maximum size of a chunk
+	buffered    int   // length of the current chunk
+	pending     int64 // bytes read beyond the current chunk
+	eof         bool  // whether the end of the media has been read
+	spilled     bool  // whether chunks are spilled to disk
+	prefetching bool  // whether a read ahead is in progress
+	err         error // error from the media other than io.EOF, if any
+}
+
+// publish records the state of mb for DebugState. It is called by each
+// method that changes the state, once the change is complete.
+func (mb *MediaBuffer) publish() {
+	st := bufferState{
+		off:         mb.off,
+		chunkSize:   mb.chunkSize(),
+		buffered:    len(mb.chunk),
+		pending:     int64(len(mb.pending)),
+		prefetching: mb.prefetch != nil,
+	}
+	if s := mb.spill; s != nil {
+		st.spilled = true
+		st.buffered = s.n
+		st.pending = max(s.end-s.start-int64(s.n), 0)
+	}
+	for _, err := range []error{mb.err, mb.pendingErr} {
+		switch {
+		case err == io.EOF:
+			st.eof = true
+		case err != nil && st.err == nil:
+			st.err = err
+		}
+	}
+	mb.mu.Lock()
+	mb.state = st
+	mb.mu.Unlock()
+}
+
+// DebugState returns a human-readable snapshot of the state of mb, for
+// diagnosing failed uploads: the offset of the current chunk in the media,
+// the chunk size, the bytes buffered in the current chunk and beyond it, and
+// whether the end of the media has been seen. It may be called concurrently
+// with an upload, and reflects the state after the last completed operation.
+func (mb *MediaBuffer) DebugState() string {
+	mb.mu.Lock()
+	st := mb.state
+	mb.mu.Unlock()
+	s := fmt.Sprintf("offset=%d chunkSize=%d buffered=%d pending=%d eof=%t", st.off, st.chunkSize, st.buffered, st.pending, st.eof)
+	if st.spilled {
+		s += " spilled=true"
+	}
+	if st.prefetching {
+		s += " prefetching=true"
+	}
+	if st.err != nil {
+		s += fmt.Sprintf(" err=%q", st.err)
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import "context"
+
+// prefetched is a read ahead from the media. data and err are set by the
+// reading goroutine before done is closed.
+type prefetched struct {
+	done <-chan struct{}
+	data []byte
+	err  error
+}
+
+// startPrefetch begins reading the next chunk from the media in the
+// background, if prefetching is enabled and there is more media to read. At
+// most one chunk is read ahead: the read stops once the data buffered beyond
+// the current chunk fills a chunk.
+func (mb *MediaBuffer) startPrefetch() {
+	if !mb.prefetchNext || mb.peek || mb.spill != nil || mb.prefetch != nil || mb.err != nil || mb.pendingErr != nil {
+		return
+	}
+	want := mb.chunkSize() - len(mb.pending)
+	if want <= 0 {
+		return
+	}
+	p := &prefetched{}
+	mb.prefetch = p
+	media := mb.media
+	p.done = spawn(func() {
+		buf := make([]byte, want)
+		var read int
+		var err error
+		for err == nil && read < want {
+			var n int
+			n, err = media.Read(buf[read:])
+			read += n
+		}
+		p.data, p.err = buf[:read], err
+	})
+}
+
+// awaitPrefetch waits for the read started by startPrefetch, if any, and adds
+// the data read to pending. Any error is returned once pending is consumed.
+// It must be called before anything else reads the media or changes pending.
+func (mb *MediaBuffer) awaitPrefetch() {
+	if mb.prefetch == nil {
+		return
+	}
+	p := mb.prefetch
+	<-p.done
+	mb.prefetch = nil
+	mb.pending = append(mb.pending, p.data...)
+	if p.err != nil {
+		mb.pendingErr = p.err
+	}
+}
+
+// awaitPrefetchContext is awaitPrefetch, except that it gives up waiting once
+// ctx is done. It reports whether the read ahead, if any, was awaited; if
+// not, it is still under way, and mb must not be used again.
+func (mb *MediaBuffer) awaitPrefetchContext(ctx context.Context) bool {
+	if mb.prefetch == nil {
+		return true
+	}
+	select {
+	case <-mb.prefetch.done:
+	case <-ctx.Done():
+		select {
+		case <-mb.prefetch.done:
+		default:
+			return false
+		}
+	}
+	mb.awaitPrefetch()
+	return true
+}
@@ -0,0 +1,53 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// sourceFile returns the file underlying the media r, if r reads from one,
+// along with the offset and length of the part of the file still to be read.
+// A length of zero extends to the end of the file. Besides an *os.File, it
+// recognizes readers made by ReaderAtToReader and io.NewSectionReader.
+func sourceFile(r io.Reader) (f *os.File, off, n int64, ok bool) {
+	if rt, isTyper := r.(readerTyper); isTyper {
+		r = rt.Reader
+	}
+	switch r := r.(type) {
+	case *os.File:
+		off, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, 0, false
+		}
+		return r, off, 0, true
+	case *io.SectionReader:
+		ra, base, size := r.Outer()
+		f, isFile := ra.(*os.File)
+		if !isFile {
+			return nil, 0, 0, false
+		}
+		// The section reader's position is unknown; advise the whole section.
+		return f, base, size, true
+	}
+	return nil, 0, 0, false
+}
+
+// adviseSequential tells the operating system that the media file, if the
+// media is read from one, is about to be read sequentially, so that it reads
+// ahead aggressively. The advice is best effort: a failure is only logged.
+func (rx *ResumableUpload) adviseSequential(ctx context.Context) {
+	f, off, n, ok := sourceFile(rx.Media.media)
+	if !ok {
+		return
+	}
+	if err := adviseSequential(f, off, n); err != nil {
+		if l := rx.logger(); l != nil {
+			l.DebugContext(ctx, "resumable upload read-ahead advice failed", "file", f.Name(), "err", err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package gensupport
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// adviseSequential advises the kernel that n bytes of f from offset off, or
+// all of f from off if n is zero, will be read sequentially.
+func adviseSequential(f *os.File, off, n int64) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		err = unix.Fadvise(int(fd), off, n, unix.FADV_SEQUENTIAL)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
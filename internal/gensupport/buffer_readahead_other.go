@@ -0,0 +1,14 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package gensupport
+
+import "os"
+
+// adviseSequential does nothing: read-ahead advice is only given on Linux.
+func adviseSequential(f *os.File, off, n int64) error {
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourceFile(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "media"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString("0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(4, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		r      io.Reader
+		wantOK bool
+		off, n int64
+	}{
+		{name: "file", r: f, wantOK: true, off: 4},
+		{name: "ReaderAtToReader", r: ReaderAtToReader(f, 10), wantOK: true, n: 10},
+		{name: "section", r: io.NewSectionReader(f, 2, 5), wantOK: true, off: 2, n: 5},
+		{name: "not a file", r: strings.NewReader("data")},
+		{name: "section of other", r: io.NewSectionReader(strings.NewReader("data"), 0, 4)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, off, n, ok := sourceFile(tc.r)
+			if ok != tc.wantOK {
+				t.Fatalf("got ok %v, want %v", ok, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got != f || off != tc.off || n != tc.n {
+				t.Errorf("got (%v, %d, %d), want (%v, %d, %d)", got, off, n, f, tc.off, tc.n)
+			}
+			if err := adviseSequential(got, off, n); err != nil {
+				t.Errorf("adviseSequential: %v", err)
+			}
+		})
+	}
+}
+
+func TestSequentialReadAhead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "media")
+	if err := os.WriteFile(path, []byte(strings.Repeat("a", 25)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var sent int64
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			n, _ := io.Copy(io.Discard, req.Body)
+			sent += n
+			if strings.HasSuffix(req.Header.Get("Content-Range"), "/*") {
+				return incompleteResponse(), nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+		})},
+		URI:                 "https://example.com/upload",
+		Media:               NewMediaBuffer(f, 10),
+		MediaType:           "text/plain",
+		SequentialReadAhead: true,
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if sent != 25 {
+		t.Errorf("sent %d bytes, want 25", sent)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errSpillDiscarded is returned by Chunk if buffered media was discarded
+// along with the spill file when an upload ended.
+var errSpillDiscarded = errors.New("buffered media was discarded with the spill file when the upload ended")
+
+// spillFile holds the chunks of a MediaBuffer in a temporary file.
+type spillFile struct {
+	dir string
+	buf []byte // Scratch space for copying media into f.
+	f   *os.File
+
+	size  int   // The maximum size of a chunk.
+	start int64 // The offset in f of the current chunk.
+	n     int   // The length of the current chunk.
+	// The offset in f of the end of the data read from media. Data beyond
+	// the current chunk is returned at the start of the next chunk.
+	end int64
+}
+
+// SpillToDisk bounds the memory held by mb for chunks larger than threshold
+// bytes. If the chunk size exceeds threshold, each chunk is copied from the
+// media into a temporary file in dir (or the default directory for temporary
+// files, if dir is empty) and read back from the file for every attempt to
+// send it, so only threshold bytes are buffered in memory. This trades disk IO
+// for memory when the chunk size is very large.
+//
+// The file is removed once all data in it has been committed, and when the
+// upload ends. SpillToDisk must be called before the first call to Chunk.
+func (mb *MediaBuffer) SpillToDisk(threshold int, dir string) {
+	if threshold <= 0 || cap(mb.chunk) <= threshold {
+		return
+	}
+	mb.spill = &spillFile{dir: dir, buf: make([]byte, threshold), size: cap(mb.chunk)}
+	mb.chunk = nil
+	mb.publish()
+}
+
+// loadSpilledChunk reads from media into the spill file, until the chunk is
+// full or a requested flush can be satisfied.
+func (mb *MediaBuffer) loadSpilledChunk() error {
+	s := mb.spill
+	if s.f == nil {
+		f, err := os.CreateTemp(s.dir, "gensupport-chunk-*")
+		if err != nil {
+			return fmt.Errorf("creating spill file: %w", err)
+		}
+		s.f = f
+	}
+	size := mb.nextChunkSize()
+	read := int(min(s.end-s.start, int64(size)))
+	var err error
+	if s.start+int64(read) == s.end && mb.pendingErr != nil {
+		err, mb.pendingErr = mb.pendingErr, nil
+	}
+	for err == nil && read < size {
+		var n int
+		n, err = mb.media.Read(s.buf[:min(len(s.buf), size-read)])
+		if n > 0 {
+			if _, werr := s.f.WriteAt(s.buf[:n], s.end); werr != nil {
+				return fmt.Errorf("writing spill file: %w", werr)
+			}
+			read += n
+			s.end += int64(n)
+		}
+		if err == nil && mb.flush.Load() {
+			if aligned := read - read%flushAlignment; aligned > 0 {
+				mb.flush.Store(false)
+				read = aligned
+				break
+			}
+		}
+	}
+	s.n = read
+	return err
+}
+
+// reader returns a reader for the current chunk.
+func (s *spillFile) reader() io.Reader {
+	if s.f == nil {
+		return bytes.NewReader(nil)
+	}
+	return io.NewSectionReader(s.f, s.start, int64(s.n))
+}
+
+// remove closes and removes the spill file, discarding any data in it.
+func (s *spillFile) remove() {
+	if s.f != nil {
+		s.f.Close()
+		os.Remove(s.f.Name())
+		s.f = nil
+	}
+	s.start, s.n, s.end = 0, 0, 0
+}
+
+// releaseSpill removes the spill file, if any, at the end of an upload. If
+// media read into it was not committed, later calls to Chunk fail.
+func (mb *MediaBuffer) releaseSpill() {
+	s := mb.spill
+	if s == nil || s.f == nil {
+		return
+	}
+	if s.end > s.start && (mb.err == nil || mb.err == io.EOF) {
+		mb.err = errSpillDiscarded
+	}
+	s.remove()
+	mb.publish()
+}
@@ -6,8 +6,11 @@ package gensupport
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"testing/iotest"
 
@@ -293,3 +296,252 @@ func TestAdapter(t *testing.T) {
 		checkConversion(to, tc.wantTyper)
 	}
 }
+
+// scriptedReader returns its pieces one Read at a time, calling after (if set)
+// once the piece at the same index has been returned.
+type scriptedReader struct {
+	pieces []string
+	after  map[int]func()
+	i      int
+}
+
+func (r *scriptedReader) Read(p []byte) (int, error) {
+	if r.i >= len(r.pieces) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.pieces[r.i])
+	if n < len(r.pieces[r.i]) {
+		r.pieces[r.i] = r.pieces[r.i][n:]
+		return n, nil
+	}
+	if f := r.after[r.i]; f != nil {
+		f()
+	}
+	r.i++
+	return n, nil
+}
+
+func TestMediaBufferFlush(t *testing.T) {
+	oldAlignment := flushAlignment
+	flushAlignment = 10
+	defer func() { flushAlignment = oldAlignment }()
+
+	r := &scriptedReader{
+		pieces: []string{
+			strings.Repeat("a", 25),
+			strings.Repeat("b", 4), // flush requested with only 4 bytes buffered
+			strings.Repeat("c", 7),
+			strings.Repeat("d", 30),
+		},
+	}
+	mb := NewMediaBuffer(r, 100)
+	r.after = map[int]func(){0: mb.Flush, 1: mb.Flush}
+
+	var chunks []string
+	for {
+		s, err := getChunkAsString(t, mb)
+		chunks = append(chunks, s)
+		mb.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		// The first flush sends the aligned prefix of the first piece.
+		strings.Repeat("a", 20),
+		// The second flush is satisfied once 10 bytes are buffered.
+		strings.Repeat("a", 5) + strings.Repeat("b", 4) + strings.Repeat("c", 1),
+		strings.Repeat("c", 6) + strings.Repeat("d", 30),
+	}
+	if !reflect.DeepEqual(chunks, want) {
+		t.Errorf("chunks: got %q, want %q", chunks, want)
+	}
+}
+
+func TestMediaBufferSpillToDisk(t *testing.T) {
+	oldAlignment := flushAlignment
+	flushAlignment = 10
+	defer func() { flushAlignment = oldAlignment }()
+
+	dir := t.TempDir()
+	spillFiles := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	data := "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	mb := NewMediaBuffer(iotest.OneByteReader(strings.NewReader(data)), 30)
+	mb.SpillToDisk(4, dir)
+	if mb.spill == nil {
+		t.Fatal("chunk size above threshold did not enable spilling")
+	}
+
+	var chunks []string
+	for i := 0; ; i++ {
+		s, err := getChunkAsString(t, mb)
+		// Every attempt reads the chunk back from the file.
+		if again, _ := getChunkAsString(t, mb); again != s {
+			t.Fatalf("chunk %d: replayed %q, want %q", i, again, s)
+		}
+		if i == 0 {
+			// The last 10 bytes move to the start of the next chunk.
+			mb.shrink(20)
+			s, err = getChunkAsString(t, mb)
+		}
+		if n := spillFiles(); s != "" && n != 1 {
+			t.Fatalf("chunk %d: got %d spill files, want 1", i, n)
+		}
+		chunks = append(chunks, s)
+		mb.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && spillFiles() != 0 {
+			t.Fatalf("spill file was not removed after chunk %d was committed", i)
+		}
+	}
+	want := []string{data[:20], data[20:40], data[40:60], data[60:]}
+	if !reflect.DeepEqual(chunks, want) {
+		t.Errorf("chunks: got %q, want %q", chunks, want)
+	}
+	if n := spillFiles(); n != 0 {
+		t.Errorf("got %d spill files after the last chunk, want 0", n)
+	}
+}
+
+func TestMediaBufferSpillReleased(t *testing.T) {
+	dir := t.TempDir()
+	mb := NewMediaBuffer(strings.NewReader(strings.Repeat("a", 100)), 30)
+	mb.SpillToDisk(4, dir)
+	if _, _, _, err := mb.Chunk(); err != nil {
+		t.Fatal(err)
+	}
+	mb.releaseSpill()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("got %d spill files after release, want 0", len(entries))
+	}
+	if _, _, _, err := mb.Chunk(); err != errSpillDiscarded {
+		t.Errorf("Chunk after release: got %v, want errSpillDiscarded", err)
+	}
+}
+
+func TestMediaBufferChunkBoundary(t *testing.T) {
+	oldAlignment := flushAlignment
+	flushAlignment = 10
+	defer func() { flushAlignment = oldAlignment }()
+
+	for _, tc := range []struct {
+		name     string
+		boundary func(offset, maxChunk int64) int64
+		want     []int
+	}{
+		{
+			name:     "snapped down",
+			boundary: func(offset, maxChunk int64) int64 { return 25 },
+			want:     []int{20, 20, 20, 20, 20, 5},
+		},
+		{
+			name:     "capped at chunk size",
+			boundary: func(offset, maxChunk int64) int64 { return 1000 },
+			want:     []int{40, 40, 25},
+		},
+		{
+			name:     "at least the alignment",
+			boundary: func(offset, maxChunk int64) int64 { return 0 },
+			want:     []int{10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 5},
+		},
+		{
+			name: "varying",
+			boundary: func(offset, maxChunk int64) int64 {
+				if offset == 0 {
+					return 30
+				}
+				return maxChunk
+			},
+			want: []int{30, 40, 35},
+		},
+	} {
+		for _, spill := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/spill=%v", tc.name, spill), func(t *testing.T) {
+				media := strings.Repeat("abcdefghijklmnopqrstuvwxy", 4) + "abcde"
+				mb := NewMediaBuffer(strings.NewReader(media), 40)
+				if spill {
+					mb.SpillToDisk(1, t.TempDir())
+					defer mb.releaseSpill()
+				}
+				mb.boundary = tc.boundary
+				var sizes []int
+				var got string
+				for {
+					s, err := getChunkAsString(t, mb)
+					sizes = append(sizes, len(s))
+					got += s
+					mb.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if !reflect.DeepEqual(sizes, tc.want) {
+					t.Errorf("chunk sizes: got %v, want %v", sizes, tc.want)
+				}
+				if got != media {
+					t.Errorf("chunks do not add up to the media: got %q", got)
+				}
+			})
+		}
+	}
+}
+
+func TestMediaBufferDebugState(t *testing.T) {
+	mb := NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10)
+	if got, want := mb.DebugState(), "offset=0 chunkSize=10 buffered=0 pending=0 eof=false"; got != want {
+		t.Errorf("new buffer: got %q, want %q", got, want)
+	}
+	mb.Chunk()
+	if got, want := mb.DebugState(), "offset=0 chunkSize=10 buffered=10 pending=0 eof=false"; got != want {
+		t.Errorf("first chunk: got %q, want %q", got, want)
+	}
+	mb.Next()
+	mb.Chunk()
+	mb.Next()
+	mb.Chunk()
+	if got, want := mb.DebugState(), "offset=20 chunkSize=10 buffered=5 pending=0 eof=true"; got != want {
+		t.Errorf("last chunk: got %q, want %q", got, want)
+	}
+
+	// DebugState may be called while another goroutine uses the buffer.
+	mb = NewMediaBuffer(strings.NewReader(strings.Repeat("a", 1000)), 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, _, _, err := mb.Chunk()
+			mb.Next()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if got := mb.DebugState(); !strings.HasPrefix(got, "offset=1000 ") {
+				t.Errorf("after the media is consumed: got %q", got)
+			}
+			return
+		default:
+			mb.DebugState()
+		}
+	}
+}
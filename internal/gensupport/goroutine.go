@@ -0,0 +1,44 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import "sync/atomic"
+
+// maxUploadGoroutines is the most goroutines a single resumable upload runs
+// at once: one reading ahead for PrefetchNextChunk, one delivering progress
+// for CallbackQueueSize, and one loading a chunk while keep-alive probes are
+// sent for KeepAliveInterval. Each is waited for before Upload returns, except
+// a read from the media abandoned after ChunkReadTimeout, or a read ahead still
+// under way when the upload is canceled, which ends when the media returns.
+const maxUploadGoroutines = 3
+
+// goroutines accounts for the goroutines started by the package, so that
+// tests can check that their number stays bounded and that none outlive an
+// upload.
+var goroutines struct {
+	live atomic.Int64 // running now
+	peak atomic.Int64 // most running at once
+}
+
+// spawn runs f on a new goroutine, accounted for in goroutines. Every
+// goroutine the package starts goes through spawn. The returned channel is
+// closed once the goroutine has exited and is no longer counted as live, so
+// waiting on it, rather than on a signal sent by f, keeps the accounting exact.
+func spawn(f func()) (exited <-chan struct{}) {
+	n := goroutines.live.Add(1)
+	for {
+		p := goroutines.peak.Load()
+		if n <= p || goroutines.peak.CompareAndSwap(p, n) {
+			break
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer goroutines.live.Add(-1)
+		f()
+	}()
+	return done
+}
@@ -0,0 +1,98 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowReader returns at most 5 bytes from r per Read, after a short sleep.
+type slowReader struct {
+	r io.Reader
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	if len(p) > 5 {
+		p = p[:5]
+	}
+	return s.r.Read(p)
+}
+
+func TestUploadGoroutines(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		cancel bool
+	}{
+		{name: "completed"},
+		{name: "canceled", cancel: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var chunks int
+			tr := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				cr := req.Header.Get("Content-Range")
+				if cr == "bytes */*" {
+					return incompleteResponse(), nil
+				}
+				io.Copy(io.Discard, req.Body)
+				if chunks++; tc.cancel && chunks == 2 {
+					cancel()
+					<-req.Context().Done()
+					return nil, req.Context().Err()
+				}
+				if strings.HasSuffix(cr, "/*") {
+					return incompleteResponse(), nil
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			})
+			rx := &ResumableUpload{
+				Client:            &http.Client{Transport: tr},
+				URI:               "https://example.com/upload",
+				Media:             NewMediaBuffer(slowReader{strings.NewReader(strings.Repeat("a", 25))}, 10),
+				MediaType:         "text/plain",
+				PrefetchNextChunk: true,
+				CallbackQueueSize: 1,
+				Callback:          func(int64) {},
+				KeepAliveInterval: 2 * time.Millisecond,
+			}
+
+			before := goroutines.live.Load()
+			goroutines.peak.Store(before)
+			res, err := rx.Upload(ctx)
+			if tc.cancel {
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("Upload err: got %v, want context.Canceled", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Upload: %v", err)
+				}
+				res.Body.Close()
+			}
+
+			if tc.cancel {
+				// A read ahead under way on cancellation is abandoned,
+				// and ends when the slow media returns.
+				for deadline := time.Now().Add(time.Second); goroutines.live.Load() != before && time.Now().Before(deadline); {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			if live := goroutines.live.Load(); live != before {
+				t.Errorf("%d goroutines still running after Upload returned", live-before)
+			}
+			if n := goroutines.peak.Load() - before; n > maxUploadGoroutines {
+				t.Errorf("upload ran %d goroutines at once, want at most %d", n, maxUploadGoroutines)
+			}
+		})
+	}
+}
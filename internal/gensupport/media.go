@@ -44,7 +44,7 @@ func newMultipartReader(parts []typeReader, boundary string) *multipartReader {
 		mpw.SetBoundary(boundary)
 	}
 	mp.ctype = "multipart/related; boundary=" + mpw.Boundary()
-	go func() {
+	spawn(func() {
 		for _, part := range parts {
 			w, err := mpw.CreatePart(typeHeader(part.typ))
 			if err != nil {
@@ -62,7 +62,7 @@ func newMultipartReader(parts []typeReader, boundary string) *multipartReader {
 
 		mpw.Close()
 		pw.Close()
-	}()
+	})
 	return mp
 }
 
@@ -139,7 +139,7 @@ type MediaInfo struct {
 	buffer               *MediaBuffer
 	singleChunk          bool
 	mType                string
-	size                 int64 // mediaSize, if known.  Used only for calls to progressUpdater_.
+	size                 int64 // mediaSize, if known.  Used for calls to progressUpdater_ and as ResumableUpload.TotalSize.
 	progressUpdater      googleapi.ProgressUpdater
 	chunkRetryDeadline   time.Duration
 	chunkTransferTimeout time.Duration
@@ -285,7 +285,9 @@ func readerFunc(r io.Reader) func() io.Reader {
 }
 
 // ResumableUpload returns an appropriately configured ResumableUpload value if the
-// upload is resumable, or nil otherwise.
+// upload is resumable, or nil otherwise. The session at locURI has already
+// been created, so NewSessionRequest, and the options that depend on it, are
+// left unset.
 func (mi *MediaInfo) ResumableUpload(locURI string) *ResumableUpload {
 	if mi == nil || mi.singleChunk {
 		return nil
@@ -294,6 +296,7 @@ func (mi *MediaInfo) ResumableUpload(locURI string) *ResumableUpload {
 		URI:       locURI,
 		Media:     mi.buffer,
 		MediaType: mi.mType,
+		TotalSize: mi.size,
 		Callback: func(curr int64) {
 			if mi.progressUpdater != nil {
 				mi.progressUpdater(curr, mi.size)
@@ -0,0 +1,137 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package otelmetrics records the events of resumable uploads as
+// OpenTelemetry metrics. It is kept apart from gensupport so that only users
+// of OpenTelemetry depend on it.
+package otelmetrics
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/api/internal/gensupport"
+)
+
+// Attribute keys set on the measurements.
+const (
+	// OutcomeKey is "success" or "failure", for uploads.
+	OutcomeKey = attribute.Key("upload.outcome")
+	// StatusCodeKey is the HTTP status code of a retried request, if it
+	// received a response.
+	StatusCodeKey = attribute.Key("http.response.status_code")
+	// ErrorTypeKey classifies the error of a retried request or a failed
+	// upload: see errorType and uploadErrorType.
+	ErrorTypeKey = attribute.Key("error.type")
+)
+
+// Recorder is a gensupport.MetricsRecorder backed by OpenTelemetry metrics.
+// It records:
+//
+//   - upload.uploads: the number of uploads, by OutcomeKey;
+//   - upload.duration: the wall time of uploads, in seconds, by OutcomeKey;
+//   - upload.bytes.transmitted: the media bytes sent, including retransmissions;
+//   - upload.bytes.committed: the media bytes committed by the server;
+//   - upload.retries: the number of retried requests, by StatusCodeKey and
+//     ErrorTypeKey;
+//   - upload.chunk.duration: the time from reading each chunk from the media
+//     until it was committed, in seconds.
+//
+// A Recorder is safe for concurrent use by multiple uploads.
+type Recorder struct {
+	uploads       metric.Int64Counter
+	duration      metric.Float64Histogram
+	transmitted   metric.Int64Counter
+	committed     metric.Int64Counter
+	retries       metric.Int64Counter
+	chunkDuration metric.Float64Histogram
+}
+
+// NewRecorder creates the instruments of a Recorder with m.
+func NewRecorder(m metric.Meter) (*Recorder, error) {
+	var r Recorder
+	var err error
+	if r.uploads, err = m.Int64Counter("upload.uploads",
+		metric.WithDescription("Number of resumable uploads."),
+		metric.WithUnit("{upload}")); err != nil {
+		return nil, fmt.Errorf("otelmetrics: %w", err)
+	}
+	if r.duration, err = m.Float64Histogram("upload.duration",
+		metric.WithDescription("Wall time of resumable uploads."),
+		metric.WithUnit("s")); err != nil {
+		return nil, fmt.Errorf("otelmetrics: %w", err)
+	}
+	if r.transmitted, err = m.Int64Counter("upload.bytes.transmitted",
+		metric.WithDescription("Media bytes sent, including retransmissions."),
+		metric.WithUnit("By")); err != nil {
+		return nil, fmt.Errorf("otelmetrics: %w", err)
+	}
+	if r.committed, err = m.Int64Counter("upload.bytes.committed",
+		metric.WithDescription("Media bytes committed by the server."),
+		metric.WithUnit("By")); err != nil {
+		return nil, fmt.Errorf("otelmetrics: %w", err)
+	}
+	if r.retries, err = m.Int64Counter("upload.retries",
+		metric.WithDescription("Number of retried requests."),
+		metric.WithUnit("{request}")); err != nil {
+		return nil, fmt.Errorf("otelmetrics: %w", err)
+	}
+	if r.chunkDuration, err = m.Float64Histogram("upload.chunk.duration",
+		metric.WithDescription("Time from reading a chunk from the media until it was committed."),
+		metric.WithUnit("s")); err != nil {
+		return nil, fmt.Errorf("otelmetrics: %w", err)
+	}
+	return &r, nil
+}
+
+// RecordUploadEvent implements gensupport.MetricsRecorder.
+func (r *Recorder) RecordUploadEvent(ctx context.Context, ev gensupport.UploadEvent) {
+	switch ev.Kind {
+	case gensupport.AttemptRetried:
+		attrs := []attribute.KeyValue{ErrorTypeKey.String(errorType(ev.Status, ev.Timeout))}
+		if ev.Status != 0 {
+			attrs = append(attrs, StatusCodeKey.Int(ev.Status))
+		}
+		r.retries.Add(ctx, 1, metric.WithAttributes(attrs...))
+	case gensupport.ChunkCommitted:
+		r.chunkDuration.Record(ctx, ev.Duration.Seconds())
+	case gensupport.UploadSucceeded, gensupport.UploadFailed:
+		attrs := []attribute.KeyValue{OutcomeKey.String("success")}
+		if ev.Kind == gensupport.UploadFailed {
+			attrs = []attribute.KeyValue{OutcomeKey.String("failure"), ErrorTypeKey.String(uploadErrorType(ev.Err))}
+		}
+		opt := metric.WithAttributes(attrs...)
+		r.uploads.Add(ctx, 1, opt)
+		r.duration.Record(ctx, ev.Duration.Seconds(), opt)
+		r.transmitted.Add(ctx, ev.BytesTransmitted)
+		r.committed.Add(ctx, ev.BytesCommitted)
+	}
+}
+
+// otherError is the ErrorTypeKey value of errors that cannot be classified,
+// as the OpenTelemetry conventions have it.
+const otherError = "_OTHER"
+
+// errorType returns the ErrorTypeKey value of a retried request: the status
+// code of its response, if any, or else the kind of timeout that failed it.
+func errorType(status int, timeout gensupport.TimeoutKind) string {
+	switch {
+	case status != 0:
+		return fmt.Sprint(status)
+	case timeout != gensupport.NoTimeout:
+		return timeout.String()
+	}
+	return otherError
+}
+
+// uploadErrorType returns the ErrorTypeKey value of a failed upload: the
+// type of err.
+func uploadErrorType(err error) string {
+	if err == nil {
+		return otherError
+	}
+	return fmt.Sprintf("%T", err)
+}
@@ -0,0 +1,132 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package otelmetrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/googleapis/gax-go/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"google.golang.org/api/internal/gensupport"
+)
+
+// measurement is a value recorded by an instrument of fakeMeter.
+type measurement struct {
+	name  string
+	value float64
+	attrs string
+}
+
+// fakeMeter records the measurements of its counters and histograms.
+type fakeMeter struct {
+	noop.Meter
+	got []measurement
+}
+
+func (m *fakeMeter) record(name string, v float64, attrs attribute.Set) {
+	m.got = append(m.got, measurement{name, v, attrs.Encoded(attribute.DefaultEncoder())})
+}
+
+type fakeCounter struct {
+	noop.Int64Counter
+	m    *fakeMeter
+	name string
+}
+
+func (c fakeCounter) Add(_ context.Context, v int64, opts ...metric.AddOption) {
+	c.m.record(c.name, float64(v), metric.NewAddConfig(opts).Attributes())
+}
+
+type fakeHistogram struct {
+	noop.Float64Histogram
+	m    *fakeMeter
+	name string
+}
+
+func (h fakeHistogram) Record(_ context.Context, v float64, opts ...metric.RecordOption) {
+	h.m.record(h.name, v, metric.NewRecordConfig(opts).Attributes())
+}
+
+func (m *fakeMeter) Int64Counter(name string, _ ...metric.Int64CounterOption) (metric.Int64Counter, error) {
+	return fakeCounter{m: m, name: name}, nil
+}
+
+func (m *fakeMeter) Float64Histogram(name string, _ ...metric.Float64HistogramOption) (metric.Float64Histogram, error) {
+	return fakeHistogram{m: m, name: name}, nil
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestRecorder(t *testing.T) {
+	m := &fakeMeter{}
+	rec, err := NewRecorder(m)
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	var requests int
+	rx := &gensupport.ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			io.Copy(io.Discard, req.Body)
+			requests++
+			if requests == 1 {
+				return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: http.NoBody}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+		})},
+		URI:       "https://example.com/upload",
+		Media:     gensupport.NewMediaBuffer(strings.NewReader("hello"), 256),
+		MediaType: "text/plain",
+		Retry:     &gensupport.RetryConfig{Backoff: &gax.Backoff{Initial: time.Millisecond}},
+		Metrics:   rec,
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+
+	var got []measurement
+	for _, g := range m.got {
+		if strings.HasSuffix(g.name, "duration") {
+			// Durations vary: only check that they were recorded.
+			g.value = 0
+		}
+		got = append(got, g)
+	}
+	want := []measurement{
+		{name: "upload.retries", value: 1, attrs: "error.type=503,http.response.status_code=503"},
+		{name: "upload.chunk.duration"},
+		{name: "upload.uploads", value: 1, attrs: "upload.outcome=success"},
+		{name: "upload.duration", attrs: "upload.outcome=success"},
+		{name: "upload.bytes.transmitted", value: 10},
+		{name: "upload.bytes.committed", value: 5},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(measurement{})); diff != "" {
+		t.Errorf("measurements mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestUploadErrorType(t *testing.T) {
+	if got, want := uploadErrorType(errors.New("x")), "*errors.errorString"; got != want {
+		t.Errorf("uploadErrorType: got %q, want %q", got, want)
+	}
+	if got := errorType(0, gensupport.DialTimeout); got != "DialTimeout" {
+		t.Errorf("errorType(0, DialTimeout): got %q, want %q", got, "DialTimeout")
+	}
+	if got := errorType(0, gensupport.NoTimeout); got != otherError {
+		t.Errorf("errorType(0, NoTimeout): got %q, want %q", got, otherError)
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import "context"
+
+// RequestPriority is a prioritization hint for a request, following the
+// urgency and incremental parameters of RFC 9218. It is carried in the request
+// context and has no effect unless the transport reads it with
+// RequestPriorityFromContext and supports prioritization, as some HTTP/2 and
+// HTTP/3 transports do.
+type RequestPriority struct {
+	// Urgency ranges from 0 (highest priority) to 7 (lowest priority). The
+	// RFC 9218 default is 3.
+	Urgency int
+	// Incremental reports whether the response can be processed
+	// incrementally.
+	Incremental bool
+}
+
+type requestPriorityKey struct{}
+
+// ContextWithRequestPriority returns a copy of ctx carrying the priority p.
+func ContextWithRequestPriority(ctx context.Context, p RequestPriority) context.Context {
+	return context.WithValue(ctx, requestPriorityKey{}, p)
+}
+
+// RequestPriorityFromContext returns the priority carried by ctx, if any.
+func RequestPriorityFromContext(ctx context.Context) (RequestPriority, bool) {
+	p, ok := ctx.Value(requestPriorityKey{}).(RequestPriority)
+	return p, ok
+}
@@ -0,0 +1,48 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ClientWithResolver returns a copy of c whose connections resolve host
+// names with r, for networks with split-horizon DNS or several resolvers
+// where the upload endpoint must be looked up differently from other hosts.
+// c is not modified; the result may be used as ResumableUpload.Client. If c
+// is nil, http.DefaultClient is copied.
+//
+// The transport of c must be nil, in which case a clone of
+// http.DefaultTransport is used, or an *http.Transport, which is cloned with
+// its DialContext replaced. A failure to resolve a name is retried if r
+// reports it as temporary or as a timeout, and not if the name does not
+// exist.
+func ClientWithResolver(c *http.Client, r *net.Resolver) (*http.Client, error) {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	rt := c.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("ClientWithResolver: transport is a %T, want an *http.Transport", rt)
+	}
+	t = t.Clone()
+	// The dialer settings match those of http.DefaultTransport.
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  r,
+	}
+	t.DialContext = d.DialContext
+	cc := *c
+	cc.Transport = t
+	return &cc, nil
+}
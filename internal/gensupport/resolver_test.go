@@ -0,0 +1,47 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClientWithResolver(t *testing.T) {
+	var lookups atomic.Int32
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			lookups.Add(1)
+			return nil, errors.New("resolver unavailable")
+		},
+	}
+	c, err := ClientWithResolver(nil, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == http.DefaultClient || c.Transport == http.DefaultTransport || http.DefaultClient.Transport != nil {
+		t.Fatal("ClientWithResolver modified the client it copied")
+	}
+	req, err := http.NewRequest("GET", "http://upload.example.test/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(req); err == nil {
+		t.Fatal("request succeeded, want a resolution failure")
+	}
+	if lookups.Load() == 0 {
+		t.Error("the custom resolver was not used")
+	}
+
+	base := &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) { return nil, nil })}
+	if _, err := ClientWithResolver(base, r); err == nil {
+		t.Error("ClientWithResolver accepted a transport that is not an *http.Transport")
+	}
+}
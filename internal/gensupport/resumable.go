@@ -5,16 +5,24 @@
 package gensupport
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/net/http/httpguts"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/internal"
 )
 
@@ -25,32 +33,634 @@ type ResumableUpload struct {
 	// URI is the resumable resource destination provided by the server after specifying "&uploadType=resumable".
 	URI       string
 	UserAgent string // User-Agent for header of the request
+
+	// NewSessionRequest, if set, returns the request that creates the upload
+	// session. If URI is empty, Upload first sends this request, with retries
+	// per Retry, and uses the Location header of the response as URI. The
+	// session may instead be created ahead of the upload with
+	// EstablishSession. MediaInfo.ResumableUpload, as used by generated
+	// code, leaves it nil, since the generated call creates the session
+	// itself; SessionEstablishTimeout, AlternateHosts and MaxSessionRestarts
+	// then have no effect. They only apply to a ResumableUpload built by the
+	// caller with NewSessionRequest set.
+	NewSessionRequest func() (*http.Request, error)
+
+	// SessionEstablishTimeout bounds the time taken to create the upload
+	// session with NewSessionRequest, including retries. On expiry, Upload
+	// fails with a *SessionEstablishTimeoutError. If zero,
+	// ChunkTransferTimeout is used.
+	SessionEstablishTimeout time.Duration
+
+	// AlternateHosts lists hosts, such as "uploads-b.example.com", to which
+	// the request from NewSessionRequest is redirected, in turn, when it
+	// keeps failing. The request is retried against each host but the last
+	// up to ChunkRetryDeadline, and fails over after a network error or a
+	// retryable response status. Only session creation fails over: once
+	// created, the session is pinned to the host in its URI.
+	AlternateHosts []string
+
+	// MaxSessionRestarts, if positive, makes Upload start the upload over,
+	// up to MaxSessionRestarts times, when the session expires mid-upload,
+	// as shown by a 404 or 410 response to a chunk. A new session is created
+	// with NewSessionRequest and the media is sent again from the start,
+	// which requires Media to implement io.Seeker. Once the restarts are
+	// exhausted, or if a restart fails, Upload fails with a
+	// *SessionExpiredError. If zero, or if NewSessionRequest is nil, such a
+	// response is returned as any other.
+	MaxSessionRestarts int
+
 	// Media is the object being uploaded.
 	Media *MediaBuffer
 	// MediaType defines the media type, e.g. "image/jpeg".
 	MediaType string
+	// TotalSize is the size of Media in bytes, or zero if it is not known in
+	// advance.
+	TotalSize int64
+
+	mu       sync.Mutex       // guards progress, samples, ledger, done and err
+	progress int64            // number of bytes uploaded so far
+	samples  []progressSample // recent progress, for EstimatedTimeRemaining
+	ledger   []ChunkRecord    // chunk records, if ChunkLedgerSize is set
+	done     chan struct{}    // closed when Upload returns; created lazily
+	finished bool             // whether done has been closed
+	err      error            // terminal error returned by Upload
 
-	mu       sync.Mutex // guards progress
-	progress int64      // number of bytes uploaded so far
+	// callbackErr is a *CallbackPanicError from a progress callback, if
+	// StrictCallbacks is set. It is guarded by mu.
+	callbackErr error
 
 	// Callback is an optional function that will be periodically called with the cumulative number of bytes uploaded.
+	//
+	// The values passed to Callback only increase. If the server loses data
+	// and the upload resumes from an earlier offset, Callback is not called
+	// again until the upload passes the highest value already reported.
+	// This holds for a single ResumableUpload only: an upload resumed by
+	// another process with ResumeFrom reports values from the offset
+	// committed by the server, and may repeat values that the earlier
+	// process reported.
 	Callback func(int64)
 
+	// FractionCallback, if set, is called alongside Callback with the
+	// fraction of the media uploaded, from 0 to 1. It is only called if
+	// TotalSize is known.
+	FractionCallback func(float64)
+
+	// CallbackQueueSize, if positive, makes Upload call Callback and
+	// FractionCallback on a dedicated goroutine, so that a slow callback
+	// does not stall the upload. Up to CallbackQueueSize updates are queued;
+	// when the queue is full, the oldest is dropped, since it is superseded
+	// by the newer ones. The last update is always delivered: Upload waits
+	// for queued updates to be delivered before it returns.
+	CallbackQueueSize int
+
+	// ReportPartialProgress makes Upload call Callback and FractionCallback
+	// when a status probe shows that the server accepted part of a chunk,
+	// before the rest is resent. By default, they are only called as whole
+	// chunks are committed. Either way, Progress counts the accepted bytes.
+	ReportPartialProgress bool
+
+	// A panic in Callback, FractionCallback, OnChunkAck, OnOffsetRegression,
+	// OnRequest, ChunkTrace, ChunkBoundaryFunc, ErrorMapper, Metrics or
+	// OnComplete is recovered and logged to Logger, and the upload
+	// continues. StrictCallbacks makes it fail the upload instead, with a
+	// *CallbackPanicError, after asking the server to discard the session.
+	// A panic in a progress callback run through CallbackQueueSize, in
+	// ChunkBoundaryFunc or in Metrics fails the upload when the next chunk
+	// is committed, and a panic once the final chunk has been committed, or
+	// in OnComplete, is only logged. A panic in OnRequest does not discard
+	// the session, one in ChunkBoundaryFunc leaves the chunk at the chunk
+	// size, and one in ErrorMapper leaves the error unmapped unless
+	// StrictCallbacks is set. A panic in ApproveURI, NewSessionRequest,
+	// ParseCommittedOffset or SkipIfExistsMatching, whose results the upload
+	// cannot do without, always fails it with a *CallbackPanicError.
+	StrictCallbacks bool
+
+	// OnChunkAck, if set, is called synchronously after each chunk is
+	// committed, with the number of bytes committed so far. Unlike Callback,
+	// it can stop the upload: if it returns an error, Upload fails with that
+	// error. It is suited to persisting progress durably before continuing; a
+	// slow OnChunkAck deliberately slows the upload down.
+	OnChunkAck func(offset int64) error
+
+	// ResumeFrom, if set, resumes an upload started by another process,
+	// from a Checkpoint it persisted. Upload uses the session URI of the
+	// checkpoint unless URI is set, asks the server how much media it has
+	// committed, and skips that much of Media before sending the rest. Media
+	// must yield the same data as in the earlier process, from its start.
+	ResumeFrom *Checkpoint
+
+	// VerifySourcePrefix configures Upload, when resuming from ResumeFrom,
+	// to re-read the media up to the checkpoint's offset and compare its
+	// checksum with the checkpoint's PrefixCRC32C. On a mismatch, the source
+	// has changed, and Upload fails with a *SourcePrefixMismatchError
+	// without sending media. Re-reading the prefix may be costly; without
+	// VerifySourcePrefix, a Media that implements io.Seeker is seeked past
+	// it instead.
+	VerifySourcePrefix bool
+
+	// CheckpointChecksum configures Upload to maintain the CRC32C checksum
+	// of the committed media, reported by Checkpoint for use with
+	// VerifySourcePrefix, at the cost of hashing each chunk.
+	CheckpointChecksum bool
+
 	// Retry optionally configures retries for requests made against the upload.
 	Retry *RetryConfig
 
+	// FinalizeRetry, if set, configures retries of the final chunk, whose
+	// request finalizes the object, in place of Retry. Re-sending the final
+	// chunk is usually cheap, so it may warrant more patience than
+	// intermediate chunks. If nil, Retry applies to all chunks.
+	FinalizeRetry *RetryConfig
+
 	// ChunkRetryDeadline configures the per-chunk deadline after which no further
 	// retries should happen.
 	ChunkRetryDeadline time.Duration
 
+	// TotalDeadline, if positive, bounds the wall time of the whole upload,
+	// from the first call to Upload or Step, including session creation,
+	// retries and pauses between them. When it passes, Upload fails with a
+	// *TotalDeadlineExceededError. Summary reports how much of it was used.
+	TotalDeadline time.Duration
+
+	// SoftTimeBudget, if positive, is a budget for the wall time of the
+	// whole upload that, unlike TotalDeadline, is enforced ahead of time:
+	// before each chunk, Upload projects when the upload will complete, and
+	// fails with a *ProjectedOverrunError if that is past the budget. The
+	// projection requires TotalSize and two committed chunks, and is
+	// conservative: it assumes the better of the recent and the overall
+	// throughput, both measured in wall time, so including the pauses
+	// between retries.
+	SoftTimeBudget time.Duration
+
 	// ChunkTransferTimeout configures the per-chunk transfer timeout. If a chunk upload stalls for longer than
-	// this duration, the upload will be retried.
+	// this duration, the upload will be retried, if the retry predicate
+	// accepts the *ChunkTimeoutError reporting it, as the default one does.
+	// If retries of the chunk stop after a timed-out attempt, Upload returns
+	// a *ChunkTimeoutError. Expiry of the context passed to Upload is never
+	// retried. If Logger is set and the first successful chunk request takes
+	// most of the timeout, a warning suggesting a larger value is logged
+	// once.
 	ChunkTransferTimeout time.Duration
 
+	// A retried chunk request waits at least as long as the server asks in a
+	// Retry-After response header, up to MaxRetryAfter, which defaults to 1
+	// minute. An HTTP-date in Retry-After is compared with the local clock:
+	// one up to RetryAfterSkewTolerance in the past, which defaults to 5
+	// seconds, is taken to mean "retry soon" and honored with a pause of one
+	// second, as the difference may be due to clock skew. Dates further in
+	// the past are ignored. A negative RetryAfterSkewTolerance disables the
+	// tolerance. Pauses are still cut short by ChunkRetryDeadline.
+	MaxRetryAfter           time.Duration
+	RetryAfterSkewTolerance time.Duration
+
+	// VerifyChunkGranularity configures Upload to probe the session before
+	// sending media, and check the chunk size against the granularity the
+	// server reports in the X-Goog-Upload-Chunk-Granularity response header.
+	// If the chunk size is not a multiple of it, Upload fails with a
+	// *ChunkGranularityError, unless SnapChunkSize is set, in which case the
+	// chunk size is reduced to a multiple of the granularity. It costs a
+	// round trip, and standard Cloud Storage endpoints use 256 KiB, so it is
+	// off by default.
+	VerifyChunkGranularity bool
+	SnapChunkSize          bool
+
+	// ShrinkChunkAfterTimeouts, if positive, is the number of consecutive
+	// attempts at a chunk that must time out, per ChunkTransferTimeout,
+	// before the chunk size is halved. The reduced size is a multiple of
+	// 256 KiB and at least MinChunkSize, and applies to the rest of the
+	// upload. Reductions are logged, reported to Metrics, and counted in the
+	// UploadSummary.
+	ShrinkChunkAfterTimeouts int
+
+	// MinChunkSize is the size below which chunks are not shrunk after
+	// timeouts. It defaults to 256 KiB.
+	MinChunkSize int
+
+	// MaxRequestBytes, if positive, caps the media bytes sent in a single
+	// request, for transports, proxies or servers with a hard limit on the
+	// request size. Chunks larger than the cap are transparently split: the
+	// chunk size is reduced to the largest multiple of 256 KiB within it.
+	// Upload fails if MaxRequestBytes is less than 256 KiB.
+	MaxRequestBytes int64
+
+	// ChunkBoundaryFunc, if set, chooses the length of each chunk, so that
+	// chunk boundaries, and hence resume points, can fall on the
+	// application's own record boundaries. It is called with the offset of
+	// the chunk in the media and the chunk size, and its result is rounded
+	// down to a multiple of 256 KiB, with a minimum of 256 KiB, and capped
+	// at the chunk size. The final chunk may be shorter. If nil, every chunk
+	// but the last has the chunk size.
+	ChunkBoundaryFunc func(offset, maxChunk int64) int64
+
+	// PrefetchNextChunk makes Upload read the next chunk from Media while
+	// the current chunk is being sent, so that a slow source, such as one
+	// that compresses or reads from disk, does not leave the connection idle
+	// between chunks. At most one chunk is read ahead, so up to twice the
+	// chunk size is buffered. Retries of the current chunk do not disturb
+	// the chunk read ahead. Prefetching does not apply to a MediaBuffer that
+	// spills to disk, and a Flush takes effect only once the chunk read
+	// ahead has been sent. Upload waits for a read ahead under way when it
+	// returns, unless ctx is done: the read is then abandoned, as it may
+	// block on a pipe or a live stream, and Media must not be used again.
+	PrefetchNextChunk bool
+
+	// SequentialReadAhead, if set, advises the operating system before the
+	// media is read that it will be read sequentially, so that it reads
+	// ahead aggressively. It applies when the media is an *os.File, or a
+	// reader made from one by ReaderAtToReader or io.NewSectionReader, and
+	// helps the throughput of large local files. The advice is only given
+	// on Linux; elsewhere the option has no effect.
+	SequentialReadAhead bool
+
+	// DetectSourceSizeChange configures Upload to check, before each chunk,
+	// that the size of the media has not changed since Media was created,
+	// before any of it was read, and to fail with a *SourceSizeChangedError
+	// if it has, as happens when a file is written while it is uploaded. It
+	// applies when the media is an *os.File, or a reader with a Size() int64
+	// method, or a section of either made by ReaderAtToReader; the size of
+	// other sources, including media whose content type was sniffed, is not
+	// known, and they are not checked.
+	DetectSourceSizeChange bool
+
+	// MaxChunks, if positive, is the maximum number of chunks in the upload.
+	// Upload fails with a *TooManyChunksError rather than send more, having
+	// read at most one byte beyond the last chunk sent. It guards against a
+	// media source that never reaches EOF.
+	MaxChunks int
+
+	// MaxIdleProgress, if positive, bounds the time the upload may go without
+	// committing any bytes, across all attempts and chunks. When it elapses,
+	// Upload fails with an *UploadStalledError. Unlike ChunkRetryDeadline, it
+	// catches uploads that keep retrying without ever making progress.
+	MaxIdleProgress time.Duration
+
+	// ParseErrorBody configures Upload to read the body of a terminal non-2xx
+	// response, close it, and return the failure as a *googleapi.Error instead
+	// of returning the response. At most MaxResponseBodyBytes of the body
+	// is read.
+	ParseErrorBody bool
+
+	// ClassifyForbidden configures Upload to read the error reason from the
+	// body of a 403 response to a chunk. A 403 for exhausted quota or rate
+	// limits is retried like a 429, honoring Retry-After; any other 403
+	// fails the upload at once with a *PermissionDeniedError. At most
+	// MaxResponseBodyBytes of the body is read. By default, a 403 is
+	// returned without retrying.
+	ClassifyForbidden bool
+
+	// RetryConflict configures Upload to retry a chunk refused with a 409
+	// Conflict response, for backends where a conflict is transient. By
+	// default, a 409, which may report a concurrent writer or a generation
+	// conflict, fails the upload at once with a *ConflictError, whatever
+	// the retry predicate says. At most MaxResponseBodyBytes of the body is
+	// read.
+	RetryConflict bool
+
+	// LenientResumeIncomplete configures Upload to treat a 200 response with
+	// an empty body and a Range header as incomplete, as if it carried the
+	// "X-Http-Status-Code-Override: 308" header, for servers that honor
+	// "X-GUploader-No-308" but omit the override header. By default,
+	// detection is strict, and such a response is taken as the end of the
+	// upload.
+	LenientResumeIncomplete bool
+
+	// MaxEgressBytes, if positive, caps the total number of media bytes sent
+	// over the course of the upload, including retransmissions of retried
+	// chunks. A request that would exceed the cap is not sent and Upload
+	// returns an *EgressBudgetExceededError.
+	MaxEgressBytes int64
+
+	// Quota, if set, paces the upload to stay under a rolling byte quota.
+	// Before each chunk request, including retries, Upload waits until the
+	// bytes it is about to send fit within the quota's window. If Quota is
+	// nil, the Group's Quota applies, if any.
+	Quota *RollingQuota
+
+	// SkipIfExistsMatching, if set, is called by Upload before any media is
+	// transferred. If it reports true, for example because the destination
+	// already holds identical content, Upload returns without sending any
+	// requests. The response returned in that case has status 200 OK and an
+	// empty body. An error from SkipIfExistsMatching is returned by Upload.
+	SkipIfExistsMatching func(ctx context.Context) (bool, error)
+
+	// ApproveURI, if set, is called with the session URI once before any
+	// media is transferred. If it returns an error, the session is cancelled
+	// with a DELETE request and Upload returns that error. It allows callers
+	// to apply arbitrary policy checks to the upload destination.
+	ApproveURI func(uri string) error
+
+	// ExpectedBucket and ExpectedObject, if set, are checked against the
+	// bucket and object named by URI before any media is sent, guarding
+	// against resuming a persisted session with the wrong media. They follow
+	// the Cloud Storage JSON API format, in which the bucket is the path
+	// segment after "/b/" and the object is the "name" query parameter. On
+	// disagreement, including when URI does not name them, Upload fails with
+	// a *SessionTargetMismatchError. Other backends format URIs differently,
+	// so the check is off by default.
+	ExpectedBucket string
+	ExpectedObject string
+
+	// ProbeBeforeRetry configures the upload to query the server for the
+	// number of bytes it has committed before retrying a failed chunk request.
+	// The chunk is then resent from the committed offset rather than in full.
+	// If the probe fails, the chunk is resent in full. The probe is bounded
+	// by ChunkTransferTimeout and counts against ChunkRetryDeadline and
+	// TotalDeadline, like the chunk requests themselves.
+	ProbeBeforeRetry bool
+
+	// ProbeOnConnReset is like ProbeBeforeRetry, but only probes before
+	// retrying a chunk request whose connection was reset or broken, as on
+	// a flaky connection. Part of a large chunk may have been committed
+	// before the connection failed, so resuming from the committed offset
+	// saves resending it.
+	ProbeOnConnReset bool
+
+	// OnOffsetRegression, if set, is called when a status probe shows that the
+	// server has committed fewer bytes (server) than were previously reported
+	// as uploaded (local). The upload then resumes from the server's offset,
+	// which requires the media to implement io.Seeker; otherwise it fails.
+	OnOffsetRegression func(local, server int64)
+
+	// ParseCommittedOffset, if set, replaces the parsing of the number of
+	// bytes committed by the server from an incomplete upload status
+	// response, for backends that report it differently from Cloud Storage,
+	// whose Range header reads "bytes=0-42". It returns the number of bytes
+	// committed, and whether resp reported a committed range at all; if
+	// not, no bytes are committed. An error fails the status probe.
+	ParseCommittedOffset func(resp *http.Response) (committed int64, ok bool, err error)
+
+	// KeepAliveInterval, if positive, enables keep-alive status probes between
+	// chunks. While the media takes longer than KeepAliveInterval to produce
+	// the next chunk, a status probe is sent once per interval so that the
+	// connection is not dropped as idle. Probes are skipped when the Group's
+	// probe limit is reached.
+	KeepAliveInterval time.Duration
+
+	// ChunkReadTimeout, if positive, bounds the time taken to read each
+	// chunk from Media, which ChunkTransferTimeout does not cover. If the
+	// media does not produce a chunk in time, Upload fails with a
+	// *SourceReadTimeoutError. The read cannot be interrupted, so it is
+	// abandoned: it goes on in the background until the media returns, and
+	// Media must not be used again.
+	ChunkReadTimeout time.Duration
+
+	// Group, if set, is the UploaderGroup whose shared limits apply to this
+	// upload.
+	Group *UploaderGroup
+
+	// RecordTo, if set, receives a RecordedExchange, encoded as a line of
+	// JSON, for each request made by the upload. Only metadata is recorded;
+	// media bytes, credentials and the upload_id of the session URI are not.
+	// Recordings can be replayed with the uploadtest package to reproduce a
+	// sequence of retries deterministically.
+	RecordTo io.Writer
+
+	// Middleware wraps the transport of Client for the requests of this
+	// upload, without modifying Client. The first function is outermost: it
+	// sees each request first and its response last. Every request of the
+	// upload, including session initiation and status probes, passes through
+	// the chain. When RecordTo is set, the recording sits beneath the chain.
+	Middleware []func(http.RoundTripper) http.RoundTripper
+
+	// ChunkLedgerSize, if positive, makes Upload keep a ChunkRecord for each
+	// chunk, available from ChunkLedger. Only the last ChunkLedgerSize
+	// records are kept, which bounds the memory used by uploads of many
+	// chunks.
+	ChunkLedgerSize int
+
+	// CaptureResponseHeaders lists headers to copy from the final success
+	// response into UploadSummary.ResponseHeaders, such as
+	// "X-Goog-Generation" or "ETag". At most 32 headers are captured, and
+	// each value is truncated to 1 KiB; the values of a repeated header are
+	// joined with ", ".
+	CaptureResponseHeaders []string
+
+	// ChunkTrace, if set, is called before each chunk request, including
+	// retries, with the index of the chunk, counting from 0. The trace it
+	// returns, if not nil, is attached to the request's context, giving
+	// access to connection-level events such as DNS lookups, dials and TLS
+	// handshakes. The library attaches a trace of its own to measure the
+	// request; the two compose as described at httptrace.WithClientTrace,
+	// with the library's hooks called before those of ChunkTrace. Hooks may
+	// be called from other goroutines.
+	ChunkTrace func(chunkIndex int) *httptrace.ClientTrace
+
+	// ProduceManifest configures the upload to compute digests of the media
+	// and, on success, assemble a Manifest describing the uploaded object. The
+	// manifest is available from the Manifest method after Upload returns.
+	ProduceManifest bool
+
+	// MissingMetadata says what Upload does when ProduceManifest is set and
+	// the final response lacks the object metadata it expects, the
+	// generation and CRC32C hash, as custom backends may. By default, a
+	// warning is logged and the missing fields are left out of the manifest.
+	MissingMetadata MissingMetadataPolicy
+
+	// IdempotencyHeaderName is the request header that carries the
+	// idempotency token of the session request and of each chunk. It
+	// defaults to "X-Goog-Gcs-Idempotency-Token", which is used by Cloud
+	// Storage; other services may expect a header such as "Idempotency-Key".
+	// It must be a valid HTTP header field name.
+	IdempotencyHeaderName string
+
+	// RotateTokenAfterAttempts and RotateTokenAfter, if positive, replace the
+	// idempotency token of a chunk after that many attempts with it, or once
+	// it has been in use for that long, for backends that expire tokens. By
+	// default, a chunk keeps one token across all its retries. A new token
+	// forfeits the server's deduplication of the attempts made with the old
+	// one: if one of them was applied but its response lost, the chunk may be
+	// applied again. Uploads that rely on exactly-once semantics should leave
+	// rotation off.
+	RotateTokenAfterAttempts int
+	RotateTokenAfter         time.Duration
+
+	// OmitInvocationID configures chunk requests to leave the
+	// gccl-invocation-id key out of the X-Goog-Api-Client header. The key
+	// carries the same per-chunk token as the idempotency header, which is
+	// sent regardless, and is included by default for compatibility.
+	OmitInvocationID bool
+
+	// VerifyIdempotencyEcho configures Upload to check that successful chunk
+	// responses echo the idempotency token in the same header, which catches
+	// intermediaries that strip the header. A missing or mismatched echo is
+	// logged as a warning, or, if StrictIdempotencyEcho is also set, fails
+	// the upload with an *IdempotencyEchoError.
+	VerifyIdempotencyEcho bool
+	StrictIdempotencyEcho bool
+
+	// MaxHeaderBytes, if positive, caps the total size of the headers of each
+	// upload request. A request whose headers would exceed it is not sent,
+	// and Upload fails with a *HeaderTooLargeError. This turns a rejection by
+	// a gateway with a header size limit into a clear local error.
+	MaxHeaderBytes int
+
+	// WriteBufferSize, if positive, is the size of a buffer through which the
+	// body of each chunk request is read by the transport. Chunks are already
+	// held in memory, so buffering is off by default; it can batch reads from
+	// the chunk body into fewer, larger writes to the connection.
+	WriteBufferSize int
+
+	// ExpectContinue configures chunk requests to carry an
+	// "Expect: 100-continue" header, so that the server may reject a request,
+	// for example for authorization or quota reasons, before its body is
+	// sent. A rejection is treated like any other response and is subject to
+	// the retry policy. It only saves bandwidth if the client's transport
+	// waits for the server's interim response: with net/http, the
+	// http.Transport's ExpectContinueTimeout must be positive, and bounds
+	// how long the transport waits before sending the body anyway.
+	ExpectContinue bool
+
+	// RequestPriority, if set, is attached to the context of each upload
+	// request as a hint for transports that support prioritization, such as
+	// to yield to interactive traffic sharing a connection. See
+	// RequestPriorityFromContext. It has no effect with other transports.
+	RequestPriority *RequestPriority
+
+	// MaxResponseBodyBytes bounds the size of any response body read by the
+	// library, such as when ParseErrorBody or ProduceManifest is set. A
+	// longer body fails the upload with a *ResponseTooLargeError. The default
+	// is 4 MiB.
+	MaxResponseBodyBytes int64
+
+	// RequestID, if set, is a caller-supplied identifier correlating the
+	// telemetry of the whole upload: it is attached to log messages, metrics
+	// events and the UploadSummary. Unlike the invocation ID, it does not
+	// change between chunks. If it is empty and Logger or Metrics is set, a
+	// random ID is generated.
+	RequestID string
+
+	// RequestIDHeader, if set, is the name of a header in which the request
+	// ID is sent with each upload request.
+	RequestIDHeader string
+
+	// OnRequest, if set, is called just before each request is sent against
+	// the upload session: chunk requests, including retries and the final
+	// chunk, status probes, and cancellation. off and size describe the
+	// media carried; size is zero for requests without media, for which off
+	// is the number of bytes uploaded so far. attempt is the attempt number of
+	// the current chunk.
+	OnRequest func(method, url string, attempt int, off, size int64)
+
+	// HostHeader, if set, overrides the Host header of requests against the
+	// upload session, for gateways that route on a virtual host distinct from
+	// the host in URI. It must be a valid host, optionally with a port. It
+	// does not affect TLS: the connection is still made to the host in URI,
+	// which is also used for SNI and certificate verification.
+	HostHeader string
+
+	// ErrorMapper, if set, is applied to any error before Upload returns it,
+	// for translation into a caller's own error taxonomy. The mapped error is
+	// also reported by Err and Summary. To keep errors.Is and errors.As
+	// working, the mapper should wrap the error it is given. If it returns
+	// nil, the original error is kept.
+	ErrorMapper func(err error) error
+
+	// Metrics, if set, receives events distinguishing retried attempts from
+	// the eventual outcome of the upload. The outcome is reported for every
+	// upload, including those rejected by validation before any request is
+	// sent.
+	Metrics MetricsRecorder
+
+	// OnComplete, if set, is called with the summary of the upload just
+	// before Upload returns, whether it succeeded or failed. It is called
+	// even when Upload fails before sending any request, such as on invalid
+	// configuration, with Success false and the error in Err.
+	OnComplete func(UploadSummary)
+
+	// Logger, if non-nil, receives diagnostic messages about the upload.
+	Logger *slog.Logger
+
+	// WarnRetransmissionRatio, if positive, makes Upload log a warning when
+	// it ends with UploadSummary.RetransmissionRatio above this value. A
+	// high ratio points at a chunk size or timeouts ill suited to the
+	// network path. It requires Logger.
+	WarnRetransmissionRatio float64
+
+	// httpClient is the client used for requests, derived from Client. It is
+	// created by client.
+	httpClient *http.Client
+
+	digests  *mediaDigests // running digests of committed media, if ProduceManifest
+	manifest *Manifest     // guarded by mu
+
+	// stats accumulates the summary of the upload. It is only accessed by the
+	// goroutine running Upload, and is published to summary by finish.
+	stats   UploadSummary
+	summary UploadSummary // guarded by mu
+	// startProgress is the progress when the upload started, or resumed
+	// from ResumeFrom, for SoftTimeBudget and RetransmissionRatio. It is only
+	// accessed by the goroutine running Upload.
+	startProgress int64
+
+	// sourceSize is the size of the media when Media was created, before
+	// any of it was read, or -1 if it is not known, for
+	// DetectSourceSizeChange. It is only accessed by the goroutine running
+	// Upload.
+	sourceSize int64
+
+	// accounting tracks the media bytes sent, for checkByteAccounting. It is
+	// only accessed by the goroutine running Upload.
+	accounting byteAccounting
+
 	// Track current request invocation ID and attempt count for retry metrics
 	// and idempotency headers.
 	invocationID string
 	attempts     int
+
+	// lastProgress is the time at which bytes were last committed, or at
+	// which Upload started. It is only accessed by the goroutine running
+	// Upload.
+	lastProgress time.Time
+
+	// timeoutChecked reports whether warnShortChunkTimeout has checked
+	// ChunkTransferTimeout against a successful chunk request. It is only
+	// accessed by the goroutine running Upload.
+	timeoutChecked bool
+
+	// servers holds the identities of the servers that answered chunk
+	// requests, counted in stats.DistinctServers. It is only accessed by the
+	// goroutine running Upload.
+	servers map[string]bool
+
+	// mediaAbandoned reports whether a read from Media timed out, or a read
+	// ahead was still under way when the upload was canceled, and was left
+	// running, after which Media must not be touched. It is only accessed by
+	// the goroutine running Upload.
+	mediaAbandoned bool
+
+	// finalSent reports whether the final chunk has been committed. It is
+	// only accessed by the goroutine running Upload.
+	finalSent bool
+
+	// reported is the highest value passed to the progress callbacks. It is
+	// only accessed by the goroutine running Upload.
+	reported int64
+
+	// chunk describes the chunk being uploaded, for the ledger. It is only
+	// accessed by the goroutine running Upload.
+	chunk ChunkRecord
+
+	// prefixCRC is the CRC32C checksum of the committed media, valid if
+	// prefixCRCValid is set. They are only accessed by the goroutine running
+	// Upload, and are published to checkpoint by updateCheckpoint.
+	prefixCRC      crc32cWriter
+	prefixCRCValid bool
+	checkpoint     Checkpoint // guarded by mu
+
+	// chunkStart is the time at which loading of the current chunk from
+	// Media began, and chunkRead is how long the loading took. They are only
+	// accessed by the goroutine running Upload.
+	chunkStart time.Time
+	chunkRead  time.Duration
+
+	// progressQueue delivers progress updates if CallbackQueueSize is set.
+	// It is only accessed by the goroutine running Upload.
+	progressQueue *progressQueue
+	// stepping reports whether an upload driven by Step is under way, and
+	// startTime is when it started. They are only accessed by the goroutine
+	// running Upload.
+	stepping  bool
+	startTime time.Time
 }
 
 // Progress returns the number of bytes uploaded at this point.
@@ -60,6 +670,93 @@ func (rx *ResumableUpload) Progress() int64 {
 	return rx.progress
 }
 
+// Done returns a channel that is closed when Upload returns. It may be called
+// before or after Upload starts, and from any goroutine. An upload started
+// over after it is done, by another call to Upload or Step, has a new
+// channel.
+func (rx *ResumableUpload) Done() <-chan struct{} {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	return rx.doneChan()
+}
+
+// Err returns the error returned by Upload once Done is closed. Before then,
+// and when Upload succeeded, it returns nil.
+func (rx *ResumableUpload) Err() error {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	return rx.err
+}
+
+// doneChan returns rx.done, creating it if necessary. rx.mu must be held.
+func (rx *ResumableUpload) doneChan() chan struct{} {
+	if rx.done == nil {
+		rx.done = make(chan struct{})
+	}
+	return rx.done
+}
+
+// finish records the terminal error of Upload and closes the Done channel.
+func (rx *ResumableUpload) finish(err error) {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	if rx.finished {
+		return
+	}
+	rx.stats.Success = err == nil
+	rx.stats.Err = err
+	rx.stats.BytesCommitted = rx.progress
+	rx.stats.RetransmissionRatio = retransmissionRatio(rx.stats.BytesTransmitted, rx.progress-rx.startProgress)
+	rx.summary = rx.stats
+	if rx.manifest != nil {
+		rx.manifest.Timing = rx.stats.Timing
+	}
+	rx.err = err
+	rx.finished = true
+	close(rx.doneChan())
+}
+
+// defaultIdempotencyHeaderName is the header carrying the idempotency token
+// unless IdempotencyHeaderName is set.
+const defaultIdempotencyHeaderName = "X-Goog-Gcs-Idempotency-Token"
+
+func (rx *ResumableUpload) idempotencyHeaderName() string {
+	if rx.IdempotencyHeaderName == "" {
+		return defaultIdempotencyHeaderName
+	}
+	return rx.IdempotencyHeaderName
+}
+
+// client returns the HTTP client to use for the requests of the upload.
+func (rx *ResumableUpload) client() *http.Client {
+	if rx.httpClient != nil {
+		return rx.httpClient
+	}
+	rx.httpClient = rx.Client
+	if rx.RecordTo == nil && len(rx.Middleware) == 0 {
+		return rx.httpClient
+	}
+	c := http.Client{}
+	if rx.Client != nil {
+		c = *rx.Client
+	}
+	if rx.RecordTo != nil {
+		c.Transport = newRecordingTransport(c.Transport, rx.RecordTo)
+	}
+	if len(rx.Middleware) > 0 {
+		rt := c.Transport
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		for i := len(rx.Middleware) - 1; i >= 0; i-- {
+			rt = rx.Middleware[i](rt)
+		}
+		c.Transport = rt
+	}
+	rx.httpClient = &c
+	return rx.httpClient
+}
+
 // doUploadRequest performs a single HTTP request to upload data.
 // off specifies the offset in rx.Media from which data is drawn.
 // size is the number of bytes in data.
@@ -84,15 +781,20 @@ func (rx *ResumableUpload) doUploadRequest(ctx context.Context, data io.Reader,
 	req.Header.Set("Content-Range", contentRange)
 	req.Header.Set("Content-Type", rx.MediaType)
 	req.Header.Set("User-Agent", rx.UserAgent)
+	rx.setRequestIDHeader(req)
 
 	// TODO(b/274504690): Consider dropping gccl-invocation-id key since it
 	// duplicates the X-Goog-Gcs-Idempotency-Token header (added in v0.115.0).
+	// Until then, OmitInvocationID allows callers to drop it.
 	baseXGoogHeader := "gl-go/" + GoVersion() + " gdcl/" + internal.Version
 	invocationHeader := fmt.Sprintf("gccl-invocation-id/%s gccl-attempt-count/%d", rx.invocationID, rx.attempts)
+	if rx.OmitInvocationID {
+		invocationHeader = fmt.Sprintf("gccl-attempt-count/%d", rx.attempts)
+	}
 	req.Header.Set("X-Goog-Api-Client", strings.Join([]string{baseXGoogHeader, invocationHeader}, " "))
 
 	// Set idempotency token header which is used by GCS uploads.
-	req.Header.Set("X-Goog-Gcs-Idempotency-Token", rx.invocationID)
+	req.Header.Set(rx.idempotencyHeaderName(), rx.invocationID)
 
 	// Google's upload endpoint uses status code 308 for a
 	// different purpose than the "308 Permanent Redirect"
@@ -102,8 +804,313 @@ func (rx *ResumableUpload) doUploadRequest(ctx context.Context, data io.Reader,
 	// and sets the upload-specific "X-HTTP-Status-Code-Override:
 	// 308" response header.
 	req.Header.Set("X-GUploader-No-308", "yes")
+	if rx.ExpectContinue && size > 0 {
+		req.Header.Set("Expect", "100-continue")
+	}
+
+	return rx.send(ctx, req, off, size)
+}
+
+// send sends req, one of the requests made against the upload session, which
+// carries size bytes of media from offset off.
+func (rx *ResumableUpload) send(ctx context.Context, req *http.Request, off, size int64) (*http.Response, error) {
+	if err := rx.checkHeaderBytes(req); err != nil {
+		return nil, err
+	}
+	if rx.OnRequest != nil {
+		// The session cannot be discarded: that request would panic too.
+		if err := rx.callHook(ctx, "OnRequest", func() { rx.OnRequest(req.Method, req.URL.String(), rx.attempts, off, size) }); err != nil {
+			return nil, err
+		}
+	}
+	if rx.HostHeader != "" {
+		req.Host = rx.HostHeader
+	}
+	return SendRequest(rx.requestContext(ctx), rx.client(), req)
+}
+
+// validHost reports whether h is a valid host, with an optional port, for
+// use as a Host header.
+func validHost(h string) bool {
+	if !httpguts.ValidHostHeader(h) || strings.ContainsAny(h, "/?#@") {
+		return false
+	}
+	host := h
+	if i := strings.LastIndex(h, ":"); i > strings.LastIndex(h, "]") {
+		if _, err := strconv.ParseUint(h[i+1:], 10, 16); err != nil {
+			return false
+		}
+		host = h[:i]
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		ip := net.ParseIP(host[1 : len(host)-1])
+		return ip != nil && ip.To4() == nil
+	}
+	return host != "" && !strings.ContainsAny(host, ":[]")
+}
+
+// requestContext returns the context for an upload request, carrying
+// RequestPriority if set.
+func (rx *ResumableUpload) requestContext(ctx context.Context) context.Context {
+	if rx.RequestPriority == nil {
+		return ctx
+	}
+	return ContextWithRequestPriority(ctx, *rx.RequestPriority)
+}
+
+// checkHeaderBytes returns a *HeaderTooLargeError if the headers of req
+// exceed MaxHeaderBytes. Each header line is counted as it would appear in
+// an HTTP/1.1 request, as "Name: value\r\n".
+func (rx *ResumableUpload) checkHeaderBytes(req *http.Request) error {
+	if rx.MaxHeaderBytes <= 0 {
+		return nil
+	}
+	var n int
+	for name, values := range req.Header {
+		for _, v := range values {
+			n += len(name) + len(": ") + len(v) + len("\r\n")
+		}
+	}
+	if n > rx.MaxHeaderBytes {
+		return &HeaderTooLargeError{Size: n, Limit: rx.MaxHeaderBytes}
+	}
+	return nil
+}
+
+// setRequestIDHeader sets the RequestIDHeader of req, if configured.
+func (rx *ResumableUpload) setRequestIDHeader(req *http.Request) {
+	if rx.RequestIDHeader != "" && rx.stats.RequestID != "" {
+		req.Header.Set(rx.RequestIDHeader, rx.stats.RequestID)
+	}
+}
+
+// checkIdempotencyEcho verifies, if VerifyIdempotencyEcho is set, that resp
+// echoes the idempotency token of the current chunk.
+func (rx *ResumableUpload) checkIdempotencyEcho(ctx context.Context, resp *http.Response) error {
+	if !rx.VerifyIdempotencyEcho {
+		return nil
+	}
+	name := rx.idempotencyHeaderName()
+	echoed := resp.Header.Get(name)
+	if echoed == rx.invocationID {
+		return nil
+	}
+	err := &IdempotencyEchoError{Header: name, Sent: rx.invocationID, Echoed: echoed}
+	if rx.StrictIdempotencyEcho {
+		return err
+	}
+	if l := rx.logger(); l != nil {
+		l.WarnContext(ctx, "resumable upload response did not echo the idempotency token", "error", err)
+	}
+	return nil
+}
+
+// drainAndClose reads resp.Body to EOF and closes it. If the Body is not both
+// read to EOF and closed, the Client's underlying RoundTripper may not be able
+// to re-use the persistent TCP connection to the server for a subsequent
+// "keep-alive" request. See https://pkg.go.dev/net/http#Client.Do
+//
+// A body known to be empty, as is typical of 308 responses, is closed without
+// being read. A body of unknown length (ContentLength -1) is always drained.
+func drainAndClose(resp *http.Response) {
+	drainAndCloseContext(context.Background(), resp)
+}
+
+// drainAndCloseContext is drainAndClose, except that it stops reading once
+// ctx is done, so that a slow body does not delay cancellation. The body is
+// then closed without being drained, and the connection is not reused. A
+// single read blocked on the network is interrupted by the transport, as the
+// request carries ctx.
+func drainAndCloseContext(ctx context.Context, resp *http.Response) {
+	if resp.ContentLength != 0 {
+		io.Copy(io.Discard, ctxReader{ctx: ctx, r: resp.Body})
+	}
+	resp.Body.Close()
+}
+
+// ctxReader is an io.Reader that fails with the error of ctx once it is
+// done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// uploadStatus is the state of an upload as reported by a status probe.
+type uploadStatus struct {
+	resp      *http.Response // the probe response, whose body is open
+	complete  bool           // whether the upload has been finalized
+	committed int64          // number of bytes committed, if not complete
+}
+
+// probeStatus queries the server for the state of the upload by sending an
+// empty request for an unknown range. Like a chunk request, the probe is
+// bounded by ChunkTransferTimeout, until its response body is closed.
+func (rx *ResumableUpload) probeStatus(ctx context.Context) (st *uploadStatus, err error) {
+	req, err := http.NewRequest("POST", rx.URI, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = 0
+	req.Header.Set("Content-Range", "bytes */*")
+	req.Header.Set("User-Agent", rx.UserAgent)
+	rx.setRequestIDHeader(req)
+	req.Header.Set("X-GUploader-No-308", "yes")
+	if rx.ChunkTransferTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rx.ChunkTransferTimeout)
+		defer func() {
+			if st == nil {
+				cancel()
+				return
+			}
+			st.resp.Body = &cancelOnClose{ReadCloser: st.resp.Body, cancel: cancel}
+		}()
+	}
+	resp, err := rx.send(ctx, req, rx.Progress(), 0)
+	if err != nil {
+		return nil, err
+	}
+	if rx.resumeIncomplete(resp) {
+		committed, err := rx.committedOffset(ctx, resp)
+		if err != nil {
+			drainAndClose(resp)
+			return nil, err
+		}
+		return &uploadStatus{resp: resp, committed: committed}, nil
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+		return &uploadStatus{resp: resp, complete: true}, nil
+	}
+	drainAndClose(resp)
+	return nil, fmt.Errorf("status probe: unexpected response status %d", resp.StatusCode)
+}
+
+// cancelSession asks the server to discard the upload session. It is best
+// effort: failures are ignored.
+func (rx *ResumableUpload) cancelSession(ctx context.Context) {
+	req, err := http.NewRequest("DELETE", rx.URI, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("User-Agent", rx.UserAgent)
+	rx.setRequestIDHeader(req)
+	resp, err := rx.send(ctx, req, rx.Progress(), 0)
+	if err != nil {
+		return
+	}
+	drainAndClose(resp)
+}
+
+// chunkGranularityHeader is the response header in which the server reports
+// the granularity to which non-final chunks must be aligned.
+const chunkGranularityHeader = "X-Goog-Upload-Chunk-Granularity"
+
+// verifyChunkGranularity probes the session and checks the chunk size against
+// the granularity reported by the server, snapping it if SnapChunkSize is set.
+func (rx *ResumableUpload) verifyChunkGranularity(ctx context.Context) error {
+	st, err := rx.probeStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("probing chunk granularity: %w", err)
+	}
+	drainAndClose(st.resp)
+	h := st.resp.Header.Get(chunkGranularityHeader)
+	if h == "" {
+		return nil
+	}
+	g, err := strconv.Atoi(h)
+	if err != nil || g <= 0 {
+		return fmt.Errorf("invalid %s header %q", chunkGranularityHeader, h)
+	}
+	size := rx.Media.chunkSize()
+	if size%g == 0 {
+		return nil
+	}
+	if !rx.SnapChunkSize || size < g {
+		return &ChunkGranularityError{ChunkSize: size, Granularity: g}
+	}
+	rx.Media.shrink(size - size%g)
+	return nil
+}
 
-	return SendRequest(ctx, rx.Client, req)
+// capChunkSize reduces the chunk size to fit within MaxRequestBytes, keeping
+// it a multiple of 256 KiB.
+func (rx *ResumableUpload) capChunkSize() error {
+	if rx.MaxRequestBytes <= 0 || int64(rx.Media.chunkSize()) <= rx.MaxRequestBytes {
+		return nil
+	}
+	size := rx.MaxRequestBytes - rx.MaxRequestBytes%int64(flushAlignment)
+	if size == 0 {
+		return fmt.Errorf("MaxRequestBytes %d is less than the minimum chunk size of %d bytes", rx.MaxRequestBytes, flushAlignment)
+	}
+	rx.Media.shrink(int(size))
+	return nil
+}
+
+// committedOffset returns the number of bytes the server has committed, as
+// reported by the Range header of an incomplete upload response, for example
+// "bytes=0-42". A missing header means that no bytes have been committed.
+func committedOffset(resp *http.Response) (int64, error) {
+	r := resp.Header.Get("Range")
+	if r == "" {
+		return 0, nil
+	}
+	var first, last int64
+	if _, err := fmt.Sscanf(r, "bytes=%d-%d", &first, &last); err != nil || first != 0 || last < first {
+		return 0, fmt.Errorf("malformed Range header %q in upload status response", r)
+	}
+	return last + 1, nil
+}
+
+// committedOffset is committedOffset, or ParseCommittedOffset if set.
+func (rx *ResumableUpload) committedOffset(ctx context.Context, resp *http.Response) (int64, error) {
+	if rx.ParseCommittedOffset == nil {
+		return committedOffset(resp)
+	}
+	var committed int64
+	var ok bool
+	var err error
+	if perr := rx.callDecisionHook(ctx, "ParseCommittedOffset", func() { committed, ok, err = rx.ParseCommittedOffset(resp) }); perr != nil {
+		return 0, perr
+	}
+	switch {
+	case err != nil:
+		return 0, fmt.Errorf("parsing committed offset from upload status response: %w", err)
+	case !ok:
+		return 0, nil
+	case committed < 0:
+		return 0, fmt.Errorf("parsing committed offset from upload status response: negative offset %d", committed)
+	}
+	return committed, nil
+}
+
+// resumeFrom repositions the upload at the offset committed by the server,
+// which is before the current chunk. It returns st.resp, which signals to
+// Upload that the upload is incomplete.
+func (rx *ResumableUpload) resumeFrom(ctx context.Context, st *uploadStatus) (*http.Response, error) {
+	local := rx.Progress()
+	if rx.OnOffsetRegression != nil {
+		if err := rx.callHook(ctx, "OnOffsetRegression", func() { rx.OnOffsetRegression(local, st.committed) }); err != nil {
+			st.resp.Body.Close()
+			rx.cancelSession(ctx)
+			return nil, err
+		}
+	}
+	if err := rx.Media.rewind(st.committed); err != nil {
+		st.resp.Body.Close()
+		return nil, fmt.Errorf("server committed offset %d is behind %d bytes uploaded, and media cannot be rewound: %w", st.committed, local, err)
+	}
+	rx.setProgress(st.committed)
+	// The digests cover media that the server no longer holds.
+	rx.digests = nil
+	rx.prefixCRCValid = false
+	return st.resp, nil
 }
 
 func statusResumeIncomplete(resp *http.Response) bool {
@@ -112,17 +1119,290 @@ func statusResumeIncomplete(resp *http.Response) bool {
 	return resp != nil && resp.Header.Get("X-Http-Status-Code-Override") == "308"
 }
 
+// resumeIncomplete is statusResumeIncomplete, also accepting a 200 response
+// with an empty body and a Range header if LenientResumeIncomplete is set.
+func (rx *ResumableUpload) resumeIncomplete(resp *http.Response) bool {
+	if statusResumeIncomplete(resp) {
+		return true
+	}
+	return rx.LenientResumeIncomplete && resp != nil && resp.StatusCode == http.StatusOK &&
+		resp.ContentLength == 0 && resp.Header.Get("Range") != ""
+}
+
+// logger returns Logger, annotated with the request ID, or nil if Logger is
+// not set.
+func (rx *ResumableUpload) logger() *slog.Logger {
+	if rx.Logger == nil || rx.stats.RequestID == "" {
+		return rx.Logger
+	}
+	return rx.Logger.With("requestID", rx.stats.RequestID)
+}
+
+// maxAdvisedChunkRequests is the number of chunk requests above which Upload
+// logs a warning suggesting a larger chunk size.
+var maxAdvisedChunkRequests int64 = 10000
+
+// warnExcessiveChunking logs a warning if the configured chunk size will
+// require more than maxAdvisedChunkRequests requests to upload TotalSize bytes.
+func (rx *ResumableUpload) warnExcessiveChunking(ctx context.Context) {
+	if rx.logger() == nil || rx.TotalSize <= 0 {
+		return
+	}
+	chunkSize := int64(rx.Media.chunkSize())
+	if chunkSize <= 0 {
+		return
+	}
+	requests := (rx.TotalSize + chunkSize - 1) / chunkSize
+	if requests <= maxAdvisedChunkRequests {
+		return
+	}
+	suggested := (rx.TotalSize + maxAdvisedChunkRequests - 1) / maxAdvisedChunkRequests
+	if r := suggested % googleapi.MinUploadChunkSize; r != 0 {
+		suggested += googleapi.MinUploadChunkSize - r
+	}
+	rx.logger().WarnContext(ctx, "resumable upload chunk size requires many requests; consider a larger chunk size",
+		"totalSize", rx.TotalSize, "chunkSize", chunkSize, "requests", requests, "suggestedChunkSize", suggested)
+}
+
+// shortChunkTimeoutFraction is the fraction of ChunkTransferTimeout that the
+// first successful chunk request must take for Upload to log a warning that
+// the timeout is too short.
+const shortChunkTimeoutFraction = 0.8
+
+// warnShortChunkTimeout logs a warning if elapsed, the duration of the first
+// successful chunk request, comes close to ChunkTransferTimeout: later chunks
+// are then likely to time out. Later calls do nothing.
+func (rx *ResumableUpload) warnShortChunkTimeout(ctx context.Context, elapsed time.Duration) {
+	if rx.timeoutChecked || rx.ChunkTransferTimeout <= 0 {
+		return
+	}
+	rx.timeoutChecked = true
+	l := rx.logger()
+	if l == nil || float64(elapsed) <= shortChunkTimeoutFraction*float64(rx.ChunkTransferTimeout) {
+		return
+	}
+	suggested := max((2 * elapsed).Round(time.Second), time.Second)
+	l.WarnContext(ctx, "resumable upload chunk request took most of ChunkTransferTimeout; consider a larger timeout",
+		"elapsed", elapsed, "chunkTransferTimeout", rx.ChunkTransferTimeout, "suggestedTimeout", suggested)
+}
+
+// defaultMaxResponseBodyBytes is the default for MaxResponseBodyBytes.
+const defaultMaxResponseBodyBytes = 4 << 20
+
+func (rx *ResumableUpload) maxResponseBodyBytes() int64 {
+	if rx.MaxResponseBodyBytes > 0 {
+		return rx.MaxResponseBodyBytes
+	}
+	return defaultMaxResponseBodyBytes
+}
+
+// readResponseBody reads the body of resp, returning a *ResponseTooLargeError
+// if it is longer than MaxResponseBodyBytes. It does not close the body.
+func (rx *ResumableUpload) readResponseBody(resp *http.Response) ([]byte, error) {
+	limit := rx.maxResponseBodyBytes()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, &ResponseTooLargeError{StatusCode: resp.StatusCode, Limit: limit}
+	}
+	return body, nil
+}
+
+// errorFromResponse reads the body of a non-2xx response, closes the body, and
+// returns the failure as a *googleapi.Error.
+func (rx *ResumableUpload) errorFromResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, err := rx.readResponseBody(resp)
+	var tooLarge *ResponseTooLargeError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
+	if err != nil {
+		return &googleapi.Error{Code: resp.StatusCode, Header: resp.Header}
+	}
+	return WrapError(googleapi.CheckResponseWithBody(resp, body))
+}
+
+// quotaReasons are the error reasons of a 403 response that report exhausted
+// quota or rate limits, rather than a lack of permission.
+var quotaReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"quotaExceeded":         true,
+	"dailyLimitExceeded":    true,
+}
+
+// classifyForbidden reads the error reason from the body of resp, a 403
+// response, and closes the body. It reports whether the reason is exhausted
+// quota; otherwise, it returns a *PermissionDeniedError.
+func (rx *ResumableUpload) classifyForbidden(resp *http.Response) (quota bool, err error) {
+	gerr, reason, err := rx.readErrorReason(resp)
+	if err != nil {
+		return false, err
+	}
+	if quotaReasons[reason] {
+		return true, nil
+	}
+	return false, &PermissionDeniedError{Reason: reason, Err: gerr}
+}
+
+// readErrorReason reads the body of resp, an error response, and closes the
+// body. The body is replaced with the bytes read, so that resp can still be
+// returned, for example when the retries of a quota 403 run out. It returns
+// the parsed error and the reason of its first item. A body that cannot be
+// read or parsed leaves the reason empty; one longer than
+// MaxResponseBodyBytes is reported as a *ResponseTooLargeError.
+func (rx *ResumableUpload) readErrorReason(resp *http.Response) (*googleapi.Error, string, error) {
+	body, err := rx.readResponseBody(resp)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	var tooLarge *ResponseTooLargeError
+	if errors.As(err, &tooLarge) {
+		return nil, "", err
+	}
+	gerr := &googleapi.Error{Code: resp.StatusCode, Header: resp.Header}
+	if cerr, ok := googleapi.CheckResponseWithBody(resp, body).(*googleapi.Error); ok {
+		gerr = cerr
+	}
+	var reason string
+	if len(gerr.Errors) > 0 {
+		reason = gerr.Errors[0].Reason
+	}
+	return gerr, reason, nil
+}
+
 // reportProgress calls a user-supplied callback to report upload progress.
 // If old==updated, the callback is not called.
 func (rx *ResumableUpload) reportProgress(old, updated int64) {
 	if updated-old == 0 {
 		return
 	}
-	rx.mu.Lock()
-	rx.progress = updated
-	rx.mu.Unlock()
+	rx.setProgress(updated)
+	rx.notifyProgress(updated)
+}
+
+// acceptPartial records that the server accepted the media up to committed,
+// part way through the current chunk.
+func (rx *ResumableUpload) acceptPartial(committed int64) {
+	rx.setProgress(committed)
+	rx.lastProgress = time.Now()
+	if rx.ReportPartialProgress {
+		rx.notifyProgress(committed)
+	}
+}
+
+// notifyProgress passes the number of bytes uploaded to the progress
+// callbacks, through progressQueue if set. Values no higher than those already
+// reported are dropped, so that the callbacks see monotonic progress across a
+// resume from an earlier offset.
+func (rx *ResumableUpload) notifyProgress(updated int64) {
+	if updated <= rx.reported {
+		return
+	}
+	rx.reported = updated
+	if rx.progressQueue != nil {
+		rx.progressQueue.push(updated)
+		return
+	}
+	rx.deliverProgress(updated)
+}
+
+// deliverProgress calls the progress callbacks with the number of bytes
+// uploaded.
+func (rx *ResumableUpload) deliverProgress(updated int64) {
 	if rx.Callback != nil {
-		rx.Callback(updated)
+		if err := rx.callHook(context.Background(), "Callback", func() { rx.Callback(updated) }); err != nil {
+			rx.setCallbackErr(err)
+		}
+	}
+	if rx.FractionCallback != nil && rx.TotalSize > 0 {
+		f := min(float64(updated)/float64(rx.TotalSize), 1)
+		if err := rx.callHook(context.Background(), "FractionCallback", func() { rx.FractionCallback(f) }); err != nil {
+			rx.setCallbackErr(err)
+		}
+	}
+}
+
+// nextChunk loads the next chunk from rx.Media. If KeepAliveInterval is set,
+// keep-alive probes are sent while waiting for the media. If the media takes
+// longer than ChunkReadTimeout, the read is abandoned and a
+// *SourceReadTimeoutError is returned.
+func (rx *ResumableUpload) nextChunk(ctx context.Context) (off int64, size int, err error) {
+	keepAlive := rx.KeepAliveInterval > 0 && rx.stats.Requests > 0
+	if !keepAlive && rx.ChunkReadTimeout <= 0 {
+		_, off, size, err = rx.Media.Chunk()
+		return off, size, err
+	}
+	// The loading goroutine and a timeout agree under mu on whether the chunk
+	// was loaded in time; if not, the goroutine cleans up after the media
+	// returns, as end would have.
+	var (
+		mu               sync.Mutex
+		finished, gaveUp bool
+		lOff             int64
+		lSize            int
+		lErr             error
+	)
+	loaded := spawn(func() {
+		_, o, n, e := rx.Media.Chunk()
+		mu.Lock()
+		lOff, lSize, lErr = o, n, e
+		finished = true
+		cleanup := gaveUp
+		mu.Unlock()
+		if cleanup {
+			rx.Media.releaseSpill()
+			rx.Media.awaitPrefetch()
+		}
+	})
+	var tick, timeout <-chan time.Time
+	if keepAlive {
+		ticker := time.NewTicker(rx.KeepAliveInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	if rx.ChunkReadTimeout > 0 {
+		timer := time.NewTimer(rx.ChunkReadTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case <-loaded:
+			return lOff, lSize, lErr
+		case <-tick:
+			rx.keepAlive(ctx)
+		case <-timeout:
+			mu.Lock()
+			if finished {
+				mu.Unlock()
+				<-loaded
+				return lOff, lSize, lErr
+			}
+			gaveUp = true
+			mu.Unlock()
+			rx.mediaAbandoned = true
+			return 0, 0, &SourceReadTimeoutError{Offset: rx.Progress(), Timeout: rx.ChunkReadTimeout}
+		}
+	}
+}
+
+// keepAlive sends a status probe to keep the connection to the server warm,
+// ignoring the result.
+func (rx *ResumableUpload) keepAlive(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	release, ok := rx.Group.tryAcquireProbe()
+	if !ok {
+		return
+	}
+	defer release()
+	rx.stats.KeepAliveProbes++
+	if st, err := rx.probeStatus(ctx); err == nil {
+		drainAndClose(st.resp)
 	}
 }
 
@@ -145,20 +1425,57 @@ func (rx *ResumableUpload) transferChunk(ctx context.Context) (resp *http.Respon
 	default:
 	}
 
-	chunk, off, size, err := rx.Media.Chunk()
+	// Once MaxChunks chunks have been sent, no more media may follow. Media
+	// that ends exactly on a chunk boundary is only known to have ended when
+	// the next chunk comes up empty, so a single byte is read to tell,
+	// rather than a whole chunk.
+	atLimit := rx.MaxChunks > 0 && rx.stats.Chunks >= rx.MaxChunks
+	rx.Media.peek = atLimit
+
+	rx.chunkStart = time.Now()
+	off, size, err := rx.nextChunk(ctx)
+	rx.chunkRead = time.Since(rx.chunkStart)
+	rx.chunk = ChunkRecord{Offset: off, Size: int64(size)}
 	done := err == io.EOF
+	if rx.mediaAbandoned {
+		return nil, err
+	}
 	if !done && err != nil {
+		return nil, &SourceReadError{Offset: off + int64(size), Err: err}
+	}
+	if rx.finalSent && size > 0 {
+		return nil, &DataAfterFinalError{Offset: off, Size: size}
+	}
+	// An empty final chunk is sent as a zero-byte request, "bytes
+	// */<total>", which commits no media and so does not count against
+	// MaxChunks.
+	finalizeOnly := done && size == 0
+	if atLimit && !finalizeOnly {
+		return nil, &TooManyChunksError{Chunks: rx.stats.Chunks, Committed: rx.Progress()}
+	}
+	if err := rx.checkSourceSize(off); err != nil {
+		return nil, err
+	}
+	if err := rx.checkProjectedOverrun(); err != nil {
 		return nil, err
 	}
 
 	// Configure retryable error criteria.
-	errorFunc := rx.Retry.errorFunc()
+	retry := rx.Retry
+	if done && rx.FinalizeRetry != nil {
+		retry = rx.FinalizeRetry
+	}
+	errorFunc := retry.errorFunc()
 
 	// Each chunk gets its own initialized-at-zero backoff and invocation ID.
-	bo := rx.Retry.backoff()
+	bo := retry.backoff()
 	var pause time.Duration
+	var timeouts int      // consecutive attempts that hit ChunkTransferTimeout
+	var lastTimedOut bool // whether the last attempt hit ChunkTransferTimeout
+	var lastReset bool    // whether the last attempt lost its connection
 	rx.invocationID = uuid.New().String()
 	rx.attempts = 1
+	tokenAttempts, tokenIssued := 0, time.Now() // use of the current token
 
 	// Configure per-chunk retry deadline.
 	var retryDeadline time.Duration
@@ -169,12 +1486,15 @@ func (rx *ResumableUpload) transferChunk(ctx context.Context) (resp *http.Respon
 	}
 	quitAfterTimer := time.NewTimer(retryDeadline)
 	defer quitAfterTimer.Stop()
+	quitAt := time.Now().Add(retryDeadline)
 
 	for {
+		pauseStart := time.Now()
 		pauseTimer := time.NewTimer(pause)
 		select {
 		case <-ctx.Done():
 			pauseTimer.Stop()
+			rx.stats.Timing.Backoff += time.Since(pauseStart)
 			if err == nil {
 				err = ctx.Err()
 			}
@@ -182,9 +1502,11 @@ func (rx *ResumableUpload) transferChunk(ctx context.Context) (resp *http.Respon
 		case <-pauseTimer.C:
 		case <-quitAfterTimer.C:
 			pauseTimer.Stop()
-			return
+			rx.stats.Timing.Backoff += time.Since(pauseStart)
+			return resp, rx.chunkTimeoutError(off, lastTimedOut, err)
 		}
 		pauseTimer.Stop()
+		rx.stats.Timing.Backoff += time.Since(pauseStart)
 
 		// Check for context cancellation or timeout once more after backoff time.
 		// If more than one case in the select statement above was satisfied at the same time,
@@ -198,7 +1520,7 @@ func (rx *ResumableUpload) transferChunk(ctx context.Context) (resp *http.Respon
 			}
 			return
 		case <-quitAfterTimer.C:
-			return
+			return resp, rx.chunkTimeoutError(off, lastTimedOut, err)
 		default:
 		}
 
@@ -207,12 +1529,87 @@ func (rx *ResumableUpload) transferChunk(ctx context.Context) (resp *http.Respon
 		// timer may fire and cause us to return a response with a closed body
 		// (in which case, the caller will not get the error message in the body).
 		if resp != nil && resp.Body != nil {
-			// Read the body to EOF - if the Body is not both read to EOF and closed,
-			// the Client's underlying RoundTripper may not be able to re-use the
-			// persistent TCP connection to the server for a subsequent "keep-alive" request.
-			// See https://pkg.go.dev/net/http#Client.Do
-			io.Copy(io.Discard, resp.Body)
-			resp.Body.Close()
+			drainAndCloseContext(ctx, resp)
+		}
+		if err := rx.checkIdleProgress(off); err != nil {
+			return nil, err
+		}
+
+		// sendOff is the offset from which the chunk is sent. A status probe
+		// may show that the server already holds a prefix of the chunk.
+		sendOff := off
+		var probeCommitted bool
+		if (rx.ProbeBeforeRetry || rx.ProbeOnConnReset && lastReset) && rx.attempts > 1 {
+			probeStart := time.Now()
+			release, aerr := rx.Group.acquireProbe(ctx, quitAfterTimer.C)
+			if aerr != nil {
+				return nil, aerr
+			}
+			// The probe counts against the chunk retry deadline.
+			pctx, pcancel := context.WithDeadline(ctx, quitAt)
+			st, perr := rx.probeStatus(pctx)
+			release()
+			rx.stats.Timing.RecoveryProbe += time.Since(probeStart)
+			if perr != nil {
+				pcancel()
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if pctx.Err() == context.DeadlineExceeded {
+					return nil, rx.chunkTimeoutError(off, lastTimedOut, errProbeDeadline)
+				}
+			} else {
+				st.resp.Body = &cancelOnClose{ReadCloser: st.resp.Body, cancel: pcancel}
+			}
+			// A failed probe is not fatal: the chunk is resent in full.
+			if perr == nil {
+				switch end := off + int64(size); {
+				case st.complete && done:
+					resp = st.resp
+					rx.finalSent = true
+					return resp, rx.commitChunk(ctx, off, end)
+				case st.complete:
+					st.resp.Body.Close()
+					return nil, fmt.Errorf("server reports upload complete, but media from offset %d has not been sent", off)
+				case st.committed > end:
+					st.resp.Body.Close()
+					return nil, fmt.Errorf("server reports %d bytes committed, but only %d were sent", st.committed, end)
+				case st.committed == end && !done:
+					resp = st.resp
+					probeCommitted = true
+				case st.committed < off:
+					return rx.resumeFrom(ctx, st)
+				default:
+					drainAndClose(st.resp)
+					if st.committed > off {
+						rx.acceptPartial(st.committed)
+					}
+					sendOff = st.committed
+				}
+			}
+		}
+		if probeCommitted {
+			break
+		}
+		sendSize := off + int64(size) - sendOff
+
+		if rx.MaxEgressBytes > 0 && rx.stats.BytesTransmitted+sendSize > rx.MaxEgressBytes {
+			return nil, &EgressBudgetExceededError{Transmitted: rx.stats.BytesTransmitted, Limit: rx.MaxEgressBytes}
+		}
+		if q := rx.quota(); q != nil {
+			start := time.Now()
+			if err := q.wait(ctx, sendSize); err != nil {
+				return nil, err
+			}
+			rx.stats.Timing.QuotaWait += time.Since(start)
+		}
+
+		var ct *httptrace.ClientTrace
+		if rx.ChunkTrace != nil {
+			if err := rx.callHook(ctx, "ChunkTrace", func() { ct = rx.ChunkTrace(rx.stats.Chunks) }); err != nil {
+				rx.cancelSession(ctx)
+				return nil, err
+			}
 		}
 
 		// rCtx is derived from a context with a defined transferTimeout with non-zero value.
@@ -225,14 +1622,62 @@ func (rx *ResumableUpload) transferChunk(ctx context.Context) (resp *http.Respon
 			rCtx, cancel = context.WithTimeout(ctx, rx.ChunkTransferTimeout)
 		}
 
-		resp, err = rx.doUploadRequest(rCtx, chunk, off, int64(size), done)
+		// Each attempt reads the chunk afresh, skipping any committed prefix.
+		chunk, _, _, _ := rx.Media.Chunk()
+		io.CopyN(io.Discard, chunk, sendOff-off)
+		var data io.Reader = chunk
+		if rx.WriteBufferSize > 0 {
+			data = bufio.NewReaderSize(chunk, rx.WriteBufferSize)
+		}
+
+		rx.stats.BytesTransmitted += sendSize
+		rx.accounting.sent(sendOff, sendSize)
+		rx.stats.Requests++
+		if ct != nil {
+			rCtx = httptrace.WithClientTrace(rCtx, ct)
+		}
+		trace := newChunkTrace()
+		start := time.Now()
+		resp, err = rx.doUploadRequest(trace.withContext(rCtx), data, sendOff, sendSize, done)
+		elapsed := time.Since(start)
+		if done {
+			rx.stats.Timing.Finalization += elapsed
+		} else {
+			rx.stats.Timing.Transfer += elapsed
+		}
+		wire, think := trace.durations(start)
+		rx.stats.Timing.Wire += wire
+		rx.stats.Timing.ServerThink += think
+		reused, _ := trace.connReused()
+		if reused {
+			rx.stats.ReusedConns++
+		}
+		rx.noteServer(resp, trace)
+		if l := rx.logger(); l != nil {
+			l.DebugContext(ctx, "resumable upload chunk request",
+				slog.Int64("offset", sendOff),
+				slog.Int64("size", sendSize),
+				slog.Int("status", responseStatus(resp)),
+				slog.Duration("wire", wire),
+				slog.Duration("serverThink", think),
+				slog.Bool("connReused", reused))
+		}
+		// A deadline exceeded on rCtx alone is the attempt's own timeout,
+		// which is retried. If ctx is done too, the caller's deadline or
+		// cancellation applies and retrying is pointless.
+		timedOut := cancel != nil && rCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		lastTimedOut = timedOut
+		if lastReset = isConnReset(err); lastReset {
+			rx.stats.ConnResets++
+		}
 		// Cancel context right after the operation is done.
 		if cancel != nil {
 			cancel()
 		}
-		var status int
-		if resp != nil {
-			status = resp.StatusCode
+		status := responseStatus(resp)
+		rx.chunk.Attempts, rx.chunk.Status = rx.attempts, status
+		if rx.resumeIncomplete(resp) {
+			rx.chunk.Status = 308
 		}
 		// We sent "X-GUploader-No-308: yes" (see comment elsewhere in
 		// this file), so we don't expect to get a 308.
@@ -240,19 +1685,250 @@ func (rx *ResumableUpload) transferChunk(ctx context.Context) (resp *http.Respon
 			return nil, errors.New("unexpected 308 response status code")
 		}
 		if status == http.StatusOK {
+			if err := rx.checkIdempotencyEcho(ctx, resp); err != nil {
+				return resp, err
+			}
+			rx.warnShortChunkTimeout(ctx, elapsed)
 			break
 		}
-		// Check if we should retry the request.
-		if !errorFunc(status, err) {
+		if ctx.Err() != nil {
+			if err == nil {
+				err = ctx.Err()
+			}
+			return
+		}
+		var quotaForbidden bool
+		if status == http.StatusForbidden && rx.ClassifyForbidden {
+			var ferr error
+			if quotaForbidden, ferr = rx.classifyForbidden(resp); !quotaForbidden {
+				return nil, ferr
+			}
+		}
+		conflict := status == http.StatusConflict
+		if conflict && !rx.RetryConflict {
+			gerr, reason, err := rx.readErrorReason(resp)
+			if err != nil {
+				return nil, err
+			}
+			return nil, &ConflictError{Offset: off, Final: done, Reason: reason, Err: gerr}
+		}
+		// Check if we should retry the request. A timed-out attempt is
+		// offered to the retry predicate as a *ChunkTimeoutError.
+		retryErr := rx.chunkTimeoutError(off, timedOut, err)
+		if !quotaForbidden && !conflict && !errorFunc(status, retryErr) {
+			err = retryErr
 			return
 		}
+		pb := nextPause(bo, quitAt, rx.retryAfter(resp))
+		pause = max(pb.Backoff, pb.RetryAfter)
+		tk := classifyTimeout(err, timedOut)
+		switch tk {
+		case DialTimeout:
+			rx.stats.DialTimeouts++
+		case TransferTimeout:
+			rx.stats.TransferTimeouts++
+		}
+		rx.recordEvent(ctx, UploadEvent{Kind: AttemptRetried, Offset: off, Attempt: rx.attempts, Status: status, Err: err, Pause: pb, ConnReused: reused, Timeout: tk})
+		rx.stats.Retries++
 		rx.attempts++
-		pause = bo.Pause()
+		tokenAttempts++
+		if rx.RotateTokenAfterAttempts > 0 && tokenAttempts >= rx.RotateTokenAfterAttempts ||
+			rx.RotateTokenAfter > 0 && time.Since(tokenIssued) >= rx.RotateTokenAfter {
+			rx.invocationID = uuid.New().String()
+			tokenAttempts, tokenIssued = 0, time.Now()
+		}
+
+		if timedOut {
+			timeouts++
+		} else {
+			timeouts = 0
+		}
+		if rx.ShrinkChunkAfterTimeouts > 0 && timeouts >= rx.ShrinkChunkAfterTimeouts && sendOff == off {
+			if n, last, ok := rx.shrinkChunk(ctx, off, size); ok {
+				size, done = n, last
+				timeouts = 0
+			}
+		}
+	}
+
+	if done {
+		rx.finalSent = true
 	}
+	return resp, rx.commitChunk(ctx, off, off+int64(size))
+}
 
-	rx.reportProgress(off, off+int64(size))
+// chunkTimeoutError returns the error to report when retries of the chunk at
+// offset off stop with err from the last attempt. If that attempt hit
+// ChunkTransferTimeout, it is wrapped in a *ChunkTimeoutError.
+func (rx *ResumableUpload) chunkTimeoutError(off int64, timedOut bool, err error) error {
+	if !timedOut {
+		return err
+	}
+	return &ChunkTimeoutError{Offset: off, Timeout: rx.ChunkTransferTimeout, Err: err}
+}
+
+// shrinkChunk halves the size of the current chunk, of size bytes at offset
+// off, if the result is no smaller than MinChunkSize. It returns the new size
+// of the chunk and whether it is the final chunk.
+func (rx *ResumableUpload) shrinkChunk(ctx context.Context, off int64, size int) (newSize int, done, ok bool) {
+	floor := rx.MinChunkSize
+	if floor < flushAlignment {
+		floor = flushAlignment
+	}
+	target := size / 2
+	target -= target % flushAlignment
+	if target < floor {
+		return 0, false, false
+	}
+	rx.Media.shrink(target)
+	rx.stats.ChunkSizeReductions++
+	if l := rx.logger(); l != nil {
+		l.WarnContext(ctx, "resumable upload chunk timed out repeatedly; reducing chunk size",
+			"offset", off, "chunkSize", size, "newChunkSize", target)
+	}
+	rx.recordEvent(ctx, UploadEvent{Kind: ChunkSizeReduced, Offset: off, ChunkSize: target})
+	_, _, newSize, err := rx.Media.Chunk()
+	return newSize, err == io.EOF, true
+}
+
+// commitChunk records that the current chunk, spanning [off, end) of the
+// media, has been committed by the server, and advances to the next chunk.
+// It returns an error if OnChunkAck rejects the chunk.
+func (rx *ResumableUpload) commitChunk(ctx context.Context, off, end int64) error {
+	if rx.digests != nil {
+		data, _, _, _ := rx.Media.Chunk()
+		rx.digests.add(data)
+	}
+	if rx.prefixCRCValid {
+		data, _, _, _ := rx.Media.Chunk()
+		io.Copy(&rx.prefixCRC, data)
+	}
+	rx.reportProgress(off, end)
+	if !rx.finalSent {
+		if err := rx.failHook(ctx); err != nil {
+			return err
+		}
+	}
+	rx.updateCheckpoint(end)
+	rx.lastProgress = time.Now()
+	rx.stats.Chunks++
+	rx.checkByteAccounting()
+	rx.chunk.Offset, rx.chunk.Size = off, end-off
+	attempts := rx.chunk.Attempts
+	rx.recordChunk(true)
+	// The duration runs from reading the chunk from Media until it was
+	// committed, so that a slow source shows as well as a slow network.
+	d := rx.lastProgress.Sub(rx.chunkStart)
+	rx.recordEvent(ctx, UploadEvent{Kind: ChunkCommitted, Offset: off, ChunkSize: int(end - off), Attempt: attempts, Duration: d})
+	if l := rx.logger(); l != nil && end > off {
+		l.InfoContext(ctx, "resumable upload chunk committed",
+			slog.Int64("offset", off),
+			slog.Int64("size", end-off),
+			slog.Duration("duration", d),
+			slog.Duration("sourceRead", rx.chunkRead),
+			slog.Float64("mibPerSec", mibPerSec(end-off, d)))
+	}
 	rx.Media.Next()
-	return resp, nil
+	if rx.OnChunkAck != nil {
+		var err error
+		if perr := rx.callHook(ctx, "OnChunkAck", func() { err = rx.OnChunkAck(end) }); perr != nil {
+			rx.cancelSession(ctx)
+			return perr
+		}
+		if err != nil {
+			return fmt.Errorf("chunk acknowledgment at offset %d: %w", end, err)
+		}
+	}
+	return nil
+}
+
+// mibPerSec returns the throughput of n bytes transferred in d, in MiB/s, or 0
+// if d is not positive.
+func mibPerSec(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / (1 << 20) / d.Seconds()
+}
+
+// retryAfter returns the pause requested by the Retry-After header of resp,
+// subject to MaxRetryAfter and RetryAfterSkewTolerance.
+func (rx *ResumableUpload) retryAfter(resp *http.Response) time.Duration {
+	maxPause := rx.MaxRetryAfter
+	if maxPause <= 0 {
+		maxPause = defaultMaxRetryAfter
+	}
+	skew := rx.RetryAfterSkewTolerance
+	if skew == 0 {
+		skew = defaultRetryAfterSkewTolerance
+	}
+	return retryAfter(resp, time.Now(), max(skew, 0), maxPause)
+}
+
+// RetryPolicy describes the retry policy in effect for the upload, with
+// defaults filled in.
+func (rx *ResumableUpload) RetryPolicy() RetryPolicyDescription {
+	d := rx.Retry.Describe()
+	if rx.ClassifyForbidden {
+		d.RetryableStatuses += ", 403 for quota"
+	}
+	if rx.RetryConflict {
+		d.RetryableStatuses += ", 409"
+	}
+	if rx.FinalizeRetry != nil {
+		fb := rx.FinalizeRetry.describeBackoff()
+		d.FinalizeBackoff = &fb
+	}
+	d.ChunkRetryDeadline = rx.ChunkRetryDeadline
+	if d.ChunkRetryDeadline == 0 {
+		d.ChunkRetryDeadline = defaultRetryDeadline
+	}
+	d.TotalDeadline = max(rx.TotalDeadline, 0)
+	d.ChunkTransferTimeout = rx.ChunkTransferTimeout
+	d.MaxRetryAfter = rx.MaxRetryAfter
+	if d.MaxRetryAfter <= 0 {
+		d.MaxRetryAfter = defaultMaxRetryAfter
+	}
+	d.RetryAfterSkewTolerance = rx.RetryAfterSkewTolerance
+	if d.RetryAfterSkewTolerance == 0 {
+		d.RetryAfterSkewTolerance = defaultRetryAfterSkewTolerance
+	}
+	d.RetryAfterSkewTolerance = max(d.RetryAfterSkewTolerance, 0)
+	return d
+}
+
+// checkChunkRetryDeadline reports an error if ChunkRetryDeadline is set but
+// too short to allow a retry after the initial backoff pause.
+func (rx *ResumableUpload) checkChunkRetryDeadline() error {
+	if rx.ChunkRetryDeadline == 0 {
+		return nil
+	}
+	if rx.ChunkRetryDeadline < 0 {
+		return fmt.Errorf("invalid ChunkRetryDeadline %v: must not be negative", rx.ChunkRetryDeadline)
+	}
+	configs := []*RetryConfig{rx.Retry}
+	if rx.FinalizeRetry != nil {
+		configs = append(configs, rx.FinalizeRetry)
+	}
+	for _, r := range configs {
+		if initial := r.PreviewBackoff(1)[0]; rx.ChunkRetryDeadline < initial {
+			return fmt.Errorf("invalid ChunkRetryDeadline %v: must be at least the initial backoff pause of %v", rx.ChunkRetryDeadline, initial)
+		}
+	}
+	return nil
+}
+
+// checkIdleProgress returns an *UploadStalledError if MaxIdleProgress has
+// elapsed since bytes were last committed. committed is the number of bytes
+// committed so far.
+func (rx *ResumableUpload) checkIdleProgress(committed int64) error {
+	if rx.MaxIdleProgress <= 0 {
+		return nil
+	}
+	if idle := time.Since(rx.lastProgress); idle > rx.MaxIdleProgress {
+		return &UploadStalledError{Committed: committed, Idle: idle}
+	}
+	return nil
 }
 
 // Upload starts the process of a resumable upload with a cancellable context.
@@ -261,55 +1937,334 @@ func (rx *ResumableUpload) transferChunk(ctx context.Context) (resp *http.Respon
 // and calls the returned functions after the request returns (see send.go).
 // rx is private to the auto-generated API code.
 // Exactly one of resp or err will be nil.  If resp is non-nil, the caller must call resp.Body.Close.
+// Other goroutines may wait for Upload to return with Done and then inspect Err.
 // Upload does not parse the response into the error on a non 200 response;
 // it is the caller's responsibility to call resp.Body.Close.
-func (rx *ResumableUpload) Upload(ctx context.Context) (resp *http.Response, err error) {
+// Upload calls Step until the upload is done.
+func (rx *ResumableUpload) Upload(ctx context.Context) (*http.Response, error) {
+	for {
+		done, resp, err := rx.Step(ctx)
+		if done {
+			return resp, err
+		}
+	}
+}
 
-	// There are a couple of cases where it's possible for err and resp to both
-	// be non-nil. However, we expose a simpler contract to our callers: exactly
-	// one of resp and err will be non-nil. This means that any response body
-	// must be closed here before returning a non-nil error.
-	var prepareReturn = func(resp *http.Response, err error) (*http.Response, error) {
-		if err != nil {
+// Step advances the upload by a single chunk, allowing callers to drive the
+// upload themselves, for example to pause or checkpoint between chunks. The
+// first call also performs the preparation done by Upload before sending
+// media, such as creating the session. Step reports whether the upload is
+// done, in which case resp and err are as Upload would return them, and the
+// upload is finished as for Upload: Done is closed and Summary is available.
+// Until then, resp and err are nil. A call to Step after the upload is done
+// starts it over, as a second call to Upload would: the statistics of Summary
+// start from zero, and Done returns a new channel.
+//
+// A caller that stops calling Step before the upload is done must call
+// Abandon, or the resources held by the upload are not released.
+func (rx *ResumableUpload) Step(ctx context.Context) (done bool, resp *http.Response, err error) {
+	first := !rx.stepping
+	if first {
+		rx.start()
+	}
+	// dctx carries TotalDeadline, if set. It stays live until the body of the
+	// final response is closed, so that the caller can still read it.
+	dctx := ctx
+	if rx.TotalDeadline > 0 {
+		var cancel context.CancelFunc
+		dctx, cancel = context.WithDeadline(ctx, rx.startTime.Add(rx.TotalDeadline))
+		defer func() {
 			if resp != nil && resp.Body != nil {
-				resp.Body.Close()
+				resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			} else {
+				cancel()
 			}
-			// If there were retries, indicate this in the error message and wrap the final error.
-			if rx.attempts > 1 {
-				return nil, fmt.Errorf("chunk upload failed after %d attempts;, final error: %w", rx.attempts, err)
+		}()
+	}
+	if first {
+		if resp, err := rx.prepare(dctx); resp != nil || err != nil {
+			resp, err = rx.end(ctx, resp, rx.totalDeadlineError(ctx, dctx, err))
+			return true, resp, err
+		}
+	}
+	// Transfer a single chunk.
+	resp, err = rx.transferChunk(dctx)
+
+	// If the chunk was uploaded successfully, but there's still more to go,
+	// the next chunk can be uploaded without any delay.
+	if err == nil && rx.resumeIncomplete(resp) {
+		// Read the body to EOF and close it to allow the underlying
+		// transport to reuse the connection for next chunk upload.
+		drainAndCloseContext(dctx, resp)
+		return false, nil, nil
+	}
+
+	if err == nil && rx.MaxSessionRestarts > 0 && rx.NewSessionRequest != nil && sessionExpired(resp) {
+		drainAndClose(resp)
+		err = &SessionExpiredError{URI: rx.URI, StatusCode: resp.StatusCode}
+		resp = nil
+		if rx.stats.SessionRestarts < rx.MaxSessionRestarts {
+			rerr := rx.restartSession(dctx)
+			if rerr == nil {
+				return false, nil, nil
 			}
-			return nil, err
+			err = fmt.Errorf("%w; restarting the upload: %w", err, rerr)
+		}
+	}
+
+	// If an error occurred, the upload has failed.
+	resp, err = rx.finalResponse(dctx, resp, rx.totalDeadlineError(ctx, dctx, err))
+	resp, err = rx.end(ctx, resp, err)
+	return true, resp, err
+}
+
+// totalDeadlineError returns err as a *TotalDeadlineExceededError if it
+// results from TotalDeadline passing, as seen by dctx, rather than from ctx.
+func (rx *ResumableUpload) totalDeadlineError(ctx, dctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil || !errors.Is(dctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	return &TotalDeadlineExceededError{Deadline: rx.TotalDeadline, Err: err}
+}
+
+// cancelOnClose calls cancel once the body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Abandon ends an upload driven by Step that the caller will not drive to
+// completion, releasing what it holds: the goroutine delivering progress
+// callbacks, any spill file and any read ahead of the media. The upload is
+// finished as if Upload had failed with ErrUploadAbandoned: Done is closed
+// and Summary is available. The session is not canceled, so that the upload
+// can still be resumed from its Checkpoint. Abandon must not be called
+// concurrently with Step, and does nothing unless an upload driven by Step is
+// under way.
+func (rx *ResumableUpload) Abandon(ctx context.Context) {
+	if !rx.stepping {
+		return
+	}
+	rx.end(ctx, nil, ErrUploadAbandoned)
+}
+
+// start begins an upload driven by Step.
+func (rx *ResumableUpload) start() {
+	rx.stepping = true
+	rx.startTime = time.Now()
+	rx.lastProgress = rx.startTime
+	rx.mu.Lock()
+	rx.samples = []progressSample{{at: rx.startTime, progress: rx.progress}}
+	rx.ledger = nil
+	rx.callbackErr = nil
+	if rx.finished {
+		// The upload is started over: it is published afresh by finish.
+		rx.finished = false
+		rx.done = nil
+		rx.err = nil
+		rx.manifest = nil
+	}
+	rx.mu.Unlock()
+	rx.stats = UploadSummary{}
+	rx.chunk = ChunkRecord{}
+	rx.timeoutChecked = false
+	rx.servers = nil
+	rx.startProgress = rx.progress
+	rx.accounting.reset(rx.progress, rx.stats.BytesTransmitted)
+	rx.stats.RequestID = rx.RequestID
+	rx.stats.Backoff = rx.Retry.describeBackoff()
+	if rx.stats.RequestID == "" && (rx.Logger != nil || rx.Metrics != nil) {
+		rx.stats.RequestID = uuid.New().String()
+	}
+	if rx.CallbackQueueSize > 0 && (rx.Callback != nil || rx.FractionCallback != nil) {
+		rx.progressQueue = newProgressQueue(rx.CallbackQueueSize, rx.deliverProgress)
+	}
+}
+
+// end finishes an upload driven by Step, which returns resp and err. It
+// returns them after applying ErrorMapper.
+func (rx *ResumableUpload) end(ctx context.Context, resp *http.Response, err error) (*http.Response, error) {
+	if err != nil && rx.ErrorMapper != nil {
+		var mapped error
+		if perr := rx.callHook(ctx, "ErrorMapper", func() { mapped = rx.ErrorMapper(err) }); perr != nil {
+			mapped = perr
+		}
+		if mapped != nil {
+			err = mapped
 		}
-		// This case is very unlikely but possible only if rx.ChunkRetryDeadline is
-		// set to a very small value, in which case no requests will be sent before
-		// the deadline. Return an error to avoid causing a panic.
-		if resp == nil {
-			return nil, fmt.Errorf("upload request to %v not sent, choose larger value for ChunkRetryDealine", rx.URI)
+	}
+	if rx.Media != nil && !rx.mediaAbandoned {
+		rx.Media.releaseSpill()
+		// The media must not be read once the upload ends, but a read
+		// ahead blocked on the media must not hold up cancellation.
+		if !rx.Media.awaitPrefetchContext(ctx) {
+			rx.mediaAbandoned = true
 		}
-		return resp, nil
 	}
+	if rx.progressQueue != nil {
+		rx.progressQueue.close()
+		rx.progressQueue = nil
+	}
+	if err != nil && rx.chunk.Attempts > 0 {
+		rx.recordChunk(false)
+	}
+	rx.stats.Timing.Total = time.Since(rx.startTime)
+	if rx.TotalDeadline > 0 {
+		rx.stats.DeadlineBudgetUsed = min(rx.stats.Timing.Total, rx.TotalDeadline)
+		rx.stats.DeadlineBudgetRemaining = rx.TotalDeadline - rx.stats.DeadlineBudgetUsed
+	}
+	rx.recordOutcome(ctx, err)
+	rx.finish(err)
+	rx.warnRetransmission(ctx)
+	rx.stepping = false
+	if rx.OnComplete != nil {
+		// The upload is over: a panic can only be logged.
+		rx.callHook(ctx, "OnComplete", func() { rx.OnComplete(rx.Summary()) })
+	}
+	return resp, err
+}
 
-	// Send all chunks.
-	for {
+// prepare validates the configuration and readies the upload session before
+// any media is sent. If it returns a response or an error, the upload is done
+// without sending media.
+func (rx *ResumableUpload) prepare(ctx context.Context) (*http.Response, error) {
+	if rx.Media == nil {
+		return nil, ErrNoMediaSource
+	}
+	if rx.mediaAbandoned {
+		return nil, errMediaAbandoned
+	}
+	if err := rx.checkChunkRetryDeadline(); err != nil {
+		return nil, err
+	}
+	if rx.IdempotencyHeaderName != "" && !httpguts.ValidHeaderFieldName(rx.IdempotencyHeaderName) {
+		return nil, fmt.Errorf("invalid IdempotencyHeaderName %q", rx.IdempotencyHeaderName)
+	}
+	if rx.HostHeader != "" && !validHost(rx.HostHeader) {
+		return nil, fmt.Errorf("invalid HostHeader %q", rx.HostHeader)
+	}
 
-		// Transfer a single chunk.
-		resp, err = rx.transferChunk(ctx)
+	if err := rx.capChunkSize(); err != nil {
+		return nil, err
+	}
+	rx.recordSourceSize()
+	rx.Media.boundary = nil
+	if f := rx.ChunkBoundaryFunc; f != nil {
+		// It runs wherever the chunk is loaded, perhaps on another
+		// goroutine, so a panic fails the upload as a progress callback's
+		// does.
+		rx.Media.boundary = func(offset, maxChunk int64) (n int64) {
+			if err := rx.recoverHook(context.Background(), "ChunkBoundaryFunc", func() { n = f(offset, maxChunk) }); err != nil {
+				n = maxChunk
+				if rx.StrictCallbacks {
+					rx.setCallbackErr(err)
+				}
+			}
+			return n
+		}
+	}
+	rx.Media.prefetchNext = rx.PrefetchNextChunk
+	rx.warnExcessiveChunking(ctx)
+	if rx.SequentialReadAhead {
+		rx.adviseSequential(ctx)
+	}
+	if rx.ProduceManifest {
+		rx.digests = newMediaDigests()
+	}
+	rx.prefixCRC, rx.prefixCRCValid = 0, rx.CheckpointChecksum
 
-		// If an error occurred, the upload has failed. Return immediately.
+	if rx.SkipIfExistsMatching != nil {
+		var skip bool
+		var err error
+		if perr := rx.callDecisionHook(ctx, "SkipIfExistsMatching", func() { skip, err = rx.SkipIfExistsMatching(ctx) }); perr != nil {
+			return nil, perr
+		}
 		if err != nil {
-			return prepareReturn(resp, err)
+			return nil, err
 		}
+		if skip {
+			return &http.Response{
+				Status:     "200 OK",
+				StatusCode: http.StatusOK,
+				Proto:      "HTTP/1.1",
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+			}, nil
+		}
+	}
 
-		// If the chunk was uploaded successfully, but there's still
-		// more to go, upload the next chunk without any delay.
-		if statusResumeIncomplete(resp) {
-			// Read the body to EOF and close it to allow the underlying
-			// transport to reuse the connection for next chunk upload.
-			io.Copy(io.Discard, resp.Body)
-			resp.Body.Close()
-			continue
+	if rx.URI == "" && rx.ResumeFrom != nil {
+		rx.URI = rx.ResumeFrom.URI
+	}
+	if rx.URI == "" && rx.NewSessionRequest != nil {
+		if err := rx.establishSession(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if rx.VerifyChunkGranularity {
+		if err := rx.verifyChunkGranularity(ctx); err != nil {
+			return nil, err
 		}
+	}
+
+	if err := rx.checkSessionTarget(); err != nil {
+		return nil, err
+	}
+
+	if err := rx.approveURI(ctx); err != nil {
+		return nil, err
+	}
 
-		return prepareReturn(resp, err)
+	if rx.ResumeFrom != nil {
+		return rx.resumeCheckpoint(ctx)
 	}
+	return nil, nil
+}
+
+// finalResponse returns the result of the upload given the last chunk's
+// response and error.
+//
+// There are a couple of cases where it's possible for err and resp to both
+// be non-nil. However, we expose a simpler contract to our callers: exactly
+// one of resp and err will be non-nil. This means that any response body
+// must be closed here before returning a non-nil error.
+func (rx *ResumableUpload) finalResponse(ctx context.Context, resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+		// If there were retries, indicate this in the error message and wrap the final error.
+		if rx.attempts > 1 {
+			return nil, fmt.Errorf("chunk upload failed after %d attempts;, final error: %w", rx.attempts, err)
+		}
+		return nil, err
+	}
+	// This case is very unlikely but possible only if rx.ChunkRetryDeadline is
+	// set to a very small value, in which case no requests will be sent before
+	// the deadline. Return an error to avoid causing a panic.
+	if resp == nil {
+		return nil, &NoRequestSentError{URI: rx.URI}
+	}
+	if rx.ParseErrorBody && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return nil, rx.errorFromResponse(resp)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		rx.captureResponseHeaders(resp)
+	}
+	if rx.ProduceManifest && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		if err := rx.buildManifest(ctx, resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return resp, nil
 }
@@ -0,0 +1,59 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import "fmt"
+
+// checkAccounting enables checkByteAccounting. It is off in production, as a
+// violation panics, and is turned on by the package's tests.
+var checkAccounting = false
+
+// byteAccounting is a model of the media bytes sent by an upload, kept apart
+// from UploadSummary so that the counters behind egress caps, costs and the
+// retransmission ratio can be checked against it.
+type byteAccounting struct {
+	start       int64 // UploadSummary.BytesTransmitted when the upload started
+	skipped     int64 // bytes below high that were never sent
+	high        int64 // end of the highest range sent
+	resent      int64 // bytes sent at offsets below high
+	initialized bool
+}
+
+// reset starts the accounting of an upload from offset progress, with
+// transmitted bytes already counted in the summary.
+func (a *byteAccounting) reset(progress, transmitted int64) {
+	*a = byteAccounting{start: transmitted, skipped: progress, high: progress, initialized: true}
+}
+
+// sent records that the n bytes at offset off were sent. Bytes skipped over,
+// having been committed before, as found by a status probe, were never sent.
+func (a *byteAccounting) sent(off, n int64) {
+	if off > a.high {
+		a.skipped += off - a.high
+		a.high = off
+	}
+	end := off + n
+	fresh := max(end-max(off, a.high), 0)
+	a.resent += n - fresh
+	a.high = max(a.high, end)
+}
+
+// checkByteAccounting panics, if checkAccounting is set, unless the bytes
+// transmitted so far equal those committed plus those retransmitted plus
+// those sent but not yet committed. It is called once each chunk is
+// committed.
+func (rx *ResumableUpload) checkByteAccounting() {
+	a := &rx.accounting
+	if !checkAccounting || !a.initialized {
+		return
+	}
+	transmitted := rx.stats.BytesTransmitted - a.start
+	committed := min(rx.progress, a.high) - a.skipped
+	outstanding := a.high - min(rx.progress, a.high)
+	if transmitted != committed+a.resent+outstanding {
+		panic(fmt.Sprintf("gensupport: byte accounting violated at offset %d: transmitted %d != committed %d + retransmitted %d + outstanding %d",
+			rx.progress, transmitted, committed, a.resent, outstanding))
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"strings"
+	"testing"
+)
+
+func init() {
+	// Every upload run by the package's tests checks its byte accounting.
+	checkAccounting = true
+}
+
+func TestCheckByteAccounting(t *testing.T) {
+	rx := &ResumableUpload{}
+	rx.accounting.reset(0, 0)
+	// A chunk sent twice, then committed.
+	for range 2 {
+		rx.stats.BytesTransmitted += 10
+		rx.accounting.sent(0, 10)
+	}
+	rx.progress = 10
+	rx.checkByteAccounting()
+	if got, want := rx.accounting.resent, int64(10); got != want {
+		t.Errorf("retransmitted %d bytes, want %d", got, want)
+	}
+	// Resuming past bytes committed earlier, without sending them.
+	rx.stats.BytesTransmitted += 5
+	rx.accounting.sent(20, 5)
+	rx.progress = 25
+	rx.checkByteAccounting()
+
+	// A send missing from the summary.
+	rx.accounting.sent(25, 5)
+	rx.progress = 30
+	defer func() {
+		r := recover()
+		if s, _ := r.(string); !strings.Contains(s, "byte accounting violated") {
+			t.Errorf("recovered %v, want a byte accounting violation", r)
+		}
+	}()
+	rx.checkByteAccounting()
+	t.Error("checkByteAccounting did not panic")
+}
@@ -0,0 +1,100 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// memTransport is an in-memory upload endpoint that answers each chunk
+// instantly: with 308 and the committed Range while the upload is
+// incomplete, and with 200 once the final chunk arrives. It does no checking
+// beyond what the protocol requires, so that benchmarks measure the upload
+// code rather than the test server.
+type memTransport struct {
+	committed int64
+}
+
+func (t *memTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	// Content-Range is "bytes first-last/total" or "bytes */total", where
+	// total is "*" until the size of the media is known.
+	rng, total, ok := strings.Cut(strings.TrimPrefix(req.Header.Get("Content-Range"), "bytes "), "/")
+	if !ok {
+		return nil, fmt.Errorf("memTransport: bad Content-Range %q", req.Header.Get("Content-Range"))
+	}
+	if _, last, ok := strings.Cut(rng, "-"); ok {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("memTransport: bad Content-Range %q", req.Header.Get("Content-Range"))
+		}
+		t.committed = n + 1
+	}
+	h := http.Header{}
+	if total == "*" || total != strconv.FormatInt(t.committed, 10) {
+		h.Set("X-Http-Status-Code-Override", "308")
+		if t.committed > 0 {
+			h.Set("Range", "bytes=0-"+strconv.FormatInt(t.committed-1, 10))
+		}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody, Request: req}, nil
+}
+
+func TestMemTransport(t *testing.T) {
+	media := strings.Repeat("a", 25)
+	var progress []int64
+	rx := &ResumableUpload{
+		Client:    &http.Client{Transport: &memTransport{}},
+		URI:       "https://example.com/upload",
+		Media:     NewMediaBuffer(strings.NewReader(media), 10),
+		MediaType: "text/plain",
+		Callback:  func(n int64) { progress = append(progress, n) },
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if got, want := fmt.Sprint(progress), "[10 20 25]"; got != want {
+		t.Errorf("progress: got %s, want %s", got, want)
+	}
+}
+
+// BenchmarkUploadChunks measures the per-chunk overhead of Upload, with no
+// network involved.
+func BenchmarkUploadChunks(b *testing.B) {
+	const chunkSize = 1 << 10
+	for _, chunks := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("chunks=%d", chunks), func(b *testing.B) {
+			media := bytes.Repeat([]byte{'a'}, chunks*chunkSize-1)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(media)))
+			for i := 0; i < b.N; i++ {
+				rx := &ResumableUpload{
+					Client:    &http.Client{Transport: &memTransport{}},
+					URI:       "https://example.com/upload",
+					Media:     NewMediaBuffer(bytes.NewReader(media), chunkSize),
+					MediaType: "application/octet-stream",
+				}
+				res, err := rx.Upload(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				res.Body.Close()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*chunks), "ns/chunk")
+		})
+	}
+}
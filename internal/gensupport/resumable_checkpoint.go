@@ -0,0 +1,140 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+)
+
+// Checkpoint records the state of an upload needed to resume it in another
+// process. It is obtained from ResumableUpload.Checkpoint, typically in
+// OnChunkAck, persisted by the caller, and passed back as
+// ResumableUpload.ResumeFrom.
+type Checkpoint struct {
+	// URI is the session URI of the upload.
+	URI string
+	// Offset is the number of media bytes committed.
+	Offset int64
+	// PrefixCRC32C is the CRC32C checksum of the first Offset bytes of the
+	// media. It is only valid if HasPrefixCRC32C is set.
+	PrefixCRC32C    uint32
+	HasPrefixCRC32C bool
+}
+
+// crc32cWriter accumulates the CRC32C checksum of the bytes written to it.
+type crc32cWriter uint32
+
+func (c *crc32cWriter) Write(p []byte) (int, error) {
+	*c = crc32cWriter(crc32.Update(uint32(*c), crc32cTable, p))
+	return len(p), nil
+}
+
+// Checkpoint returns the state of the upload as of the last committed chunk.
+// PrefixCRC32C is only computed if CheckpointChecksum is set, and is
+// unavailable after the server loses committed data. Checkpoint may be called
+// concurrently with Upload.
+func (rx *ResumableUpload) Checkpoint() Checkpoint {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	return rx.checkpoint
+}
+
+// updateCheckpoint records that the media up to offset has been committed.
+func (rx *ResumableUpload) updateCheckpoint(offset int64) {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	rx.checkpoint = Checkpoint{
+		URI:             rx.URI,
+		Offset:          offset,
+		PrefixCRC32C:    uint32(rx.prefixCRC),
+		HasPrefixCRC32C: rx.prefixCRCValid,
+	}
+}
+
+// resumeCheckpoint positions the upload at the offset committed by the
+// server in the session recorded by ResumeFrom, first checking the media
+// against the recorded checksum if VerifySourcePrefix is set. If the server
+// reports the upload complete, it returns the final response, as processed by
+// finalResponse.
+func (rx *ResumableUpload) resumeCheckpoint(ctx context.Context) (*http.Response, error) {
+	cp := rx.ResumeFrom
+	if rx.VerifySourcePrefix && !cp.HasPrefixCRC32C {
+		return nil, errors.New("VerifySourcePrefix requires a checkpoint with a prefix checksum")
+	}
+	st, err := rx.probeStatus(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("resuming upload: %w", err)
+	}
+	// The digests of a manifest would cover only the media sent after the
+	// checkpoint.
+	rx.digests = nil
+	crc, valid := crc32cWriter(cp.PrefixCRC32C), cp.HasPrefixCRC32C
+	if rx.VerifySourcePrefix {
+		crc = 0
+		if err := rx.Media.skip(cp.Offset, &crc); err != nil {
+			drainAndClose(st.resp)
+			return nil, err
+		}
+		if uint32(crc) != cp.PrefixCRC32C {
+			drainAndClose(st.resp)
+			return nil, &SourcePrefixMismatchError{Offset: cp.Offset, Want: cp.PrefixCRC32C, Got: uint32(crc)}
+		}
+	} else if err := rx.Media.skip(cp.Offset, nil); err != nil {
+		drainAndClose(st.resp)
+		return nil, err
+	}
+	if st.complete {
+		// The server reports no committed offset once the upload is
+		// complete: all of the media, of at least the checkpointed
+		// length, has been committed.
+		rx.setProgress(max(cp.Offset, rx.TotalSize))
+		return rx.finalResponse(ctx, st.resp, nil)
+	}
+	drainAndClose(st.resp)
+	if st.committed < cp.Offset {
+		return nil, fmt.Errorf("server reports %d bytes committed, fewer than the %d recorded in the checkpoint", st.committed, cp.Offset)
+	}
+	// The server may have committed a chunk that the checkpoint missed.
+	if err := rx.Media.skip(st.committed-cp.Offset, &crc); err != nil {
+		return nil, err
+	}
+	rx.prefixCRC, rx.prefixCRCValid = crc, valid && rx.CheckpointChecksum
+	rx.setProgress(st.committed)
+	rx.startProgress = st.committed
+	rx.reported = st.committed
+	rx.updateCheckpoint(st.committed)
+	return nil, nil
+}
+
+// skip advances mb by n bytes into the media, before the first chunk is
+// loaded, writing the bytes skipped to w, if not nil. If w is nil and the
+// media implements io.Seeker, the bytes are seeked over rather than read.
+func (mb *MediaBuffer) skip(n int64, w io.Writer) error {
+	if n == 0 {
+		return nil
+	}
+	defer mb.publish()
+	if s, ok := mb.media.(io.Seeker); ok && w == nil {
+		if _, err := s.Seek(n, io.SeekCurrent); err != nil {
+			return err
+		}
+		mb.off += n
+		return nil
+	}
+	if w == nil {
+		w = io.Discard
+	}
+	copied, err := io.CopyN(w, mb.media, n)
+	mb.off += copied
+	if err == io.EOF {
+		return fmt.Errorf("media ends at offset %d, before the committed offset %d", mb.off, mb.off-copied+n)
+	}
+	return err
+}
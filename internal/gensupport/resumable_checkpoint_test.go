@@ -0,0 +1,189 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	const media = "0123456789abcdefghijklmno"
+	crc := func(s string) uint32 { return crc32.Checksum([]byte(s), crc32cTable) }
+
+	// The first process commits one chunk, checkpoints, and dies.
+	errCrash := errors.New("crash")
+	var cp Checkpoint
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: &interruptibleTransport{
+			events: []event{{byteRange: "bytes 0-9/*", responseStatus: 308}},
+			bodies: bodyTracker{},
+		}},
+		URI:                "https://example.com/upload?upload_id=1",
+		Media:              NewMediaBuffer(strings.NewReader(media), 10),
+		MediaType:          "text/plain",
+		CheckpointChecksum: true,
+	}
+	rx.OnChunkAck = func(int64) error {
+		cp = rx.Checkpoint()
+		return errCrash
+	}
+	if _, err := rx.Upload(context.Background()); !errors.Is(err, errCrash) {
+		t.Fatalf("first Upload: got %v, want %v", err, errCrash)
+	}
+	if want := (Checkpoint{URI: rx.URI, Offset: 10, PrefixCRC32C: crc(media[:10]), HasPrefixCRC32C: true}); cp != want {
+		t.Fatalf("got checkpoint %+v, want %+v", cp, want)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		source  string
+		verify  bool
+		wantErr bool
+	}{
+		{name: "verified", source: media, verify: true},
+		{name: "unverified", source: media},
+		{name: "changed source", source: "X" + media[1:], verify: true, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			events := []event{
+				// The server committed a chunk after the checkpoint.
+				{byteRange: "bytes */*", responseStatus: 308, responseHeader: http.Header{"Range": {"bytes=0-19"}}},
+			}
+			if !tc.wantErr {
+				events = append(events, event{byteRange: "bytes 20-24/25", responseStatus: http.StatusOK})
+			}
+			tr := &interruptibleTransport{events: events, bodies: bodyTracker{}}
+			var progress []int64
+			rx := &ResumableUpload{
+				Client:             &http.Client{Transport: tr},
+				Media:              NewMediaBuffer(strings.NewReader(tc.source), 10),
+				MediaType:          "text/plain",
+				ResumeFrom:         &cp,
+				VerifySourcePrefix: tc.verify,
+				CheckpointChecksum: true,
+				Callback:           func(n int64) { progress = append(progress, n) },
+			}
+			res, err := rx.Upload(context.Background())
+			if tc.wantErr {
+				var merr *SourcePrefixMismatchError
+				if !errors.As(err, &merr) {
+					t.Fatalf("Upload err: got %v, want *SourcePrefixMismatchError", err)
+				}
+				if merr.Offset != 10 || merr.Want != cp.PrefixCRC32C || merr.Got != crc(tc.source[:10]) {
+					t.Errorf("got %+v", merr)
+				}
+				if len(tr.buf) != 0 {
+					t.Errorf("sent media %q, want none", tr.buf)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if got := string(tr.buf); got != media[20:] {
+				t.Errorf("sent media %q, want %q", got, media[20:])
+			}
+			if len(progress) != 1 || progress[0] != 25 {
+				t.Errorf("reported progress %v, want [25]", progress)
+			}
+			if got := rx.Checkpoint(); got.Offset != 25 || got.PrefixCRC32C != crc(media) || !got.HasPrefixCRC32C {
+				t.Errorf("got final checkpoint %+v, want offset 25 and the checksum of the media", got)
+			}
+		})
+	}
+}
+
+func TestResumeFromCheckpointManifest(t *testing.T) {
+	const media = "0123456789abcdefghijklmno"
+	const objJSON = `{"bucket":"bkt","name":"obj"}`
+	for _, tc := range []struct {
+		name   string
+		events []event
+	}{
+		{
+			name: "incomplete",
+			events: []event{
+				{byteRange: "bytes */*", responseStatus: 308, responseHeader: http.Header{"Range": {"bytes=0-9"}}},
+				{byteRange: "bytes 10-19/*", responseStatus: 308},
+				{byteRange: "bytes 20-24/25", responseStatus: http.StatusOK, responseBody: objJSON},
+			},
+		},
+		{
+			name: "complete",
+			events: []event{
+				{byteRange: "bytes */*", responseStatus: http.StatusOK, responseBody: objJSON},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rx := &ResumableUpload{
+				Client:          &http.Client{Transport: &interruptibleTransport{events: tc.events, bodies: bodyTracker{}}},
+				Media:           NewMediaBuffer(strings.NewReader(media), 10),
+				MediaType:       "text/plain",
+				TotalSize:       int64(len(media)),
+				ResumeFrom:      &Checkpoint{URI: "https://example.com/upload?upload_id=1", Offset: 10},
+				ProduceManifest: true,
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			m, err := rx.Manifest()
+			if err != nil {
+				t.Fatalf("Manifest: %v", err)
+			}
+			// The media before the checkpoint was not hashed: the digests
+			// would not be those of the object.
+			if m.CRC32C != "" || m.MD5 != "" {
+				t.Errorf("got digests %q and %q, want none", m.CRC32C, m.MD5)
+			}
+			if m.TotalBytes != int64(len(media)) {
+				t.Errorf("TotalBytes: got %d, want %d", m.TotalBytes, len(media))
+			}
+		})
+	}
+}
+
+func TestResumeFromCheckpointRetransmissionRatio(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	// Of the 20 bytes committed after the checkpoint, 10 are sent twice.
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: &interruptibleTransport{
+			events: []event{
+				{byteRange: "bytes */*", responseStatus: 308, responseHeader: http.Header{"Range": {"bytes=0-9"}}},
+				{byteRange: "bytes 10-19/*", responseStatus: http.StatusServiceUnavailable},
+				{byteRange: "bytes 10-19/*", responseStatus: 308},
+				{byteRange: "bytes 20-29/*", responseStatus: 308},
+				{byteRange: "bytes */30", responseStatus: http.StatusOK},
+			},
+			bodies: bodyTracker{},
+		}},
+		Media:      NewMediaBuffer(strings.NewReader(strings.Repeat("a", 30)), 10),
+		MediaType:  "text/plain",
+		ResumeFrom: &Checkpoint{URI: "https://example.com/upload?upload_id=1", Offset: 10},
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	s := rx.Summary()
+	if s.BytesTransmitted != 30 || s.BytesCommitted != 30 {
+		t.Errorf("got %d bytes transmitted and %d committed, want 30 and 30", s.BytesTransmitted, s.BytesCommitted)
+	}
+	if s.RetransmissionRatio != 0.5 {
+		t.Errorf("got RetransmissionRatio %v, want 0.5", s.RetransmissionRatio)
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// ErrNoMediaSource is returned by ResumableUpload.Upload when
+// ResumableUpload.Media is nil.
+var ErrNoMediaSource = errors.New("resumable upload has no media source: Media is nil")
+
+// ErrUploadAbandoned is the error of an upload ended by
+// ResumableUpload.Abandon.
+var ErrUploadAbandoned = errors.New("resumable upload abandoned before completion")
+
+// errMediaAbandoned is returned by ResumableUpload.Upload when an earlier
+// upload left a read from the media running.
+var errMediaAbandoned = errors.New("resumable upload media was abandoned by an earlier upload and cannot be reused")
+
+// EgressBudgetExceededError is returned by ResumableUpload.Upload when sending
+// the next request would exceed ResumableUpload.MaxEgressBytes.
+type EgressBudgetExceededError struct {
+	// Transmitted is the number of bytes sent before the upload was aborted,
+	// including retransmissions.
+	Transmitted int64
+	// Limit is the configured MaxEgressBytes.
+	Limit int64
+}
+
+func (e *EgressBudgetExceededError) Error() string {
+	return fmt.Sprintf("upload aborted: %d bytes transmitted, egress budget is %d bytes", e.Transmitted, e.Limit)
+}
+
+// SourceReadError is returned by ResumableUpload.Upload when reading from the
+// media source fails with an error other than io.EOF. It distinguishes a
+// failing data source from network or server failures.
+type SourceReadError struct {
+	// Offset is the position in the media at which the read failed.
+	Offset int64
+	// Err is the error returned by the source.
+	Err error
+}
+
+func (e *SourceReadError) Error() string {
+	return fmt.Sprintf("reading media source at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *SourceReadError) Unwrap() error {
+	return e.Err
+}
+
+// SourceReadTimeoutError is returned by ResumableUpload.Upload when reading a
+// chunk from the media takes longer than ResumableUpload.ChunkReadTimeout.
+type SourceReadTimeoutError struct {
+	// Offset is the number of bytes committed when the read began.
+	Offset int64
+	// Timeout is the ChunkReadTimeout that expired.
+	Timeout time.Duration
+}
+
+func (e *SourceReadTimeoutError) Error() string {
+	return fmt.Sprintf("reading media after offset %d: no chunk produced within %v", e.Offset, e.Timeout)
+}
+
+// SourceSizeChangedError is returned by ResumableUpload.Upload when the size
+// of the media changes during the upload, with
+// ResumableUpload.DetectSourceSizeChange set.
+type SourceSizeChangedError struct {
+	// Offset is the offset of the chunk about to be sent.
+	Offset int64
+	// Initial and Current are the sizes of the media when it was first
+	// buffered and when the change was detected.
+	Initial, Current int64
+}
+
+func (e *SourceSizeChangedError) Error() string {
+	return fmt.Sprintf("media size changed during upload, from %d to %d bytes, before the chunk at offset %d", e.Initial, e.Current, e.Offset)
+}
+
+// UploadStalledError is returned by ResumableUpload.Upload when no bytes have
+// been committed for longer than ResumableUpload.MaxIdleProgress.
+type UploadStalledError struct {
+	// Committed is the number of bytes committed before the upload stalled.
+	Committed int64
+	// Idle is the time since bytes were last committed.
+	Idle time.Duration
+}
+
+func (e *UploadStalledError) Error() string {
+	return fmt.Sprintf("upload stalled: no progress for %v after %d bytes committed", e.Idle, e.Committed)
+}
+
+// HeaderTooLargeError is returned by ResumableUpload.Upload when the headers
+// of an upload request exceed ResumableUpload.MaxHeaderBytes. The request is
+// not sent.
+type HeaderTooLargeError struct {
+	// Size is the total size of the request headers, in bytes.
+	Size int
+	// Limit is the configured MaxHeaderBytes.
+	Limit int
+}
+
+func (e *HeaderTooLargeError) Error() string {
+	return fmt.Sprintf("upload request headers are %d bytes, exceeding the limit of %d bytes", e.Size, e.Limit)
+}
+
+// ResponseTooLargeError is returned by ResumableUpload.Upload when a response
+// body read by the library exceeds ResumableUpload.MaxResponseBodyBytes.
+type ResponseTooLargeError struct {
+	// StatusCode is the status code of the response.
+	StatusCode int
+	// Limit is the maximum body size, in bytes.
+	Limit int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response body (status %d) exceeds the limit of %d bytes", e.StatusCode, e.Limit)
+}
+
+// NoRequestSentError is returned by ResumableUpload.Upload when the chunk retry
+// deadline expired before any request could be sent.
+type NoRequestSentError struct {
+	// URI is the session URI of the upload.
+	URI string
+}
+
+func (e *NoRequestSentError) Error() string {
+	return fmt.Sprintf("upload request to %v not sent, choose larger value for ChunkRetryDeadline", e.URI)
+}
+
+// TooManyChunksError is returned by ResumableUpload.Upload when the media
+// needs more than ResumableUpload.MaxChunks chunks.
+type TooManyChunksError struct {
+	// Chunks is the number of chunks committed.
+	Chunks int
+	// Committed is the number of bytes committed.
+	Committed int64
+}
+
+func (e *TooManyChunksError) Error() string {
+	return fmt.Sprintf("upload aborted: chunk limit reached after %d chunks (%d bytes) committed", e.Chunks, e.Committed)
+}
+
+// IdempotencyEchoError is returned by ResumableUpload.Upload when
+// ResumableUpload.StrictIdempotencyEcho is set and a response does not echo
+// the idempotency token that was sent.
+type IdempotencyEchoError struct {
+	// Header is the name of the idempotency header.
+	Header string
+	// Sent is the token sent with the request.
+	Sent string
+	// Echoed is the token in the response, or empty if there was none.
+	Echoed string
+}
+
+func (e *IdempotencyEchoError) Error() string {
+	if e.Echoed == "" {
+		return fmt.Sprintf("response does not echo idempotency token %q in header %s", e.Sent, e.Header)
+	}
+	return fmt.Sprintf("response echoes idempotency token %q in header %s, want %q", e.Echoed, e.Header, e.Sent)
+}
+
+// DataAfterFinalError is returned by ResumableUpload.Upload when the media
+// yields more data after the final chunk has been sent. The data is not sent.
+type DataAfterFinalError struct {
+	// Offset is the position in the media of the unexpected data.
+	Offset int64
+	// Size is the number of unexpected bytes in the chunk.
+	Size int
+}
+
+func (e *DataAfterFinalError) Error() string {
+	return fmt.Sprintf("media yielded %d bytes at offset %d after the final chunk was sent", e.Size, e.Offset)
+}
+
+// SessionEstablishTimeoutError is returned by ResumableUpload.Upload when the
+// upload session could not be created within
+// ResumableUpload.SessionEstablishTimeout.
+type SessionEstablishTimeoutError struct {
+	// Timeout is the timeout that expired.
+	Timeout time.Duration
+	// Err is the error of the last attempt.
+	Err error
+}
+
+func (e *SessionEstablishTimeoutError) Error() string {
+	return fmt.Sprintf("upload session not established within %v: %v", e.Timeout, e.Err)
+}
+
+func (e *SessionEstablishTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// ChunkGranularityError is returned by ResumableUpload.Upload when
+// ResumableUpload.VerifyChunkGranularity is set and the chunk size is not a
+// multiple of the granularity required by the server.
+type ChunkGranularityError struct {
+	// ChunkSize is the configured chunk size.
+	ChunkSize int
+	// Granularity is the granularity reported by the server.
+	Granularity int
+}
+
+func (e *ChunkGranularityError) Error() string {
+	return fmt.Sprintf("chunk size %d is not a multiple of the server's chunk granularity %d", e.ChunkSize, e.Granularity)
+}
+
+// ChunkTimeoutError is returned by ResumableUpload.Upload when retries of a
+// chunk stop after its last attempt hit ResumableUpload.ChunkTransferTimeout.
+// It distinguishes the per-attempt timeout from the expiry of the context
+// passed to Upload, which aborts the upload at once with the context's error.
+type ChunkTimeoutError struct {
+	// Offset is the offset in the media of the chunk.
+	Offset int64
+	// Timeout is the configured ChunkTransferTimeout.
+	Timeout time.Duration
+	// Err is the error of the last attempt.
+	Err error
+}
+
+func (e *ChunkTimeoutError) Error() string {
+	return fmt.Sprintf("chunk at offset %d timed out after %v: %v", e.Offset, e.Timeout, e.Err)
+}
+
+func (e *ChunkTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// MissingMetadataError is returned by ResumableUpload.Upload when the final
+// response lacks expected object metadata and ResumableUpload.MissingMetadata
+// is MissingMetadataFail.
+type MissingMetadataError struct {
+	// Fields are the names of the missing fields of the object resource.
+	Fields []string
+}
+
+func (e *MissingMetadataError) Error() string {
+	return fmt.Sprintf("upload final response lacks object metadata: %s", strings.Join(e.Fields, ", "))
+}
+
+// SessionTargetMismatchError is returned by ResumableUpload.Upload when the
+// session URI does not name ResumableUpload.ExpectedBucket and
+// ResumableUpload.ExpectedObject. No media is sent.
+type SessionTargetMismatchError struct {
+	// ExpectedBucket and ExpectedObject are the configured values.
+	ExpectedBucket, ExpectedObject string
+	// Bucket and Object are the values named by the session URI, or empty
+	// if it does not name them.
+	Bucket, Object string
+}
+
+func (e *SessionTargetMismatchError) Error() string {
+	return fmt.Sprintf("upload session is for object %q in bucket %q, expected object %q in bucket %q", e.Object, e.Bucket, e.ExpectedObject, e.ExpectedBucket)
+}
+
+// TotalDeadlineExceededError is returned by ResumableUpload.Upload when the
+// upload did not complete within ResumableUpload.TotalDeadline.
+type TotalDeadlineExceededError struct {
+	// Deadline is the deadline that passed.
+	Deadline time.Duration
+	// Err is the error of the interrupted operation.
+	Err error
+}
+
+func (e *TotalDeadlineExceededError) Error() string {
+	return fmt.Sprintf("upload not completed within %v: %v", e.Deadline, e.Err)
+}
+
+func (e *TotalDeadlineExceededError) Unwrap() error {
+	return e.Err
+}
+
+// ProjectedOverrunError is returned by ResumableUpload.Upload when the upload
+// is projected to complete after ResumableUpload.SoftTimeBudget.
+type ProjectedOverrunError struct {
+	// Committed is the number of bytes committed when the upload was
+	// abandoned.
+	Committed int64
+	// Elapsed is the wall time of the upload so far, and Projected the
+	// projected wall time of the whole upload.
+	Elapsed, Projected time.Duration
+	// Budget is the SoftTimeBudget.
+	Budget time.Duration
+}
+
+func (e *ProjectedOverrunError) Error() string {
+	return fmt.Sprintf("upload projected to take %v, over its budget of %v, after %v with %d bytes committed",
+		e.Projected.Round(time.Millisecond), e.Budget, e.Elapsed.Round(time.Millisecond), e.Committed)
+}
+
+// PermissionDeniedError is returned by ResumableUpload.Upload when
+// ResumableUpload.ClassifyForbidden is set and a chunk is refused with a 403
+// response that does not report exhausted quota.
+type PermissionDeniedError struct {
+	// Reason is the error reason from the response body, if any, such as
+	// "forbidden".
+	Reason string
+	// Err is the error parsed from the response.
+	Err *googleapi.Error
+}
+
+func (e *PermissionDeniedError) Error() string {
+	return fmt.Sprintf("permission denied (reason %q): %v", e.Reason, e.Err)
+}
+
+func (e *PermissionDeniedError) Unwrap() error {
+	return e.Err
+}
+
+// ConflictError is returned by ResumableUpload.Upload when a chunk is refused
+// with a 409 Conflict response and ResumableUpload.RetryConflict is not set.
+// A conflict typically reports a concurrent writer or a generation mismatch.
+type ConflictError struct {
+	// Offset is the offset of the refused chunk.
+	Offset int64
+	// Final reports whether the refused chunk was the final one.
+	Final bool
+	// Reason is the error reason from the response body, if any, such as
+	// "conflict".
+	Reason string
+	// Err is the error parsed from the response.
+	Err *googleapi.Error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("upload conflict at offset %d (reason %q): %v", e.Offset, e.Reason, e.Err)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// SourcePrefixMismatchError is returned by ResumableUpload.Upload when
+// ResumableUpload.VerifySourcePrefix is set and the media up to the offset of
+// ResumableUpload.ResumeFrom does not match the checkpoint's checksum: the
+// source has changed since the upload began. No media is sent.
+type SourcePrefixMismatchError struct {
+	// Offset is the length of the prefix that was checked.
+	Offset int64
+	// Want is the CRC32C checksum recorded in the checkpoint, and Got the
+	// checksum of the media.
+	Want, Got uint32
+}
+
+func (e *SourcePrefixMismatchError) Error() string {
+	return fmt.Sprintf("media does not match the upload being resumed: CRC32C of the first %d bytes is %08x, checkpoint has %08x", e.Offset, e.Got, e.Want)
+}
+
+// CallbackPanicError is returned by ResumableUpload.Upload when
+// ResumableUpload.StrictCallbacks is set and a user-supplied callback panics.
+type CallbackPanicError struct {
+	// Callback is the name of the callback, such as "Callback".
+	Callback string
+	// Value is the value passed to panic.
+	Value any
+	// Stack is the stack trace of the goroutine at the time of the panic.
+	Stack []byte
+}
+
+func (e *CallbackPanicError) Error() string {
+	return fmt.Sprintf("%s panicked: %v", e.Callback, e.Value)
+}
+
+// SessionExpiredError is returned by ResumableUpload.Upload when
+// ResumableUpload.MaxSessionRestarts is set and the upload session expired,
+// once the restarts are exhausted or a restart failed.
+type SessionExpiredError struct {
+	// URI is the expired session URI.
+	URI string
+	// StatusCode is the status code of the response that showed the
+	// session expired.
+	StatusCode int
+}
+
+func (e *SessionExpiredError) Error() string {
+	return fmt.Sprintf("upload session expired (status %d)", e.StatusCode)
+}
@@ -0,0 +1,91 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import "time"
+
+// etaWindow is the period over which throughput is measured for
+// EstimatedTimeRemaining. It is a variable so that tests can overwrite it.
+var etaWindow = 30 * time.Second
+
+// progressSample records the progress of an upload at a point in time.
+type progressSample struct {
+	at       time.Time
+	progress int64
+}
+
+// setProgress records that n bytes have been uploaded.
+func (rx *ResumableUpload) setProgress(n int64) {
+	now := time.Now()
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	if n < rx.progress {
+		// The server lost data: throughput so far says nothing about the
+		// rest of the upload.
+		rx.samples = rx.samples[:0]
+	}
+	rx.progress = n
+	rx.samples = append(rx.samples, progressSample{at: now, progress: n})
+	// Keep the samples within etaWindow, but at least two, so that progress
+	// made less often than that still yields an estimate.
+	cutoff := now.Add(-etaWindow)
+	drop := 0
+	for drop+2 < len(rx.samples) && rx.samples[drop].at.Before(cutoff) {
+		drop++
+	}
+	rx.samples = append(rx.samples[:0], rx.samples[drop:]...)
+}
+
+// EstimatedTimeRemaining estimates the time until the upload completes, from
+// the bytes remaining and the throughput over the last 30 seconds or so. It
+// reports false if TotalSize is not known or no throughput has been observed
+// yet. It may be called concurrently with Upload.
+func (rx *ResumableUpload) EstimatedTimeRemaining() (time.Duration, bool) {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	if rx.TotalSize <= 0 || len(rx.samples) < 2 {
+		return 0, false
+	}
+	first, last := rx.samples[0], rx.samples[len(rx.samples)-1]
+	n, d := last.progress-first.progress, last.at.Sub(first.at)
+	if n <= 0 || d <= 0 {
+		return 0, false
+	}
+	remaining := rx.TotalSize - rx.progress
+	if remaining <= 0 {
+		return 0, true
+	}
+	return time.Duration(float64(remaining) / float64(n) * float64(d)), true
+}
+
+// minProjectionChunks is the number of chunks that must be committed before
+// SoftTimeBudget is checked, so that the projection rests on some
+// throughput.
+const minProjectionChunks = 2
+
+// checkProjectedOverrun returns a *ProjectedOverrunError if SoftTimeBudget is
+// set and the upload is projected to complete past it. The remaining time is
+// projected from the better of the throughput over the last 30 seconds or so
+// and the throughput since the upload started, so as not to abandon an upload
+// over a passing slowdown.
+func (rx *ResumableUpload) checkProjectedOverrun() error {
+	if rx.SoftTimeBudget <= 0 || rx.TotalSize <= 0 || rx.stats.Chunks < minProjectionChunks {
+		return nil
+	}
+	elapsed := time.Since(rx.startTime)
+	remaining, ok := rx.EstimatedTimeRemaining()
+	if !ok {
+		return nil
+	}
+	committed := rx.Progress()
+	if n := committed - rx.startProgress; n > 0 && elapsed > 0 {
+		overall := time.Duration(float64(rx.TotalSize-committed) / float64(n) * float64(elapsed))
+		remaining = min(remaining, overall)
+	}
+	if projected := elapsed + remaining; projected > rx.SoftTimeBudget {
+		return &ProjectedOverrunError{Committed: committed, Elapsed: elapsed, Projected: projected, Budget: rx.SoftTimeBudget}
+	}
+	return nil
+}
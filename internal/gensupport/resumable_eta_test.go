@@ -0,0 +1,115 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEstimatedTimeRemaining(t *testing.T) {
+	oldWindow := etaWindow
+	etaWindow = time.Minute
+	defer func() { etaWindow = oldWindow }()
+
+	rx := &ResumableUpload{TotalSize: 1000}
+	if _, ok := rx.EstimatedTimeRemaining(); ok {
+		t.Error("estimate before any progress: got ok, want false")
+	}
+	base := time.Now().Add(-time.Hour)
+	rx.samples = []progressSample{{at: base}}
+	rx.progress = 0
+	// Slow progress long ago falls out of the window...
+	rx.samples = append(rx.samples, progressSample{at: base.Add(30 * time.Minute), progress: 100})
+	// ...and the recent rate of 100 bytes per second applies.
+	now := time.Now()
+	rx.samples = append(rx.samples,
+		progressSample{at: now.Add(-4 * time.Second), progress: 400},
+		progressSample{at: now.Add(-2 * time.Second), progress: 600},
+	)
+	rx.setProgress(800)
+
+	got, ok := rx.EstimatedTimeRemaining()
+	if !ok {
+		t.Fatal("no estimate")
+	}
+	// 200 bytes remain at about 100 bytes per second.
+	if got < 1500*time.Millisecond || got > 2500*time.Millisecond {
+		t.Errorf("got %v, want about 2s", got)
+	}
+	if len(rx.samples) != 3 || rx.samples[0].progress != 400 {
+		t.Errorf("samples outside the window were kept: %+v", rx.samples)
+	}
+
+	rx.setProgress(1000)
+	if got, ok := rx.EstimatedTimeRemaining(); !ok || got != 0 {
+		t.Errorf("complete upload: got %v, %v, want 0, true", got, ok)
+	}
+
+	// A regression discards the throughput measured so far.
+	rx.setProgress(500)
+	if _, ok := rx.EstimatedTimeRemaining(); ok {
+		t.Error("estimate right after a regression: got ok, want false")
+	}
+
+	if _, ok := (&ResumableUpload{}).EstimatedTimeRemaining(); ok {
+		t.Error("estimate with unknown TotalSize: got ok, want false")
+	}
+}
+
+func TestSoftTimeBudget(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		budget  time.Duration
+		wantErr bool
+	}{
+		{name: "within budget", budget: time.Minute},
+		// Each of the 5 chunks takes at least 20ms.
+		{name: "overrun", budget: 60 * time.Millisecond, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					io.Copy(io.Discard, req.Body)
+					requests++
+					time.Sleep(20 * time.Millisecond)
+					if strings.HasSuffix(req.Header.Get("Content-Range"), "/*") {
+						return incompleteResponse(), nil
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:            "https://example.com/upload",
+				Media:          NewMediaBuffer(strings.NewReader(strings.Repeat("a", 50)), 10),
+				MediaType:      "text/plain",
+				TotalSize:      50,
+				SoftTimeBudget: tc.budget,
+			}
+			res, err := rx.Upload(context.Background())
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("Upload: %v", err)
+				}
+				res.Body.Close()
+				return
+			}
+			var perr *ProjectedOverrunError
+			if !errors.As(err, &perr) {
+				t.Fatalf("Upload err: got %v, want *ProjectedOverrunError", err)
+			}
+			if perr.Committed != 20 || perr.Projected <= tc.budget || perr.Budget != tc.budget {
+				t.Errorf("got %+v, want 20 bytes committed and a projection over the budget", perr)
+			}
+			if requests != minProjectionChunks {
+				t.Errorf("sent %d requests, want %d", requests, minProjectionChunks)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// UploaderGroup coordinates resources shared by a set of resumable uploads.
+// Uploads join a group by setting ResumableUpload.Group. An UploaderGroup must
+// not be copied after first use.
+type UploaderGroup struct {
+	// MaxConcurrentProbes, if positive, limits the number of status probes
+	// that uploads in the group may have in flight at once. This protects the
+	// status endpoint when many uploads try to recover at the same time.
+	MaxConcurrentProbes int
+
+	// Quota, if set, is the RollingQuota shared by uploads in the group that
+	// do not set their own ResumableUpload.Quota.
+	Quota *RollingQuota
+
+	once     sync.Once
+	probeSem chan struct{}
+}
+
+// errProbeDeadline is returned when the per-chunk retry deadline passes while
+// waiting for a status probe slot or for the probe itself.
+var errProbeDeadline = errors.New("chunk retry deadline exceeded while probing upload status")
+
+// acquireProbe waits for a status probe slot, and returns a function that
+// releases it. It returns an error if ctx is done or quit fires first. A nil
+// group imposes no limit.
+func (g *UploaderGroup) acquireProbe(ctx context.Context, quit <-chan time.Time) (release func(), err error) {
+	if g == nil || g.MaxConcurrentProbes <= 0 {
+		return func() {}, nil
+	}
+	select {
+	case g.sem() <- struct{}{}:
+		return func() { <-g.probeSem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-quit:
+		return nil, errProbeDeadline
+	}
+}
+
+// tryAcquireProbe acquires a status probe slot if one is immediately available.
+func (g *UploaderGroup) tryAcquireProbe() (release func(), ok bool) {
+	if g == nil || g.MaxConcurrentProbes <= 0 {
+		return func() {}, true
+	}
+	select {
+	case g.sem() <- struct{}{}:
+		return func() { <-g.probeSem }, true
+	default:
+		return nil, false
+	}
+}
+
+func (g *UploaderGroup) sem() chan struct{} {
+	g.once.Do(func() {
+		g.probeSem = make(chan struct{}, g.MaxConcurrentProbes)
+	})
+	return g.probeSem
+}
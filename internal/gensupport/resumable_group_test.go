@@ -0,0 +1,55 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUploaderGroupProbeLimit(t *testing.T) {
+	g := &UploaderGroup{MaxConcurrentProbes: 2}
+	ctx := context.Background()
+
+	r1, err := g.acquireProbe(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := g.acquireProbe(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A third probe must wait, and gives up when its context is done...
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := g.acquireProbe(cctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire with expired context: got %v, want context.DeadlineExceeded", err)
+	}
+	// ...or when the retry deadline passes.
+	if _, err := g.acquireProbe(ctx, time.After(10*time.Millisecond)); err != errProbeDeadline {
+		t.Errorf("acquire past retry deadline: got %v, want %v", err, errProbeDeadline)
+	}
+
+	// Releasing a slot lets the next probe proceed.
+	r1()
+	r3, err := g.acquireProbe(ctx, time.After(time.Second))
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	r2()
+	r3()
+}
+
+func TestUploaderGroupNil(t *testing.T) {
+	var g *UploaderGroup
+	release, err := g.acquireProbe(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
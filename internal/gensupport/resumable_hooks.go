@@ -0,0 +1,72 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+)
+
+// callHook calls f, which invokes the user-supplied hook named name,
+// recovering from a panic in it. The panic is logged and, if StrictCallbacks
+// is set, returned as a *CallbackPanicError.
+func (rx *ResumableUpload) callHook(ctx context.Context, name string, f func()) error {
+	if err := rx.recoverHook(ctx, name, f); err != nil && rx.StrictCallbacks {
+		return err
+	}
+	return nil
+}
+
+// callDecisionHook is callHook for a hook whose result the upload depends on,
+// such as ApproveURI. Having no result to go on, it returns a panic as a
+// *CallbackPanicError whether or not StrictCallbacks is set.
+func (rx *ResumableUpload) callDecisionHook(ctx context.Context, name string, f func()) error {
+	return rx.recoverHook(ctx, name, f)
+}
+
+// recoverHook calls f, which invokes the user-supplied hook named name, and
+// logs and returns a panic in it as a *CallbackPanicError.
+func (rx *ResumableUpload) recoverHook(ctx context.Context, name string, f func()) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		stack := debug.Stack()
+		if l := rx.logger(); l != nil {
+			l.WarnContext(ctx, "resumable upload callback panicked",
+				slog.String("hook", name),
+				slog.Any("panic", r),
+				slog.String("stack", string(stack)))
+		}
+		err = &CallbackPanicError{Callback: name, Value: r, Stack: stack}
+	}()
+	f()
+	return nil
+}
+
+// setCallbackErr records err from a progress callback, which may run on the
+// progress queue's goroutine, for failHook to pick up.
+func (rx *ResumableUpload) setCallbackErr(err error) {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	if rx.callbackErr == nil {
+		rx.callbackErr = err
+	}
+}
+
+// failHook returns the error recorded by setCallbackErr, if any, after asking
+// the server to discard the session, which the failed upload cannot use.
+func (rx *ResumableUpload) failHook(ctx context.Context) error {
+	rx.mu.Lock()
+	err := rx.callbackErr
+	rx.callbackErr = nil
+	rx.mu.Unlock()
+	if err != nil {
+		rx.cancelSession(ctx)
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+)
+
+// panickingRecorder is a MetricsRecorder that panics.
+type panickingRecorder struct{}
+
+func (panickingRecorder) RecordUploadEvent(context.Context, UploadEvent) { panic("boom") }
+
+func TestCallbackPanic(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		strict      bool
+		hook        func(rx *ResumableUpload)
+		wantHook    string // of a *CallbackPanicError
+		wantChunks  int    // chunk requests sent
+		keepSession bool   // no DELETE is sent on failure
+	}{
+		{
+			name: "logged",
+			hook: func(rx *ResumableUpload) {
+				rx.Callback = func(int64) { panic("boom") }
+			},
+			wantChunks: 3,
+		},
+		{
+			name:   "strict callback",
+			strict: true,
+			hook: func(rx *ResumableUpload) {
+				rx.Callback = func(int64) { panic("boom") }
+			},
+			wantHook:   "Callback",
+			wantChunks: 1,
+		},
+		{
+			name:   "strict fraction callback",
+			strict: true,
+			hook: func(rx *ResumableUpload) {
+				rx.TotalSize = 25
+				rx.FractionCallback = func(float64) { panic("boom") }
+			},
+			wantHook:   "FractionCallback",
+			wantChunks: 1,
+		},
+		{
+			name:   "strict chunk ack",
+			strict: true,
+			hook: func(rx *ResumableUpload) {
+				rx.OnChunkAck = func(int64) error { panic("boom") }
+			},
+			wantHook:   "OnChunkAck",
+			wantChunks: 1,
+		},
+		{
+			name:   "strict request",
+			strict: true,
+			hook: func(rx *ResumableUpload) {
+				rx.OnRequest = func(string, string, int, int64, int64) { panic("boom") }
+			},
+			wantHook:    "OnRequest",
+			keepSession: true,
+		},
+		{
+			name:   "strict chunk trace",
+			strict: true,
+			hook: func(rx *ResumableUpload) {
+				rx.ChunkTrace = func(int) *httptrace.ClientTrace { panic("boom") }
+			},
+			wantHook: "ChunkTrace",
+		},
+		{
+			name:   "strict error mapper",
+			strict: true,
+			hook: func(rx *ResumableUpload) {
+				rx.OnChunkAck = func(int64) error { return errors.New("ack") }
+				rx.ErrorMapper = func(error) error { panic("boom") }
+			},
+			wantHook:    "ErrorMapper",
+			wantChunks:  1,
+			keepSession: true,
+		},
+		{
+			name: "approve uri",
+			hook: func(rx *ResumableUpload) {
+				rx.ApproveURI = func(string) error { panic("boom") }
+			},
+			wantHook: "ApproveURI",
+		},
+		{
+			name: "new session request",
+			hook: func(rx *ResumableUpload) {
+				rx.URI = ""
+				rx.NewSessionRequest = func() (*http.Request, error) { panic("boom") }
+			},
+			wantHook:    "NewSessionRequest",
+			keepSession: true,
+		},
+		{
+			name:   "strict chunk boundary",
+			strict: true,
+			hook: func(rx *ResumableUpload) {
+				rx.ChunkBoundaryFunc = func(int64, int64) int64 { panic("boom") }
+			},
+			wantHook:   "ChunkBoundaryFunc",
+			wantChunks: 1,
+		},
+		{
+			name:   "strict metrics",
+			strict: true,
+			hook: func(rx *ResumableUpload) {
+				rx.Metrics = panickingRecorder{}
+			},
+			wantHook:   "Metrics",
+			wantChunks: 2, // the event for a chunk follows its commit
+		},
+		{
+			name: "skip if exists",
+			hook: func(rx *ResumableUpload) {
+				rx.SkipIfExistsMatching = func(context.Context) (bool, error) { panic("boom") }
+			},
+			wantHook:    "SkipIfExistsMatching",
+			keepSession: true,
+		},
+		{
+			name:   "strict complete",
+			strict: true,
+			hook: func(rx *ResumableUpload) {
+				rx.OnComplete = func(UploadSummary) { panic("boom") }
+			},
+			wantChunks: 3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var chunks, deletes int
+			var logs strings.Builder
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					if req.Method == "DELETE" {
+						deletes++
+						return &http.Response{StatusCode: 499, Header: http.Header{}, Body: http.NoBody}, nil
+					}
+					chunks++
+					h := http.Header{}
+					if !strings.HasSuffix(req.Header.Get("Content-Range"), "/25") {
+						h.Set("X-Http-Status-Code-Override", "308")
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+				})},
+				URI:             "https://example.com/upload",
+				Media:           NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+				MediaType:       "text/plain",
+				Logger:          slog.New(slog.NewTextHandler(&logs, nil)),
+				StrictCallbacks: tc.strict,
+			}
+			tc.hook(rx)
+			res, err := rx.Upload(context.Background())
+			if !strings.Contains(logs.String(), "callback panicked") {
+				t.Errorf("panic was not logged:\n%s", logs.String())
+			}
+			if tc.wantHook == "" {
+				if err != nil {
+					t.Fatalf("Upload: %v", err)
+				}
+				res.Body.Close()
+			} else {
+				var perr *CallbackPanicError
+				if !errors.As(err, &perr) {
+					t.Fatalf("Upload err: got %v, want *CallbackPanicError", err)
+				}
+				if perr.Callback != tc.wantHook || perr.Value != "boom" || len(perr.Stack) == 0 {
+					t.Errorf("got %s panic with %v, want %s panic with boom and a stack", perr.Callback, perr.Value, tc.wantHook)
+				}
+				wantDeletes := 1 // to discard the session
+				if tc.keepSession {
+					wantDeletes = 0
+				}
+				if deletes != wantDeletes {
+					t.Errorf("sent %d DELETE requests, want %d", deletes, wantDeletes)
+				}
+			}
+			if chunks != tc.wantChunks {
+				t.Errorf("sent %d chunks, want %d", chunks, tc.wantChunks)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+// ChunkRecord describes the upload of one chunk, as kept when
+// ResumableUpload.ChunkLedgerSize is set.
+type ChunkRecord struct {
+	// Offset is the offset of the chunk in the media.
+	Offset int64
+	// Size is the length of the chunk, in bytes. A chunk shrunk after
+	// timeouts is recorded with its final size.
+	Size int64
+	// Attempts is the number of requests that carried the chunk.
+	Attempts int
+	// Status is the HTTP status code of the last request, or 0 if it
+	// received no response. A chunk accepted with more to follow is recorded
+	// with status 308, however the server signaled it.
+	Status int
+	// Committed reports whether the server committed the chunk. Only the
+	// chunk that failed the upload is recorded uncommitted.
+	Committed bool
+}
+
+// ChunkLedger returns a record of each chunk of the upload, in order. It is
+// empty unless ChunkLedgerSize is set, and holds at most ChunkLedgerSize
+// records: the oldest are dropped to make room for newer ones.
+func (rx *ResumableUpload) ChunkLedger() []ChunkRecord {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	return append([]ChunkRecord(nil), rx.ledger...)
+}
+
+// recordChunk adds the current chunk to the ledger, if ChunkLedgerSize is set,
+// and clears it.
+func (rx *ResumableUpload) recordChunk(committed bool) {
+	cr := rx.chunk
+	rx.chunk = ChunkRecord{}
+	if rx.ChunkLedgerSize <= 0 {
+		return
+	}
+	cr.Committed = committed
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	if len(rx.ledger) >= rx.ChunkLedgerSize {
+		rx.ledger = append(rx.ledger[:0], rx.ledger[len(rx.ledger)-rx.ChunkLedgerSize+1:]...)
+	}
+	rx.ledger = append(rx.ledger, cr)
+}
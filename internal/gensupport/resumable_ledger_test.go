@@ -0,0 +1,100 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChunkLedger(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	for _, tc := range []struct {
+		name       string
+		ledgerSize int
+		events     []event
+		wantErr    bool
+		want       []ChunkRecord
+	}{
+		{
+			name:       "disabled",
+			ledgerSize: 0,
+			events: []event{
+				{byteRange: "bytes 0-9/*", responseStatus: 308},
+				{byteRange: "bytes 10-19/*", responseStatus: 308},
+				{byteRange: "bytes 20-24/25", responseStatus: http.StatusOK},
+			},
+		},
+		{
+			name:       "all chunks",
+			ledgerSize: 10,
+			events: []event{
+				{byteRange: "bytes 0-9/*", responseStatus: 308},
+				{byteRange: "bytes 10-19/*", responseStatus: http.StatusServiceUnavailable},
+				{byteRange: "bytes 10-19/*", responseStatus: 308},
+				{byteRange: "bytes 20-24/25", responseStatus: http.StatusOK},
+			},
+			want: []ChunkRecord{
+				{Offset: 0, Size: 10, Attempts: 1, Status: 308, Committed: true},
+				{Offset: 10, Size: 10, Attempts: 2, Status: 308, Committed: true},
+				{Offset: 20, Size: 5, Attempts: 1, Status: http.StatusOK, Committed: true},
+			},
+		},
+		{
+			name:       "capped",
+			ledgerSize: 2,
+			events: []event{
+				{byteRange: "bytes 0-9/*", responseStatus: 308},
+				{byteRange: "bytes 10-19/*", responseStatus: 308},
+				{byteRange: "bytes 20-24/25", responseStatus: http.StatusOK},
+			},
+			want: []ChunkRecord{
+				{Offset: 10, Size: 10, Attempts: 1, Status: 308, Committed: true},
+				{Offset: 20, Size: 5, Attempts: 1, Status: http.StatusOK, Committed: true},
+			},
+		},
+		{
+			name:       "failed chunk",
+			ledgerSize: 10,
+			events: []event{
+				{byteRange: "bytes 0-9/*", responseStatus: 308},
+				{byteRange: "bytes 10-19/*", responseStatus: http.StatusServiceUnavailable},
+				{byteRange: "bytes 10-19/*", responseStatus: http.StatusForbidden},
+			},
+			wantErr: true,
+			want: []ChunkRecord{
+				{Offset: 0, Size: 10, Attempts: 1, Status: 308, Committed: true},
+				{Offset: 10, Size: 10, Attempts: 2, Status: http.StatusForbidden},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rx := &ResumableUpload{
+				Client:          &http.Client{Transport: &interruptibleTransport{events: tc.events, bodies: bodyTracker{}}},
+				Media:           NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+				MediaType:       "text/plain",
+				ChunkLedgerSize: tc.ledgerSize,
+				// Report the terminal 403 as an error.
+				ParseErrorBody: true,
+			}
+			res, err := rx.Upload(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Upload err: got %v, want error: %v", err, tc.wantErr)
+			}
+			if err == nil {
+				res.Body.Close()
+			}
+			if got := rx.ChunkLedger(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ChunkLedger:\ngot  %+v\nwant %+v", got, tc.want)
+			}
+		})
+	}
+}
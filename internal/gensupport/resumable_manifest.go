@@ -0,0 +1,174 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// Manifest is a machine-readable record of a successful resumable upload. It
+// is produced when ResumableUpload.ProduceManifest is set.
+type Manifest struct {
+	// ObjectURL, Bucket, Name and Generation identify the uploaded object,
+	// as reported in the final response. They are empty if the response did
+	// not include them.
+	ObjectURL  string `json:"objectUrl,omitempty"`
+	Bucket     string `json:"bucket,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Generation string `json:"generation,omitempty"`
+	// ETag is taken from the final response body, or else its ETag header.
+	ETag string `json:"etag,omitempty"`
+
+	// TotalBytes is the number of media bytes committed.
+	TotalBytes int64 `json:"totalBytes"`
+	// CRC32C and MD5 are the base64-encoded digests of the media, computed
+	// locally in the format used by Cloud Storage. They are empty if the
+	// upload had to rewind or was resumed from a Checkpoint, since the
+	// digests then do not cover all of the media.
+	CRC32C string `json:"crc32c,omitempty"`
+	MD5    string `json:"md5Hash,omitempty"`
+
+	// Chunks is the number of chunks committed.
+	Chunks int `json:"chunks"`
+	// Timing breaks down the wall time of the upload.
+	Timing TimingBreakdown `json:"timing"`
+}
+
+// Manifest returns the manifest of the upload. It returns an error if
+// ProduceManifest was not set, or if Upload has not returned successfully.
+func (rx *ResumableUpload) Manifest() (*Manifest, error) {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	switch {
+	case !rx.ProduceManifest:
+		return nil, errors.New("manifest not available: ProduceManifest is not set")
+	case !rx.finished:
+		return nil, errors.New("manifest not available: upload has not completed")
+	case rx.manifest == nil:
+		return nil, errors.New("manifest not available: upload did not succeed")
+	}
+	m := *rx.manifest
+	return &m, nil
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// mediaDigests accumulates the digests of committed media.
+type mediaDigests struct {
+	crc32c hash.Hash32
+	md5    hash.Hash
+}
+
+func newMediaDigests() *mediaDigests {
+	return &mediaDigests{crc32c: crc32.New(crc32cTable), md5: md5.New()}
+}
+
+func (d *mediaDigests) add(r io.Reader) {
+	io.Copy(io.MultiWriter(d.crc32c, d.md5), r)
+}
+
+// objectMetadata holds the fields of an object resource that are copied into
+// a Manifest.
+type objectMetadata struct {
+	SelfLink   string `json:"selfLink"`
+	Bucket     string `json:"bucket"`
+	Name       string `json:"name"`
+	Generation string `json:"generation"`
+	ETag       string `json:"etag"`
+	CRC32C     string `json:"crc32c"`
+}
+
+// MissingMetadataPolicy says what to do when the final response of an upload
+// lacks expected object metadata. See ResumableUpload.MissingMetadata.
+type MissingMetadataPolicy int
+
+const (
+	// MissingMetadataWarn logs a warning to ResumableUpload.Logger, if set,
+	// and leaves the missing fields out. It is the default.
+	MissingMetadataWarn MissingMetadataPolicy = iota
+	// MissingMetadataSkip silently leaves the missing fields out.
+	MissingMetadataSkip
+	// MissingMetadataFail makes Upload return a *MissingMetadataError.
+	MissingMetadataFail
+)
+
+// checkMetadata applies MissingMetadata if md lacks any expected field.
+func (rx *ResumableUpload) checkMetadata(ctx context.Context, md objectMetadata) error {
+	var missing []string
+	if md.Generation == "" {
+		missing = append(missing, "generation")
+	}
+	if md.CRC32C == "" {
+		missing = append(missing, "crc32c")
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	switch rx.MissingMetadata {
+	case MissingMetadataFail:
+		return &MissingMetadataError{Fields: missing}
+	case MissingMetadataWarn:
+		if l := rx.logger(); l != nil {
+			l.WarnContext(ctx, "resumable upload final response lacks object metadata; omitting it from the manifest",
+				slog.Any("missing", missing))
+		}
+	}
+	return nil
+}
+
+// buildManifest assembles the manifest from the final response and the upload
+// statistics. The response body is read, up to MaxResponseBodyBytes, and
+// replaced so that the caller can still consume it. It is not closed.
+func (rx *ResumableUpload) buildManifest(ctx context.Context, resp *http.Response) error {
+	m := &Manifest{
+		ETag:       resp.Header.Get("ETag"),
+		TotalBytes: rx.Progress(),
+		Chunks:     rx.stats.Chunks,
+	}
+	if rx.digests != nil {
+		var crc [4]byte
+		binary.BigEndian.PutUint32(crc[:], rx.digests.crc32c.Sum32())
+		m.CRC32C = base64.StdEncoding.EncodeToString(crc[:])
+		m.MD5 = base64.StdEncoding.EncodeToString(rx.digests.md5.Sum(nil))
+	}
+	var md objectMetadata
+	if resp.Body != nil && resp.Body != http.NoBody {
+		body, err := rx.readResponseBody(resp)
+		if err != nil {
+			return err
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{bytes.NewReader(body), resp.Body}
+		if json.Unmarshal(body, &md) == nil {
+			m.ObjectURL = md.SelfLink
+			m.Bucket = md.Bucket
+			m.Name = md.Name
+			m.Generation = md.Generation
+			if md.ETag != "" {
+				m.ETag = md.ETag
+			}
+		}
+	}
+	if err := rx.checkMetadata(ctx, md); err != nil {
+		return err
+	}
+	rx.mu.Lock()
+	rx.manifest = m
+	rx.mu.Unlock()
+	return nil
+}
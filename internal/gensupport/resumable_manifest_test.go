@@ -0,0 +1,140 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	const objJSON = `{"selfLink":"https://storage.googleapis.com/storage/v1/b/bkt/o/obj","bucket":"bkt","name":"obj","generation":"1234","etag":"CNIJ"}`
+	tr := &interruptibleTransport{
+		events: []event{
+			{byteRange: "bytes 0-9/*", responseStatus: 308},
+			{byteRange: "bytes 10-10/11", responseStatus: http.StatusOK, responseBody: objJSON},
+		},
+		bodies: bodyTracker{},
+	}
+	rx := &ResumableUpload{
+		Client:          &http.Client{Transport: tr},
+		Media:           NewMediaBuffer(strings.NewReader("hello world"), 10),
+		MediaType:       "text/plain",
+		ProduceManifest: true,
+	}
+	if _, err := rx.Manifest(); err == nil {
+		t.Error("Manifest before Upload: got nil error")
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	// The body must still be readable by the caller.
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || string(body) != objJSON {
+		t.Errorf("response body: got %q, %v; want %q", body, err, objJSON)
+	}
+
+	m, err := rx.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	want := Manifest{
+		ObjectURL:  "https://storage.googleapis.com/storage/v1/b/bkt/o/obj",
+		Bucket:     "bkt",
+		Name:       "obj",
+		Generation: "1234",
+		ETag:       "CNIJ",
+		TotalBytes: 11,
+		// Digests of "hello world", as reported by Cloud Storage.
+		CRC32C: "yZRlqg==",
+		MD5:    "XrY7u+Ae7tCTyyK7j1rNww==",
+		Chunks: 2,
+	}
+	m.Timing = TimingBreakdown{}
+	if *m != want {
+		t.Errorf("Manifest:\ngot  %+v\nwant %+v", *m, want)
+	}
+}
+
+func TestManifestNotProduced(t *testing.T) {
+	rx := &ResumableUpload{
+		Client:    &http.Client{Transport: &interruptibleTransport{bodies: bodyTracker{}}},
+		Media:     NewMediaBuffer(strings.NewReader("data"), 10),
+		MediaType: "text/plain",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rx.Upload(ctx)
+	if _, err := rx.Manifest(); err == nil {
+		t.Error("Manifest without ProduceManifest: got nil error")
+	}
+	rx.ProduceManifest = true
+	if _, err := rx.Manifest(); err == nil {
+		t.Error("Manifest after failed upload: got nil error")
+	}
+}
+
+func TestMissingMetadata(t *testing.T) {
+	const fullJSON = `{"name":"obj","generation":"1234","crc32c":"yZRlqg=="}`
+	const minimalJSON = `{"name":"obj"}`
+	for _, tc := range []struct {
+		name     string
+		body     string
+		policy   MissingMetadataPolicy
+		wantErr  bool
+		wantWarn bool
+	}{
+		{name: "complete", body: fullJSON, policy: MissingMetadataFail},
+		{name: "warn", body: minimalJSON, policy: MissingMetadataWarn, wantWarn: true},
+		{name: "skip", body: minimalJSON, policy: MissingMetadataSkip},
+		{name: "fail", body: minimalJSON, policy: MissingMetadataFail, wantErr: true},
+		{name: "fail on non-JSON body", body: "OK", policy: MissingMetadataFail, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs strings.Builder
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: &interruptibleTransport{
+					events: []event{
+						{byteRange: "bytes 0-10/11", responseStatus: http.StatusOK, responseBody: tc.body},
+					},
+					bodies: bodyTracker{},
+				}},
+				Media:           NewMediaBuffer(strings.NewReader("hello world"), 100),
+				MediaType:       "text/plain",
+				ProduceManifest: true,
+				MissingMetadata: tc.policy,
+				Logger:          slog.New(slog.NewTextHandler(&logs, nil)),
+			}
+			res, err := rx.Upload(context.Background())
+			if tc.wantErr {
+				var merr *MissingMetadataError
+				if !errors.As(err, &merr) {
+					t.Fatalf("Upload err: got %v, want *MissingMetadataError", err)
+				}
+				if got := strings.Join(merr.Fields, ","); got != "generation,crc32c" {
+					t.Errorf("got missing fields %q, want generation and crc32c", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if m, err := rx.Manifest(); err != nil || m.Name != "obj" {
+				t.Errorf("Manifest: got %+v, %v; want one for obj", m, err)
+			}
+			if got := strings.Contains(logs.String(), "lacks object metadata"); got != tc.wantWarn {
+				t.Errorf("warning logged: got %v, want %v\n%s", got, tc.wantWarn, logs.String())
+			}
+		})
+	}
+}
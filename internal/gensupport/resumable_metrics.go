@@ -0,0 +1,130 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"time"
+)
+
+// MetricsRecorder receives events from a resumable upload, for export to a
+// metrics system. RecordUploadEvent is called synchronously from the goroutine
+// running Upload and should return quickly.
+type MetricsRecorder interface {
+	RecordUploadEvent(ctx context.Context, ev UploadEvent)
+}
+
+// UploadEventKind identifies the kind of an UploadEvent.
+type UploadEventKind int
+
+const (
+	// AttemptRetried reports a failed request that will be retried. It does
+	// not by itself make the upload fail.
+	AttemptRetried UploadEventKind = iota + 1
+	// UploadFailed reports that the upload ultimately failed.
+	UploadFailed
+	// UploadSucceeded reports that the upload completed, possibly after
+	// retries.
+	UploadSucceeded
+	// ChunkSizeReduced reports that the chunk size was halved after repeated
+	// timeouts.
+	ChunkSizeReduced
+	// ChunkCommitted reports that the server committed a chunk.
+	ChunkCommitted
+)
+
+func (k UploadEventKind) String() string {
+	switch k {
+	case AttemptRetried:
+		return "AttemptRetried"
+	case UploadFailed:
+		return "UploadFailed"
+	case UploadSucceeded:
+		return "UploadSucceeded"
+	case ChunkSizeReduced:
+		return "ChunkSizeReduced"
+	case ChunkCommitted:
+		return "ChunkCommitted"
+	}
+	return "UploadEventKind(unknown)"
+}
+
+// UploadEvent describes an event in a resumable upload.
+type UploadEvent struct {
+	Kind UploadEventKind
+	// RequestID is the request ID of the upload, if any. See
+	// ResumableUpload.RequestID.
+	RequestID string
+
+	// Offset is the offset in the media of the chunk being sent, for
+	// AttemptRetried, ChunkSizeReduced and ChunkCommitted.
+	Offset int64
+	// ChunkSize is the new chunk size, for ChunkSizeReduced, or the size of
+	// the chunk, for ChunkCommitted.
+	ChunkSize int
+	// Attempt is the number of the failed attempt at the chunk, starting at
+	// 1, for AttemptRetried, or the number of requests that carried the
+	// chunk, for ChunkCommitted.
+	Attempt int
+	// Status is the HTTP status code of the failed attempt, or 0 if no
+	// response was received, for AttemptRetried.
+	Status int
+	// Pause describes the pause before the next attempt, for
+	// AttemptRetried.
+	Pause PauseBreakdown
+	// ConnReused reports whether the failed attempt was sent over a reused
+	// connection, for AttemptRetried.
+	ConnReused bool
+	// Timeout classifies the timeout, if any, that failed the attempt, for
+	// AttemptRetried.
+	Timeout TimeoutKind
+
+	// Retries is the number of retried requests over the whole upload, for
+	// UploadFailed and UploadSucceeded.
+	Retries int
+	// ReusedConns is the number of chunk requests sent over a reused
+	// connection, for UploadFailed and UploadSucceeded. See
+	// UploadSummary.ReusedConns.
+	ReusedConns int
+	// BytesTransmitted and BytesCommitted are the media bytes sent and
+	// committed over the whole upload, for UploadFailed and
+	// UploadSucceeded. See UploadSummary.
+	BytesTransmitted int64
+	BytesCommitted   int64
+	// Duration is the wall time of the upload, for UploadFailed and
+	// UploadSucceeded, or the time from reading the chunk from the media
+	// until it was committed, for ChunkCommitted.
+	Duration time.Duration
+
+	// Err is the error of the failed attempt or upload, if any.
+	Err error
+}
+
+// recordEvent passes ev to Metrics, if set.
+func (rx *ResumableUpload) recordEvent(ctx context.Context, ev UploadEvent) {
+	if rx.Metrics != nil {
+		ev.RequestID = rx.stats.RequestID
+		if err := rx.callHook(ctx, "Metrics", func() { rx.Metrics.RecordUploadEvent(ctx, ev) }); err != nil {
+			rx.setCallbackErr(err)
+		}
+	}
+}
+
+// recordOutcome reports the terminal outcome of the upload to Metrics.
+func (rx *ResumableUpload) recordOutcome(ctx context.Context, err error) {
+	ev := UploadEvent{
+		Kind:             UploadSucceeded,
+		Retries:          rx.stats.Retries,
+		ReusedConns:      rx.stats.ReusedConns,
+		BytesTransmitted: rx.stats.BytesTransmitted,
+		BytesCommitted:   rx.progress,
+		Duration:         rx.stats.Timing.Total,
+		Err:              err,
+	}
+	if err != nil {
+		ev.Kind = UploadFailed
+	}
+	rx.recordEvent(ctx, ev)
+}
@@ -0,0 +1,264 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type eventRecorder struct {
+	events []UploadEvent
+}
+
+func (r *eventRecorder) RecordUploadEvent(_ context.Context, ev UploadEvent) {
+	r.events = append(r.events, ev)
+}
+
+func (r *eventRecorder) kinds() []UploadEventKind {
+	var kinds []UploadEventKind
+	for _, ev := range r.events {
+		kinds = append(kinds, ev.Kind)
+	}
+	return kinds
+}
+
+func TestMetricsRecorder(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	for _, tc := range []struct {
+		name        string
+		events      []event
+		wantKinds   []UploadEventKind
+		wantRetries int
+	}{
+		{
+			name: "first attempt success",
+			events: []event{
+				{byteRange: "bytes 0-9/10", responseStatus: http.StatusOK},
+			},
+			wantKinds: []UploadEventKind{ChunkCommitted, UploadSucceeded},
+		},
+		{
+			name: "success after retries",
+			events: []event{
+				{byteRange: "bytes 0-9/10", responseStatus: http.StatusServiceUnavailable},
+				{byteRange: "bytes 0-9/10", responseStatus: http.StatusTooManyRequests},
+				{byteRange: "bytes 0-9/10", responseStatus: http.StatusOK},
+			},
+			wantKinds:   []UploadEventKind{AttemptRetried, AttemptRetried, ChunkCommitted, UploadSucceeded},
+			wantRetries: 2,
+		},
+		{
+			name: "failure after retry",
+			events: []event{
+				{byteRange: "bytes 0-9/10", responseStatus: http.StatusServiceUnavailable},
+				{byteRange: "bytes 0-9/10", responseStatus: http.StatusForbidden},
+			},
+			wantKinds:   []UploadEventKind{AttemptRetried, UploadFailed},
+			wantRetries: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &eventRecorder{}
+			rx := &ResumableUpload{
+				Client:    &http.Client{Transport: &interruptibleTransport{events: tc.events, bodies: bodyTracker{}}},
+				Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 10)), 100),
+				MediaType: "text/plain",
+				Metrics:   rec,
+				// Report the terminal 403 as an error.
+				ParseErrorBody: true,
+			}
+			res, err := rx.Upload(context.Background())
+			if err == nil {
+				res.Body.Close()
+			}
+			got := rec.kinds()
+			if len(got) != len(tc.wantKinds) {
+				t.Fatalf("got events %v, want %v", got, tc.wantKinds)
+			}
+			for i := range got {
+				if got[i] != tc.wantKinds[i] {
+					t.Fatalf("got events %v, want %v", got, tc.wantKinds)
+				}
+			}
+			for i, ev := range rec.events[:len(rec.events)-1] {
+				if ev.Kind == ChunkCommitted {
+					if ev.Offset != 0 || ev.ChunkSize != 10 || ev.Attempt != tc.wantRetries+1 {
+						t.Errorf("event %d: got %+v, want the 10-byte chunk after %d attempts", i, ev, tc.wantRetries+1)
+					}
+					continue
+				}
+				if ev.Attempt != i+1 || ev.Status != http.StatusServiceUnavailable && ev.Status != http.StatusTooManyRequests {
+					t.Errorf("event %d: got Attempt=%d Status=%d", i, ev.Attempt, ev.Status)
+				}
+				if ev.Pause != (PauseBreakdown{}) {
+					// NoPauseBackoff never pauses.
+					t.Errorf("event %d: got Pause %+v, want zero pauses", i, ev.Pause)
+				}
+			}
+			last := rec.events[len(rec.events)-1]
+			if last.Retries != tc.wantRetries {
+				t.Errorf("got Retries=%d, want %d", last.Retries, tc.wantRetries)
+			}
+			if (last.Kind == UploadFailed) != (err != nil) || last.Err != err {
+				t.Errorf("terminal event %v with Err=%v, Upload returned %v", last.Kind, last.Err, err)
+			}
+			if err == nil && (last.BytesTransmitted != 10*int64(tc.wantRetries+1) || last.BytesCommitted != 10) {
+				t.Errorf("got BytesTransmitted=%d BytesCommitted=%d, want %d and 10", last.BytesTransmitted, last.BytesCommitted, 10*(tc.wantRetries+1))
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		requestID string
+		metrics   bool
+		wantID    string // "*" for a generated ID
+	}{
+		{name: "caller supplied", requestID: "req-123", metrics: true, wantID: "req-123"},
+		{name: "generated", metrics: true, wantID: "*"},
+		{name: "no telemetry", wantID: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var headers []string
+			rec := &eventRecorder{}
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					headers = append(headers, req.Header.Get("X-Request-Id"))
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				Media:           NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:       "text/plain",
+				RequestID:       tc.requestID,
+				RequestIDHeader: "X-Request-Id",
+			}
+			if tc.metrics {
+				rx.Metrics = rec
+			}
+			var logs strings.Builder
+			if tc.requestID != "" {
+				rx.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+
+			id := rx.Summary().RequestID
+			switch tc.wantID {
+			case "*":
+				if id == "" {
+					t.Fatal("no request ID was generated")
+				}
+			default:
+				if id != tc.wantID {
+					t.Fatalf("Summary RequestID: got %q, want %q", id, tc.wantID)
+				}
+			}
+			if len(headers) != 1 || headers[0] != id {
+				t.Errorf("X-Request-Id headers: got %q, want [%q]", headers, id)
+			}
+			if tc.requestID != "" && !strings.Contains(logs.String(), "requestID="+tc.requestID) {
+				t.Errorf("log does not carry the request ID:\n%s", logs.String())
+			}
+			for _, ev := range rec.events {
+				if ev.RequestID != id {
+					t.Errorf("%v event: got RequestID %q, want %q", ev.Kind, ev.RequestID, id)
+				}
+			}
+		})
+	}
+}
+
+func TestDialTimeoutTelemetry(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	var requests int
+	rec := &eventRecorder{}
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			requests++
+			if requests == 1 {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+		})},
+		URI:       "https://example.com/upload",
+		Media:     NewMediaBuffer(strings.NewReader("hello"), 256),
+		MediaType: "text/plain",
+		Metrics:   rec,
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if len(rec.events) != 3 || rec.events[0].Kind != AttemptRetried || rec.events[0].Timeout != DialTimeout {
+		t.Fatalf("got events %+v, want a retried DialTimeout attempt", rec.events)
+	}
+	if s := rx.Summary(); s.DialTimeouts != 1 || s.TransferTimeouts != 0 {
+		t.Errorf("got DialTimeouts=%d TransferTimeouts=%d, want 1 and 0", s.DialTimeouts, s.TransferTimeouts)
+	}
+}
+
+func TestTelemetryOnConfigurationError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rx   func() *ResumableUpload
+	}{
+		{name: "no media", rx: func() *ResumableUpload { return &ResumableUpload{} }},
+		{name: "invalid host header", rx: func() *ResumableUpload {
+			return &ResumableUpload{
+				Media:      NewMediaBuffer(strings.NewReader("hello"), 256),
+				HostHeader: "bad host",
+			}
+		}},
+		{name: "retry deadline too short", rx: func() *ResumableUpload {
+			return &ResumableUpload{
+				Media:              NewMediaBuffer(strings.NewReader("hello"), 256),
+				ChunkRetryDeadline: time.Nanosecond,
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &eventRecorder{}
+			var summaries []UploadSummary
+			rx := tc.rx()
+			rx.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				t.Fatal("unexpected request")
+				return nil, nil
+			})}
+			rx.Metrics = rec
+			rx.OnComplete = func(s UploadSummary) { summaries = append(summaries, s) }
+			_, err := rx.Upload(context.Background())
+			if err == nil {
+				t.Fatal("Upload succeeded, want a configuration error")
+			}
+			if got := rec.kinds(); len(got) != 1 || got[0] != UploadFailed || rec.events[0].Err != err {
+				t.Errorf("got events %+v, want one UploadFailed with %v", rec.events, err)
+			}
+			if len(summaries) != 1 {
+				t.Fatalf("OnComplete called %d times, want 1", len(summaries))
+			}
+			s := summaries[0]
+			if s.Success || s.Err != err || s.BytesCommitted != 0 || s.Requests != 0 {
+				t.Errorf("got summary %+v, want a failure with %v and no bytes", s, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+// progressQueue delivers progress updates to a callback on a dedicated
+// goroutine, through a bounded queue.
+type progressQueue struct {
+	updates chan int64
+	done    <-chan struct{}
+}
+
+// newProgressQueue starts a goroutine calling deliver with each update pushed
+// to the returned queue, which holds up to size updates.
+func newProgressQueue(size int, deliver func(int64)) *progressQueue {
+	q := &progressQueue{updates: make(chan int64, size)}
+	q.done = spawn(func() {
+		for n := range q.updates {
+			deliver(n)
+		}
+	})
+	return q
+}
+
+// push queues the update n. If the queue is full, the oldest queued update is
+// dropped: updates are cumulative, so n supersedes it.
+func (q *progressQueue) push(n int64) {
+	for {
+		select {
+		case q.updates <- n:
+			return
+		default:
+		}
+		select {
+		case <-q.updates:
+		default:
+		}
+	}
+}
+
+// close waits for the queued updates to be delivered, and stops the
+// goroutine.
+func (q *progressQueue) close() {
+	close(q.updates)
+	<-q.done
+}
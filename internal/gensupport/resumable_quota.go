@@ -0,0 +1,102 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RollingQuota paces uploads so that the media bytes sent within any sliding
+// window of time stay under a cap, matching egress quotas such as "N GiB per
+// hour". Before a chunk is sent, the upload blocks until sending it would not
+// exceed the cap. A RollingQuota may be shared by many uploads, directly or
+// through an UploaderGroup, and is safe for concurrent use.
+type RollingQuota struct {
+	window time.Duration
+	limit  int64
+
+	mu    sync.Mutex
+	sent  []quotaEntry // oldest first; guarded by mu
+	total int64        // sum of sent; guarded by mu
+}
+
+type quotaEntry struct {
+	at time.Time
+	n  int64
+}
+
+// NewRollingQuota returns a RollingQuota that allows at most limit bytes to be
+// sent within any period of length window. A single chunk larger than limit
+// is sent once the window is otherwise empty. NewRollingQuota panics if window
+// or limit is not positive.
+func NewRollingQuota(window time.Duration, limit int64) *RollingQuota {
+	if window <= 0 || limit <= 0 {
+		panic("gensupport: NewRollingQuota requires a positive window and limit")
+	}
+	return &RollingQuota{window: window, limit: limit}
+}
+
+// wait blocks until n bytes may be sent without exceeding the quota, and then
+// charges them to the current window. It returns ctx.Err() if ctx is done
+// first. A nil quota imposes no limit.
+func (q *RollingQuota) wait(ctx context.Context, n int64) error {
+	if q == nil {
+		return nil
+	}
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		q.expire(now)
+		if q.total == 0 || q.total+n <= q.limit {
+			q.sent = append(q.sent, quotaEntry{at: now, n: n})
+			q.total += n
+			q.mu.Unlock()
+			return nil
+		}
+		// Find when enough of the oldest entries leave the window.
+		need := q.total + n - q.limit
+		var freed int64
+		var at time.Time
+		for _, e := range q.sent {
+			freed += e.n
+			at = e.at.Add(q.window)
+			if freed >= need {
+				break
+			}
+		}
+		q.mu.Unlock()
+
+		t := time.NewTimer(at.Sub(now))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// expire drops the entries that have left the window ending at now. q.mu must
+// be held.
+func (q *RollingQuota) expire(now time.Time) {
+	i := 0
+	for ; i < len(q.sent) && !now.Before(q.sent[i].at.Add(q.window)); i++ {
+		q.total -= q.sent[i].n
+	}
+	q.sent = q.sent[i:]
+}
+
+// quota returns the RollingQuota that applies to the upload, if any.
+func (rx *ResumableUpload) quota() *RollingQuota {
+	if rx.Quota != nil {
+		return rx.Quota
+	}
+	if rx.Group != nil {
+		return rx.Group.Quota
+	}
+	return nil
+}
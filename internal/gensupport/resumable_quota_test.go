@@ -0,0 +1,95 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRollingQuotaWait(t *testing.T) {
+	q := NewRollingQuota(50*time.Millisecond, 20)
+	ctx := context.Background()
+
+	start := time.Now()
+	for _, n := range []int64{10, 10} {
+		if err := q.wait(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d >= 50*time.Millisecond {
+		t.Errorf("bytes within the limit waited %v", d)
+	}
+
+	// The window is full, so a further send waits, and gives up when its
+	// context is done.
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := q.wait(cctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait with expired context: got %v, want context.DeadlineExceeded", err)
+	}
+	if err := q.wait(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("send past the limit waited only %v, want at least the window", d)
+	}
+
+	// A send larger than the limit goes through once the window is empty.
+	if err := q.wait(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollingQuotaSharedByGroup(t *testing.T) {
+	var mu sync.Mutex
+	var sends []time.Time
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		io.Copy(io.Discard, req.Body)
+		mu.Lock()
+		sends = append(sends, time.Now())
+		mu.Unlock()
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})}
+	g := &UploaderGroup{Quota: NewRollingQuota(100*time.Millisecond, 10)}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	rxs := make([]*ResumableUpload, 2)
+	for i := range rxs {
+		rxs[i] = &ResumableUpload{
+			Client:    client,
+			URI:       "https://example.com/upload",
+			Media:     NewMediaBuffer(strings.NewReader("0123456789"), 10),
+			MediaType: "text/plain",
+			Group:     g,
+		}
+		wg.Add(1)
+		go func(rx *ResumableUpload) {
+			defer wg.Done()
+			if _, err := rx.Upload(context.Background()); err != nil {
+				t.Errorf("Upload: %v", err)
+			}
+		}(rxs[i])
+	}
+	wg.Wait()
+
+	// Only one upload fits in the window, so the other waits for it.
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("uploads took %v, want at least the quota window", d)
+	}
+	if len(sends) != 2 {
+		t.Fatalf("got %d requests, want 2", len(sends))
+	}
+	if w := rxs[0].Summary().Timing.QuotaWait + rxs[1].Summary().Timing.QuotaWait; w < 50*time.Millisecond {
+		t.Errorf("got total QuotaWait %v, want the second upload to wait", w)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// RecordedExchange is the metadata of one request made by a resumable upload
+// and of the response it received, as written by ResumableUpload.RecordTo.
+// Media bytes are never recorded.
+type RecordedExchange struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	RequestHeader http.Header `json:"requestHeader,omitempty"`
+	// ContentLength is the number of media bytes in the request.
+	ContentLength int64 `json:"contentLength"`
+
+	// StatusCode and ResponseHeader describe the response. They are empty if
+	// the request failed, in which case Error is set.
+	StatusCode     int         `json:"statusCode,omitempty"`
+	ResponseHeader http.Header `json:"responseHeader,omitempty"`
+	Error          string      `json:"error,omitempty"`
+}
+
+// redactedHeaders are replaced in recordings, since they may carry secrets.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range redactedHeaders {
+		if _, ok := h[k]; ok {
+			h[k] = []string{"REDACTED"}
+		}
+	}
+	if loc := h.Get("Location"); loc != "" {
+		h.Set("Location", redactURL(loc))
+	}
+	return h
+}
+
+// redactURL replaces the upload_id query parameter of the session URI s,
+// which grants access to the upload session, in recordings.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	q := u.Query()
+	if !q.Has("upload_id") {
+		return s
+	}
+	q.Set("upload_id", "REDACTED")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// recordingTransport writes a RecordedExchange for each round trip, as a line
+// of JSON.
+type recordingTransport struct {
+	base http.RoundTripper
+
+	mu  sync.Mutex // guards enc
+	enc *json.Encoder
+}
+
+func newRecordingTransport(base http.RoundTripper, w io.Writer) *recordingTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &recordingTransport{base: base, enc: json.NewEncoder(w)}
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ex := RecordedExchange{
+		Method:        req.Method,
+		URL:           redactURL(req.URL.String()),
+		RequestHeader: redactHeader(req.Header),
+		ContentLength: req.ContentLength,
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		ex.Error = err.Error()
+	} else {
+		ex.StatusCode = resp.StatusCode
+		ex.ResponseHeader = redactHeader(resp.Header)
+	}
+	t.mu.Lock()
+	// Recording is best effort, and never fails the upload.
+	t.enc.Encode(&ex)
+	t.mu.Unlock()
+	return resp, err
+}
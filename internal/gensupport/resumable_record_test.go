@@ -0,0 +1,64 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRecordingRedactsUploadID(t *testing.T) {
+	const session = "https://example.com/upload?name=obj&upload_id=secret&uploadType=resumable"
+	var rec strings.Builder
+	rt := newRecordingTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		h := http.Header{}
+		h.Set("Location", session)
+		return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+	}), &rec)
+	for _, uri := range []string{"https://example.com/upload?uploadType=resumable", session} {
+		req, err := http.NewRequest("POST", uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Location"); got != session {
+			t.Errorf("response Location: got %q, want %q unchanged", got, session)
+		}
+	}
+	if strings.Contains(rec.String(), "secret") {
+		t.Errorf("recording contains the upload ID:\n%s", rec.String())
+	}
+
+	dec := json.NewDecoder(strings.NewReader(rec.String()))
+	var exs []RecordedExchange
+	for dec.More() {
+		var ex RecordedExchange
+		if err := dec.Decode(&ex); err != nil {
+			t.Fatal(err)
+		}
+		exs = append(exs, ex)
+	}
+	if len(exs) != 2 {
+		t.Fatalf("got %d recorded exchanges, want 2", len(exs))
+	}
+	const redacted = "https://example.com/upload?name=obj&uploadType=resumable&upload_id=REDACTED"
+	if got, want := exs[0].URL, "https://example.com/upload?uploadType=resumable"; got != want {
+		t.Errorf("URL without upload_id: got %q, want %q", got, want)
+	}
+	if got := exs[1].URL; got != redacted {
+		t.Errorf("URL: got %q, want %q", got, redacted)
+	}
+	for i, ex := range exs {
+		if got := ex.ResponseHeader.Get("Location"); got != redacted {
+			t.Errorf("exchange %d Location: got %q, want %q", i, got, redacted)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sessionTimeout returns the timeout for establishing the upload session.
+func (rx *ResumableUpload) sessionTimeout() time.Duration {
+	if rx.SessionEstablishTimeout != 0 {
+		return rx.SessionEstablishTimeout
+	}
+	return rx.ChunkTransferTimeout
+}
+
+// EstablishSession creates the upload session with NewSessionRequest, without
+// transferring any media, and returns its URI. The URI is also stored in URI,
+// so a later call to Upload transfers the media to the same session rather
+// than creating another. The URI may instead be handed to another
+// ResumableUpload, for example by a broker that creates sessions for its
+// clients. If URI is already set, EstablishSession returns it without sending
+// a request.
+func (rx *ResumableUpload) EstablishSession(ctx context.Context) (string, error) {
+	if rx.URI != "" {
+		return rx.URI, nil
+	}
+	if rx.NewSessionRequest == nil {
+		return "", errors.New("EstablishSession requires NewSessionRequest")
+	}
+	if err := rx.establishSession(ctx); err != nil {
+		return "", err
+	}
+	return rx.URI, nil
+}
+
+// establishSession creates the upload session by sending the request returned
+// by NewSessionRequest, and sets URI to the session URI from the Location
+// header of the response. If the request keeps failing, it is sent to each of
+// AlternateHosts in turn.
+func (rx *ResumableUpload) establishSession(ctx context.Context) error {
+	sctx := ctx
+	timeout := rx.sessionTimeout()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		sctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// The empty host stands for the host of the request as given.
+	hosts := append([]string{""}, rx.AlternateHosts...)
+	var resp *http.Response
+	var err error
+	for i, host := range hosts {
+		resp, err = rx.sendSessionRequest(sctx, host, i == len(hosts)-1)
+		if resp != nil || err != nil && sctx.Err() != nil {
+			break
+		}
+		if l := rx.logger(); l != nil && i+1 < len(hosts) {
+			l.WarnContext(ctx, "resumable upload session creation failed; trying an alternate host",
+				"host", host, "alternateHost", hosts[i+1], "err", err)
+		}
+	}
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(sctx.Err(), context.DeadlineExceeded) {
+			return &SessionEstablishTimeoutError{Timeout: timeout, Err: err}
+		}
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return rx.errorFromResponse(resp)
+	}
+	drainAndClose(resp)
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return errors.New("upload session response has no Location header")
+	}
+	rx.URI = loc
+	return nil
+}
+
+// sendSessionRequest sends the request returned by NewSessionRequest, with
+// retries, to host, or to the host of the request if host is empty. Unless
+// last is set, retries are bounded by the chunk retry deadline, and a failure
+// that might succeed on another host is returned as an error with a nil
+// response, with the response, if any, closed.
+func (rx *ResumableUpload) sendSessionRequest(ctx context.Context, host string, last bool) (*http.Response, error) {
+	var req *http.Request
+	var err error
+	if perr := rx.callDecisionHook(ctx, "NewSessionRequest", func() { req, err = rx.NewSessionRequest() }); perr != nil {
+		return nil, perr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		req.URL.Host = host
+		req.Host = host
+	}
+	if last {
+		return sendRequestWithRetry(ctx, rx.client(), req, rx.Retry, rx.idempotencyHeaderName())
+	}
+	deadline := rx.ChunkRetryDeadline
+	if deadline == 0 {
+		deadline = defaultRetryDeadline
+	}
+	hctx, cancel := context.WithTimeout(ctx, deadline)
+	resp, err := sendRequestWithRetry(hctx, rx.client(), req, rx.Retry, rx.idempotencyHeaderName())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if rx.Retry.errorFunc()(resp.StatusCode, nil) {
+		cancel()
+		drainAndClose(resp)
+		return nil, fmt.Errorf("creating upload session on %s: unexpected response status %d", req.URL.Host, resp.StatusCode)
+	}
+	// The body is read after this returns.
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// sessionTarget returns the bucket and object named by a Cloud Storage JSON
+// API session URI, such as
+// https://storage.googleapis.com/upload/storage/v1/b/BUCKET/o?uploadType=resumable&name=OBJECT&upload_id=ID.
+// Either is empty if the URI does not name it.
+func sessionTarget(uri string) (bucket, object string) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", ""
+	}
+	segs := strings.Split(u.Path, "/")
+	for i := 0; i+1 < len(segs); i++ {
+		if segs[i] == "b" {
+			bucket = segs[i+1]
+			break
+		}
+	}
+	return bucket, u.Query().Get("name")
+}
+
+// checkSessionTarget returns a *SessionTargetMismatchError if URI does not
+// name ExpectedBucket and ExpectedObject, where set.
+func (rx *ResumableUpload) checkSessionTarget() error {
+	if rx.ExpectedBucket == "" && rx.ExpectedObject == "" {
+		return nil
+	}
+	bucket, object := sessionTarget(rx.URI)
+	if rx.ExpectedBucket != "" && bucket != rx.ExpectedBucket || rx.ExpectedObject != "" && object != rx.ExpectedObject {
+		return &SessionTargetMismatchError{
+			ExpectedBucket: rx.ExpectedBucket,
+			ExpectedObject: rx.ExpectedObject,
+			Bucket:         bucket,
+			Object:         object,
+		}
+	}
+	return nil
+}
+
+// approveURI calls ApproveURI, if set, with URI, asking the server to discard
+// the session if it is not approved.
+func (rx *ResumableUpload) approveURI(ctx context.Context) error {
+	if rx.ApproveURI == nil {
+		return nil
+	}
+	var err error
+	if perr := rx.callDecisionHook(ctx, "ApproveURI", func() { err = rx.ApproveURI(rx.URI) }); perr != nil {
+		err = perr
+	}
+	if err != nil {
+		rx.cancelSession(ctx)
+	}
+	return err
+}
+
+// sessionExpired reports whether resp shows that the upload session no longer
+// exists.
+func sessionExpired(resp *http.Response) bool {
+	return resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone)
+}
+
+// restartSession starts the upload over in a new session, after its session
+// expired: it rewinds Media to the start and creates the session with
+// NewSessionRequest.
+func (rx *ResumableUpload) restartSession(ctx context.Context) error {
+	if err := rx.Media.rewind(0); err != nil {
+		return err
+	}
+	expired := rx.URI
+	rx.URI = ""
+	if err := rx.establishSession(ctx); err != nil {
+		return err
+	}
+	if err := rx.checkSessionTarget(); err != nil {
+		return err
+	}
+	if err := rx.approveURI(ctx); err != nil {
+		return err
+	}
+	rx.stats.SessionRestarts++
+	if l := rx.logger(); l != nil {
+		l.WarnContext(ctx, "resumable upload session expired; starting over in a new session",
+			"expiredURI", expired, "offset", rx.Progress(), "restarts", rx.stats.SessionRestarts)
+	}
+	rx.setProgress(0)
+	rx.finalSent = false
+	if rx.ProduceManifest {
+		rx.digests = newMediaDigests()
+	}
+	rx.prefixCRC, rx.prefixCRCValid = 0, rx.CheckpointChecksum
+	rx.updateCheckpoint(0)
+	return nil
+}
@@ -0,0 +1,410 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEstablishSession(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/upload":
+			w.Header().Set("Location", "http://"+r.Host+"/session/1")
+			w.WriteHeader(http.StatusOK)
+		case "/session/1":
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	rx := &ResumableUpload{
+		Client:    srv.Client(),
+		Media:     NewMediaBuffer(strings.NewReader("hello"), 256),
+		MediaType: "text/plain",
+		NewSessionRequest: func() (*http.Request, error) {
+			return http.NewRequest("POST", srv.URL+"/upload", nil)
+		},
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if want := srv.URL + "/session/1"; rx.URI != want {
+		t.Errorf("URI: got %q, want %q", rx.URI, want)
+	}
+	if want := []string{"POST /upload", "POST /session/1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got requests %q, want %q", got, want)
+	}
+}
+
+func TestEstablishSessionIdempotencyHeaderName(t *testing.T) {
+	var got http.Header
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			got = req.Header.Clone()
+			h := http.Header{"Location": {"https://example.com/session/1"}}
+			return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+		})},
+		IdempotencyHeaderName: "Idempotency-Key",
+		NewSessionRequest: func() (*http.Request, error) {
+			return http.NewRequest("POST", "https://example.com/upload", nil)
+		},
+	}
+	if _, err := rx.EstablishSession(context.Background()); err != nil {
+		t.Fatalf("EstablishSession: %v", err)
+	}
+	if got.Get("Idempotency-Key") == "" {
+		t.Errorf("Idempotency-Key not set on the session request; headers: %v", got)
+	}
+	if v := got.Get(defaultIdempotencyHeaderName); v != "" {
+		t.Errorf("%s unexpectedly set to %q", defaultIdempotencyHeaderName, v)
+	}
+}
+
+func TestEstablishSessionBeforeUpload(t *testing.T) {
+	var sessions int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/upload":
+			sessions++
+			w.Header().Set("Location", "http://"+r.Host+"/session/1")
+			w.WriteHeader(http.StatusOK)
+		case "/session/1":
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	rx := &ResumableUpload{
+		Client:    srv.Client(),
+		Media:     NewMediaBuffer(strings.NewReader("hello"), 256),
+		MediaType: "text/plain",
+		NewSessionRequest: func() (*http.Request, error) {
+			return http.NewRequest("POST", srv.URL+"/upload", nil)
+		},
+	}
+	uri, err := rx.EstablishSession(context.Background())
+	if err != nil {
+		t.Fatalf("EstablishSession: %v", err)
+	}
+	if want := srv.URL + "/session/1"; uri != want || rx.URI != want {
+		t.Errorf("got URI %q (field %q), want %q", uri, rx.URI, want)
+	}
+	if again, err := rx.EstablishSession(context.Background()); err != nil || again != uri {
+		t.Errorf("second EstablishSession: got %q, %v, want %q", again, err, uri)
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if sessions != 1 {
+		t.Errorf("created %d sessions, want 1", sessions)
+	}
+
+	if _, err := (&ResumableUpload{}).EstablishSession(context.Background()); err == nil {
+		t.Error("EstablishSession without NewSessionRequest succeeded, want error")
+	}
+}
+
+func TestSessionEstablishTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	rx := &ResumableUpload{
+		Client:    srv.Client(),
+		Media:     NewMediaBuffer(strings.NewReader("hello"), 256),
+		MediaType: "text/plain",
+		NewSessionRequest: func() (*http.Request, error) {
+			return http.NewRequest("POST", srv.URL+"/upload", nil)
+		},
+		SessionEstablishTimeout: 50 * time.Millisecond,
+		// Chunk transfers may take much longer than session creation.
+		ChunkTransferTimeout: time.Hour,
+	}
+	start := time.Now()
+	_, err := rx.Upload(context.Background())
+	var terr *SessionEstablishTimeoutError
+	if !errors.As(err, &terr) {
+		t.Fatalf("Upload err: got %v, want *SessionEstablishTimeoutError", err)
+	}
+	if terr.Timeout != rx.SessionEstablishTimeout {
+		t.Errorf("got Timeout %v, want %v", terr.Timeout, rx.SessionEstablishTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Upload took %v, want it to fail fast", elapsed)
+	}
+}
+
+func TestAlternateHosts(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string // of the session request
+	}{
+		// Without a body to resend, the 503 is returned at once.
+		{name: "unretryable request"},
+		// Otherwise, retries go on until ChunkRetryDeadline.
+		{name: "retried request", body: "{}"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var primary int
+			down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				primary++
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer down.Close()
+			var got []string
+			up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = append(got, r.Method+" "+r.Host+r.URL.Path)
+				io.Copy(io.Discard, r.Body)
+				if r.URL.Path == "/upload" {
+					w.Header().Set("Location", "http://"+r.Host+"/session/1")
+				}
+			}))
+			defer up.Close()
+			upHost := strings.TrimPrefix(up.URL, "http://")
+
+			rx := &ResumableUpload{
+				Client:    up.Client(),
+				Media:     NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType: "text/plain",
+				NewSessionRequest: func() (*http.Request, error) {
+					var body io.Reader
+					if tc.body != "" {
+						body = strings.NewReader(tc.body)
+					}
+					return http.NewRequest("POST", down.URL+"/upload", body)
+				},
+				AlternateHosts:     []string{upHost},
+				ChunkRetryDeadline: 150 * time.Millisecond,
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if primary == 0 {
+				t.Error("the primary host was not tried")
+			}
+			want := []string{"POST " + upHost + "/upload", "POST " + upHost + "/session/1"}
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("got requests %q on the alternate host, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestVerifyChunkGranularity(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		granularity   string
+		snap          bool
+		wantErr       bool
+		wantChunkSize int
+	}{
+		{name: "no header", granularity: "", wantChunkSize: 300},
+		{name: "compatible", granularity: "100", wantChunkSize: 300},
+		{name: "incompatible", granularity: "128", wantErr: true},
+		{name: "snapped", granularity: "128", snap: true, wantChunkSize: 256},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sizes []int64
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					h := http.Header{}
+					if req.Header.Get("Content-Range") == "bytes */*" {
+						h.Set(chunkGranularityHeader, tc.granularity)
+						h.Set("X-Http-Status-Code-Override", "308")
+						return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+					}
+					sizes = append(sizes, req.ContentLength)
+					if !strings.HasSuffix(req.Header.Get("Content-Range"), "/1000") {
+						h.Set("X-Http-Status-Code-Override", "308")
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+				})},
+				Media:                  NewMediaBuffer(strings.NewReader(strings.Repeat("a", 1000)), 300),
+				MediaType:              "text/plain",
+				VerifyChunkGranularity: true,
+				SnapChunkSize:          tc.snap,
+			}
+			res, err := rx.Upload(context.Background())
+			if tc.wantErr {
+				var gerr *ChunkGranularityError
+				if !errors.As(err, &gerr) {
+					t.Fatalf("Upload err: got %v, want *ChunkGranularityError", err)
+				}
+				if gerr.ChunkSize != 300 || gerr.Granularity != 128 {
+					t.Errorf("got %+v, want chunk size 300 and granularity 128", gerr)
+				}
+				if len(sizes) > 0 {
+					t.Errorf("sent %d chunks, want none", len(sizes))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if sizes[0] != int64(tc.wantChunkSize) {
+				t.Errorf("got first chunk of %d bytes, want %d", sizes[0], tc.wantChunkSize)
+			}
+		})
+	}
+}
+
+func TestSessionTarget(t *testing.T) {
+	const uri = "https://storage.googleapis.com/upload/storage/v1/b/my-bucket/o?uploadType=resumable&name=dir%2Fobj.txt&upload_id=xyz"
+	for _, tc := range []struct {
+		name           string
+		uri            string
+		bucket, object string
+		wantErr        bool
+	}{
+		{name: "unchecked", uri: "https://example.com/upload?id=1"},
+		{name: "match", uri: uri, bucket: "my-bucket", object: "dir/obj.txt"},
+		{name: "bucket only", uri: uri, bucket: "my-bucket"},
+		{name: "object only", uri: uri, object: "dir/obj.txt"},
+		{name: "wrong bucket", uri: uri, bucket: "other-bucket", object: "dir/obj.txt", wantErr: true},
+		{name: "wrong object", uri: uri, bucket: "my-bucket", object: "obj.txt", wantErr: true},
+		{name: "unparseable format", uri: "https://example.com/upload?id=1", bucket: "my-bucket", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					requests++
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:            tc.uri,
+				Media:          NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:      "text/plain",
+				ExpectedBucket: tc.bucket,
+				ExpectedObject: tc.object,
+			}
+			res, err := rx.Upload(context.Background())
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("Upload: %v", err)
+				}
+				res.Body.Close()
+				return
+			}
+			var merr *SessionTargetMismatchError
+			if !errors.As(err, &merr) {
+				t.Fatalf("Upload err: got %v, want *SessionTargetMismatchError", err)
+			}
+			if merr.ExpectedBucket != tc.bucket || merr.ExpectedObject != tc.object {
+				t.Errorf("got %+v, want expected bucket %q and object %q", merr, tc.bucket, tc.object)
+			}
+			if requests != 0 {
+				t.Errorf("sent %d requests, want none", requests)
+			}
+		})
+	}
+}
+
+func TestMaxSessionRestarts(t *testing.T) {
+	const media = "0123456789abcdefghijklmno"
+	for _, tc := range []struct {
+		name         string
+		restarts     int
+		seekable     bool
+		expireIn     int // number of sessions in which the second chunk gets a 404
+		wantErr      bool
+		wantRestarts int
+	}{
+		{name: "restarted", restarts: 2, seekable: true, expireIn: 1, wantRestarts: 1},
+		{name: "exhausted", restarts: 1, seekable: true, expireIn: 2, wantErr: true, wantRestarts: 1},
+		{name: "not seekable", restarts: 1, expireIn: 1, wantErr: true},
+		{name: "disabled", restarts: 0, seekable: true, expireIn: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sessions int
+			received := map[int]string{} // media received, by session
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					h := http.Header{}
+					if req.URL.Path == "/upload" {
+						sessions++
+						h.Set("Location", fmt.Sprintf("https://example.com/session/%d", sessions))
+						return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+					}
+					var session int
+					fmt.Sscanf(req.URL.Path, "/session/%d", &session)
+					b, _ := io.ReadAll(req.Body)
+					req.Body.Close()
+					if strings.HasPrefix(req.Header.Get("Content-Range"), "bytes 10-") && session <= tc.expireIn {
+						return &http.Response{StatusCode: http.StatusNotFound, Header: h, Body: http.NoBody}, nil
+					}
+					received[session] += string(b)
+					if !strings.HasSuffix(req.Header.Get("Content-Range"), "/25") {
+						h.Set("X-Http-Status-Code-Override", "308")
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+				})},
+				MediaType: "text/plain",
+				NewSessionRequest: func() (*http.Request, error) {
+					return http.NewRequest("POST", "https://example.com/upload", nil)
+				},
+				MaxSessionRestarts: tc.restarts,
+			}
+			if tc.seekable {
+				rx.Media = NewMediaBuffer(strings.NewReader(media), 10)
+			} else {
+				rx.Media = NewMediaBuffer(onlyReader{strings.NewReader(media)}, 10)
+			}
+			res, err := rx.Upload(context.Background())
+			if got := rx.Summary().SessionRestarts; got != tc.wantRestarts {
+				t.Errorf("got SessionRestarts=%d, want %d", got, tc.wantRestarts)
+			}
+			if tc.wantErr {
+				var serr *SessionExpiredError
+				if !errors.As(err, &serr) || serr.StatusCode != http.StatusNotFound {
+					t.Fatalf("Upload err: got %v, want *SessionExpiredError with status 404", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if tc.restarts == 0 {
+				if res.StatusCode != http.StatusNotFound {
+					t.Errorf("got status %d, want the 404 returned", res.StatusCode)
+				}
+				return
+			}
+			if got := received[sessions]; got != media {
+				t.Errorf("new session received %q, want the whole media %q", got, media)
+			}
+		})
+	}
+}
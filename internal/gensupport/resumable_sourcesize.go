@@ -0,0 +1,63 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"io"
+	"io/fs"
+)
+
+// sourceSize returns the current size of the media r, if it reports one: an
+// *os.File, or anything else with a Stat method, reports the size of the
+// file, and a reader with a Size method, such as a *bytes.Reader, reports
+// that. A section of either, as made by ReaderAtToReader, reports the size
+// of the whole, since the section keeps its size when the whole changes.
+func sourceSize(r io.Reader) (int64, bool) {
+	if rt, isTyper := r.(readerTyper); isTyper {
+		r = rt.Reader
+	}
+	var src any = r
+	if sr, ok := r.(*io.SectionReader); ok {
+		src, _, _ = sr.Outer()
+	}
+	switch r := src.(type) {
+	case interface{ Stat() (fs.FileInfo, error) }:
+		fi, err := r.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0, false
+		}
+		return fi.Size(), true
+	case interface{ Size() int64 }:
+		return r.Size(), true
+	}
+	return 0, false
+}
+
+// recordSourceSize records the size of the media, as it was when Media was
+// created, before any of it was read, for checkSourceSize, if
+// DetectSourceSizeChange is set.
+func (rx *ResumableUpload) recordSourceSize() {
+	rx.sourceSize = -1
+	if rx.DetectSourceSizeChange {
+		rx.sourceSize = rx.Media.initialSize
+	}
+}
+
+// checkSourceSize returns a *SourceSizeChangedError if DetectSourceSizeChange
+// is set and the size of the media has changed since recordSourceSize, before
+// the chunk at offset off.
+func (rx *ResumableUpload) checkSourceSize(off int64) error {
+	if !rx.DetectSourceSizeChange || rx.sourceSize < 0 {
+		return nil
+	}
+	size, ok := sourceSize(rx.Media.media)
+	if !ok {
+		return nil
+	}
+	if size != rx.sourceSize {
+		return &SourceSizeChangedError{Offset: off, Initial: rx.sourceSize, Current: size}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestDetectSourceSizeChange(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		grow    bool
+		wantErr bool
+	}{
+		{name: "unchanged"},
+		{name: "grown", grow: true, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "media")
+			if err := os.WriteFile(path, []byte(strings.Repeat("a", 25)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var requests int
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					io.Copy(io.Discard, req.Body)
+					requests++
+					if tc.grow && requests == 1 {
+						// The file is appended to while it is uploaded.
+						w, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+						if err != nil {
+							return nil, err
+						}
+						w.WriteString("bbbbb")
+						w.Close()
+					}
+					if strings.HasSuffix(req.Header.Get("Content-Range"), "/*") {
+						return incompleteResponse(), nil
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:                    "https://example.com/upload",
+				Media:                  NewMediaBuffer(f, 10),
+				MediaType:              "text/plain",
+				DetectSourceSizeChange: true,
+			}
+			res, err := rx.Upload(context.Background())
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("Upload: %v", err)
+				}
+				res.Body.Close()
+				return
+			}
+			var serr *SourceSizeChangedError
+			if !errors.As(err, &serr) {
+				t.Fatalf("Upload err: got %v, want *SourceSizeChangedError", err)
+			}
+			if want := (SourceSizeChangedError{Offset: 10, Initial: 25, Current: 30}); *serr != want {
+				t.Errorf("got %+v, want %+v", *serr, want)
+			}
+			if requests != 1 {
+				t.Errorf("sent %d requests, want 1", requests)
+			}
+		})
+	}
+}
+
+// growingReader is media whose size grows by 5 bytes as its first bytes are
+// read, as a file appended to while it is uploaded does.
+type growingReader struct {
+	*strings.Reader
+	size int64
+}
+
+func (r *growingReader) Read(p []byte) (int, error) {
+	if r.size == r.Reader.Size() {
+		r.size += 5
+	}
+	return r.Reader.Read(p)
+}
+
+func (r *growingReader) Size() int64 { return r.size }
+
+func TestDetectSourceSizeChangeBeforeFirstChunk(t *testing.T) {
+	var requests int
+	media := &growingReader{Reader: strings.NewReader(strings.Repeat("a", 25)), size: 25}
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			requests++
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+		})},
+		URI:                    "https://example.com/upload",
+		Media:                  NewMediaBuffer(media, 10),
+		MediaType:              "text/plain",
+		DetectSourceSizeChange: true,
+	}
+	_, err := rx.Upload(context.Background())
+	var serr *SourceSizeChangedError
+	if !errors.As(err, &serr) {
+		t.Fatalf("Upload err: got %v, want *SourceSizeChangedError", err)
+	}
+	if want := (SourceSizeChangedError{Offset: 0, Initial: 25, Current: 30}); *serr != want {
+		t.Errorf("got %+v, want %+v", *serr, want)
+	}
+	if requests != 0 {
+		t.Errorf("sent %d requests, want none", requests)
+	}
+}
+
+func TestDetectSourceSizeChangeMediaInfo(t *testing.T) {
+	const size = googleapi.MinUploadChunkSize + 10
+	for _, tc := range []struct {
+		name string
+		info func(f *os.File) *MediaInfo
+	}{
+		{
+			name: "NewInfoFromMedia",
+			info: func(f *os.File) *MediaInfo {
+				return NewInfoFromMedia(f, []googleapi.MediaOption{googleapi.ContentType("text/plain"), googleapi.ChunkSize(googleapi.MinUploadChunkSize)})
+			},
+		},
+		{
+			name: "NewInfoFromResumableMedia",
+			info: func(f *os.File) *MediaInfo {
+				return NewInfoFromResumableMedia(f, size, "text/plain")
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "media")
+			if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			mi := tc.info(f)
+			// The file is appended to after MediaInfo has read the first
+			// chunk, but before the upload starts.
+			w, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.WriteString("bbbbb")
+			w.Close()
+
+			var requests int
+			rx := mi.ResumableUpload("https://example.com/upload")
+			rx.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				requests++
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			})}
+			rx.DetectSourceSizeChange = true
+			_, err = rx.Upload(context.Background())
+			var serr *SourceSizeChangedError
+			if !errors.As(err, &serr) {
+				t.Fatalf("Upload err: got %v, want *SourceSizeChangedError", err)
+			}
+			if want := (SourceSizeChangedError{Offset: 0, Initial: size, Current: size + 5}); *serr != want {
+				t.Errorf("got %+v, want %+v", *serr, want)
+			}
+			if requests != 0 {
+				t.Errorf("sent %d requests, want none", requests)
+			}
+		})
+	}
+}
+
+func TestSourceSize(t *testing.T) {
+	if n, ok := sourceSize(strings.NewReader("hello")); !ok || n != 5 {
+		t.Errorf("sourceSize(strings.Reader): got %d, %v; want 5, true", n, ok)
+	}
+	if n, ok := sourceSize(io.NewSectionReader(strings.NewReader("hello"), 1, 2)); !ok || n != 5 {
+		t.Errorf("sourceSize(io.SectionReader): got %d, %v; want the 5 bytes of the whole, true", n, ok)
+	}
+	if _, ok := sourceSize(io.LimitReader(strings.NewReader("hello"), 3)); ok {
+		t.Error("sourceSize(io.LimitedReader): got a size for a stream")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UploadSummary describes the outcome of a resumable upload. It is available
+// from ResumableUpload.Summary once Upload has returned.
+type UploadSummary struct {
+	// RequestID is the request ID of the upload, if any. See
+	// ResumableUpload.RequestID.
+	RequestID string
+
+	// Success reports whether Upload returned a response rather than an error.
+	Success bool
+	// Err is the error returned by Upload, if any.
+	Err error
+
+	// BytesCommitted is the number of media bytes acknowledged by the server.
+	BytesCommitted int64
+	// BytesTransmitted is the number of media bytes sent, including
+	// retransmissions of retried chunks.
+	BytesTransmitted int64
+	// RetransmissionRatio is the number of media bytes sent more than once
+	// divided by the bytes committed by the upload, excluding any committed
+	// before it resumed from ResumeFrom: 0 means that no byte was resent,
+	// and 1 that, on average, each byte was sent twice. It is 0 if no bytes
+	// were committed.
+	RetransmissionRatio float64
+	// Chunks is the number of chunks committed.
+	Chunks int
+	// Requests is the number of chunk requests sent, including retries.
+	Requests int
+	// Retries is the number of chunk requests that failed and were retried.
+	Retries int
+	// DialTimeouts and TransferTimeouts count the retried chunk requests
+	// that failed because connecting to the server timed out, and because
+	// the request timed out once connected, respectively.
+	DialTimeouts     int
+	TransferTimeouts int
+	// ConnResets is the number of chunk requests that failed because their
+	// connection was reset or broken.
+	ConnResets int
+	// ReusedConns is the number of chunk requests sent over a reused
+	// connection. If it is well below Requests, connections are not being
+	// kept alive between chunks, and each chunk pays for a new connection.
+	ReusedConns int
+	// DistinctServers approximates the number of distinct servers that
+	// answered chunk requests, identified by the Via response header or
+	// else by the server address, and counted up to 64. A high count points
+	// at connection churn or a flapping load balancer.
+	DistinctServers int
+	// ChunkSizeReductions is the number of times the chunk size was halved
+	// after repeated timeouts.
+	ChunkSizeReductions int
+	// KeepAliveProbes is the number of keep-alive status probes sent between
+	// chunks.
+	KeepAliveProbes int
+	// SessionRestarts is the number of times the upload was started over in
+	// a new session after its session expired. See
+	// ResumableUpload.MaxSessionRestarts.
+	SessionRestarts int
+
+	// DeadlineBudgetUsed and DeadlineBudgetRemaining split
+	// ResumableUpload.TotalDeadline into the part taken by the upload and the
+	// part left when it ended. They are zero unless TotalDeadline is set.
+	DeadlineBudgetUsed      time.Duration
+	DeadlineBudgetRemaining time.Duration
+
+	// ResponseHeaders holds the headers of the final response listed in
+	// ResumableUpload.CaptureResponseHeaders, keyed by canonical name.
+	// Headers absent from the response are omitted.
+	ResponseHeaders map[string]string
+
+	// Backoff describes the backoff used between retries.
+	Backoff BackoffDescription
+
+	// Timing breaks down where the time of the upload was spent.
+	Timing TimingBreakdown
+}
+
+// TimingBreakdown splits the wall time of an upload into its phases.
+type TimingBreakdown struct {
+	// Total is the wall time of Upload.
+	Total time.Duration
+	// Transfer is the time spent in requests carrying non-final chunks.
+	Transfer time.Duration
+	// Backoff is the time spent pausing between attempts.
+	Backoff time.Duration
+	// Finalization is the time spent in requests carrying the final chunk.
+	Finalization time.Duration
+	// RecoveryProbe is the time spent in status probes before retries.
+	RecoveryProbe time.Duration
+	// QuotaWait is the time spent waiting for a RollingQuota to allow a
+	// chunk to be sent.
+	QuotaWait time.Duration
+
+	// Wire is the part of Transfer and Finalization spent writing chunk
+	// requests, from sending the request until its body was fully written.
+	Wire time.Duration
+	// ServerThink is the part of Transfer and Finalization spent waiting
+	// for the server, from the request being fully written until the first
+	// byte of the response arrived. A large ServerThink relative to Wire
+	// points at a slow backend rather than a slow link.
+	ServerThink time.Duration
+}
+
+// Summary returns a summary of the upload. It is the zero value until Upload
+// returns.
+func (rx *ResumableUpload) Summary() UploadSummary {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	return rx.summary
+}
+
+// Bounds on the headers captured by captureResponseHeaders.
+const (
+	maxCapturedHeaders     = 32
+	maxCapturedHeaderBytes = 1 << 10
+)
+
+// captureResponseHeaders copies the headers listed in CaptureResponseHeaders
+// from resp into the summary.
+func (rx *ResumableUpload) captureResponseHeaders(resp *http.Response) {
+	for i, name := range rx.CaptureResponseHeaders {
+		if i == maxCapturedHeaders {
+			break
+		}
+		vs := resp.Header.Values(name)
+		if len(vs) == 0 {
+			continue
+		}
+		v := strings.Join(vs, ", ")
+		if len(v) > maxCapturedHeaderBytes {
+			v = v[:maxCapturedHeaderBytes]
+		}
+		if rx.stats.ResponseHeaders == nil {
+			rx.stats.ResponseHeaders = make(map[string]string)
+		}
+		rx.stats.ResponseHeaders[http.CanonicalHeaderKey(name)] = v
+	}
+}
+
+// retransmissionRatio returns the ratio of retransmitted bytes to the bytes
+// committed by the transmission. Bytes found committed by a status probe were
+// not transmitted, so the retransmitted bytes are never counted as negative.
+func retransmissionRatio(transmitted, committed int64) float64 {
+	if committed <= 0 {
+		return 0
+	}
+	return float64(max(transmitted-committed, 0)) / float64(committed)
+}
+
+// warnRetransmission logs a warning if the retransmission ratio of the upload
+// exceeds WarnRetransmissionRatio.
+func (rx *ResumableUpload) warnRetransmission(ctx context.Context) {
+	l := rx.logger()
+	if l == nil || rx.WarnRetransmissionRatio <= 0 || rx.stats.RetransmissionRatio <= rx.WarnRetransmissionRatio {
+		return
+	}
+	l.WarnContext(ctx, "resumable upload retransmitted many bytes; consider a smaller chunk size or longer timeouts",
+		"retransmissionRatio", rx.stats.RetransmissionRatio,
+		"bytesTransmitted", rx.stats.BytesTransmitted,
+		"bytesCommitted", rx.stats.BytesCommitted,
+		"retries", rx.stats.Retries)
+}
@@ -0,0 +1,349 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadSummary(t *testing.T) {
+	tr := &interruptibleTransport{
+		events: []event{
+			{byteRange: "bytes 0-89/*", responseStatus: http.StatusServiceUnavailable, delay: 10 * time.Millisecond},
+			{byteRange: "bytes 0-89/*", responseStatus: 308, delay: 10 * time.Millisecond},
+			{byteRange: "bytes 90-179/*", responseStatus: 308},
+			{byteRange: "bytes 180-199/200", responseStatus: http.StatusOK, delay: 10 * time.Millisecond},
+		},
+		bodies: bodyTracker{},
+	}
+	rx := &ResumableUpload{
+		Client:    &http.Client{Transport: tr},
+		Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 200)), 90),
+		MediaType: "text/plain",
+	}
+
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	if got := rx.Summary(); got.Requests != 0 {
+		t.Errorf("Summary before Upload: got %+v, want zero value", got)
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+
+	s := rx.Summary()
+	if !s.Success || s.Err != nil {
+		t.Errorf("got Success=%v Err=%v, want success", s.Success, s.Err)
+	}
+	if s.BytesCommitted != 200 || s.BytesTransmitted != 290 {
+		t.Errorf("got BytesCommitted=%d BytesTransmitted=%d, want 200 and 290", s.BytesCommitted, s.BytesTransmitted)
+	}
+	if s.RetransmissionRatio != 0.45 {
+		t.Errorf("got RetransmissionRatio %v, want 0.45", s.RetransmissionRatio)
+	}
+	if s.Chunks != 3 || s.Requests != 4 {
+		t.Errorf("got Chunks=%d Requests=%d, want 3 and 4", s.Chunks, s.Requests)
+	}
+	if s.Backoff.Strategy != "exponential" || s.Backoff.Initial != defaultBackoffConfig.Initial {
+		t.Errorf("got Backoff %+v, want the default exponential backoff", s.Backoff)
+	}
+	tb := s.Timing
+	if tb.Transfer < 20*time.Millisecond || tb.Finalization < 10*time.Millisecond {
+		t.Errorf("timing too short: %+v", tb)
+	}
+	if tb.Total < tb.Transfer+tb.Finalization+tb.Backoff {
+		t.Errorf("Total %v is less than the sum of its phases: %+v", tb.Total, tb)
+	}
+}
+
+func TestUploadSummaryServerThink(t *testing.T) {
+	const think = 20 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(think)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	rx := &ResumableUpload{
+		Client:    srv.Client(),
+		URI:       srv.URL,
+		Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 100)), 256),
+		MediaType: "text/plain",
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+
+	tb := rx.Summary().Timing
+	if tb.ServerThink < think {
+		t.Errorf("got ServerThink %v, want at least %v", tb.ServerThink, think)
+	}
+	if tb.Wire+tb.ServerThink > tb.Finalization {
+		t.Errorf("Wire %v + ServerThink %v exceeds Finalization %v", tb.Wire, tb.ServerThink, tb.Finalization)
+	}
+}
+
+func TestUploadSummaryReusedConns(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		keepAlive bool
+		want      int
+	}{
+		{name: "keep-alive", keepAlive: true, want: 2},
+		{name: "no keep-alive", keepAlive: false, want: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				if !strings.HasSuffix(r.Header.Get("Content-Range"), "/25") {
+					w.Header().Set("X-Http-Status-Code-Override", "308")
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer srv.Close()
+
+			client := srv.Client()
+			client.Transport.(*http.Transport).DisableKeepAlives = !tc.keepAlive
+			rec := &eventRecorder{}
+			rx := &ResumableUpload{
+				Client:    client,
+				URI:       srv.URL,
+				Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+				MediaType: "text/plain",
+				Metrics:   rec,
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+
+			s := rx.Summary()
+			if s.Requests != 3 || s.ReusedConns != tc.want {
+				t.Errorf("got Requests=%d ReusedConns=%d, want 3 and %d", s.Requests, s.ReusedConns, tc.want)
+			}
+			if last := rec.events[len(rec.events)-1]; last.ReusedConns != tc.want {
+				t.Errorf("%v event: got ReusedConns=%d, want %d", last.Kind, last.ReusedConns, tc.want)
+			}
+		})
+	}
+}
+
+func TestUploadSummaryDeadlineBudget(t *testing.T) {
+	t.Run("completed", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, `{"name":"obj"}`)
+		}))
+		defer srv.Close()
+
+		rx := &ResumableUpload{
+			Client:        srv.Client(),
+			URI:           srv.URL,
+			Media:         NewMediaBuffer(strings.NewReader("hello"), 256),
+			MediaType:     "text/plain",
+			TotalDeadline: time.Hour,
+		}
+		res, err := rx.Upload(context.Background())
+		if err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		// The deadline must not cut off the final response body.
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil || string(body) != `{"name":"obj"}` {
+			t.Errorf("reading response body: got %q, %v", body, err)
+		}
+		s := rx.Summary()
+		if s.DeadlineBudgetUsed <= 0 || s.DeadlineBudgetUsed+s.DeadlineBudgetRemaining != time.Hour {
+			t.Errorf("got DeadlineBudgetUsed=%v DeadlineBudgetRemaining=%v, want them to add up to 1h", s.DeadlineBudgetUsed, s.DeadlineBudgetRemaining)
+		}
+	})
+
+	t.Run("exceeded", func(t *testing.T) {
+		rx := &ResumableUpload{
+			Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			})},
+			URI:           "https://example.com/upload",
+			Media:         NewMediaBuffer(strings.NewReader("hello"), 256),
+			MediaType:     "text/plain",
+			TotalDeadline: 50 * time.Millisecond,
+		}
+		_, err := rx.Upload(context.Background())
+		var derr *TotalDeadlineExceededError
+		if !errors.As(err, &derr) {
+			t.Fatalf("Upload err: got %v, want *TotalDeadlineExceededError", err)
+		}
+		if derr.Deadline != rx.TotalDeadline {
+			t.Errorf("got Deadline %v, want %v", derr.Deadline, rx.TotalDeadline)
+		}
+		if s := rx.Summary(); s.DeadlineBudgetUsed != rx.TotalDeadline || s.DeadlineBudgetRemaining != 0 {
+			t.Errorf("got DeadlineBudgetUsed=%v DeadlineBudgetRemaining=%v, want 50ms and 0", s.DeadlineBudgetUsed, s.DeadlineBudgetRemaining)
+		}
+	})
+}
+
+func TestUploadSummaryResponseHeaders(t *testing.T) {
+	long := strings.Repeat("x", 2*maxCapturedHeaderBytes)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("X-Goog-Generation", "1234")
+		w.Header().Add("X-Goog-Hash", "crc32c=abc")
+		w.Header().Add("X-Goog-Hash", "md5=def")
+		w.Header().Set("X-Long", long)
+		w.Header().Set("X-Not-Captured", "v")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	rx := &ResumableUpload{
+		Client:                 srv.Client(),
+		URI:                    srv.URL,
+		Media:                  NewMediaBuffer(strings.NewReader("hello"), 256),
+		MediaType:              "text/plain",
+		CaptureResponseHeaders: []string{"x-goog-generation", "X-Goog-Hash", "X-Long", "X-Missing"},
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+
+	got := rx.Summary().ResponseHeaders
+	want := map[string]string{
+		"X-Goog-Generation": "1234",
+		"X-Goog-Hash":       "crc32c=abc, md5=def",
+		"X-Long":            long[:maxCapturedHeaderBytes],
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d headers %v, want %d", len(got), got, len(want))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("header %s: got %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestWarnRetransmissionRatio(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	for _, tc := range []struct {
+		name     string
+		limit    float64
+		wantWarn bool
+	}{
+		{name: "above", limit: 0.5, wantWarn: true},
+		{name: "below", limit: 1},
+		{name: "unset"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The chunk of 10 bytes is sent twice, a ratio of 1 to the 10
+			// bytes committed.
+			var requests int
+			var logs bytes.Buffer
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					io.Copy(io.Discard, req.Body)
+					if requests++; requests == 1 {
+						return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: http.NoBody}, nil
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:                     "https://example.com/upload",
+				Media:                   NewMediaBuffer(strings.NewReader("0123456789"), 256),
+				MediaType:               "text/plain",
+				Logger:                  slog.New(slog.NewTextHandler(&logs, nil)),
+				WarnRetransmissionRatio: tc.limit,
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if got := rx.Summary().RetransmissionRatio; got != 1 {
+				t.Errorf("got RetransmissionRatio %v, want 1", got)
+			}
+			if got := strings.Contains(logs.String(), "retransmissionRatio=1"); got != tc.wantWarn {
+				t.Errorf("warning logged: got %v, want %v; logs:\n%s", got, tc.wantWarn, logs.String())
+			}
+		})
+	}
+}
+
+func TestUploadSummaryDistinctServers(t *testing.T) {
+	t.Run("Via", func(t *testing.T) {
+		vias := []string{"1.1 gfe-a", "1.1 gfe-b", "1.1 gfe-a"}
+		var requests int
+		rx := &ResumableUpload{
+			Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				io.Copy(io.Discard, req.Body)
+				resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}
+				if strings.HasSuffix(req.Header.Get("Content-Range"), "/*") {
+					resp = incompleteResponse()
+				}
+				resp.Header.Set("Via", vias[requests])
+				requests++
+				return resp, nil
+			})},
+			URI:       "https://example.com/upload",
+			Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+			MediaType: "text/plain",
+		}
+		res, err := rx.Upload(context.Background())
+		if err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		res.Body.Close()
+		if got := rx.Summary().DistinctServers; got != 2 {
+			t.Errorf("got DistinctServers %d, want 2", got)
+		}
+	})
+
+	t.Run("address", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			if strings.HasSuffix(r.Header.Get("Content-Range"), "/*") {
+				w.Header().Set("X-Http-Status-Code-Override", "308")
+			}
+		}))
+		defer srv.Close()
+		rx := &ResumableUpload{
+			Client:    srv.Client(),
+			URI:       srv.URL,
+			Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+			MediaType: "text/plain",
+		}
+		res, err := rx.Upload(context.Background())
+		if err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		res.Body.Close()
+		if got := rx.Summary().DistinctServers; got != 1 {
+			t.Errorf("got DistinctServers %d, want 1", got)
+		}
+	})
+}
@@ -5,15 +5,29 @@
 package gensupport
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/googleapi"
 )
 
 type unexpectedReader struct{}
@@ -30,6 +44,11 @@ type event struct {
 	responseStatus int
 	// delay to simulate network latency for this specific event.
 	delay time.Duration
+	// responseBody, if set, is the body of the response. Otherwise reading the
+	// body fails.
+	responseBody string
+	// responseHeader holds additional headers to set on the response.
+	responseHeader http.Header
 }
 
 // interruptibleTransport is configured with a canned set of requests/responses.
@@ -79,7 +98,7 @@ func (t *interruptibleTransport) RoundTrip(req *http.Request) (*http.Response, e
 		return nil, fmt.Errorf("byte range: got %s; want %s", got, want)
 	}
 
-	if ev.responseStatus != http.StatusServiceUnavailable {
+	if ev.responseStatus != http.StatusServiceUnavailable && req.Body != nil {
 		buf, err := io.ReadAll(req.Body)
 		if err != nil {
 			return nil, fmt.Errorf("error reading from request data: %v", err)
@@ -87,9 +106,16 @@ func (t *interruptibleTransport) RoundTrip(req *http.Request) (*http.Response, e
 		t.buf = append(t.buf, buf...)
 	}
 
-	tc := &trackingCloser{unexpectedReader{}, t.bodies}
+	var body io.Reader = unexpectedReader{}
+	if ev.responseBody != "" {
+		body = strings.NewReader(ev.responseBody)
+	}
+	tc := &trackingCloser{body, t.bodies}
 	tc.Open()
 	h := http.Header{}
+	for k, v := range ev.responseHeader {
+		h[k] = v
+	}
 	status := ev.responseStatus
 
 	// Support "X-GUploader-No-308" like Google:
@@ -533,6 +559,16 @@ func TestMediaError(t *testing.T) {
 	if !errors.Is(err, failErr) {
 		t.Fatalf("Upload err: got %v; want %v", err, failErr)
 	}
+	var serr *SourceReadError
+	if !errors.As(err, &serr) {
+		t.Fatalf("Upload err: got %T, want *SourceReadError", err)
+	}
+	if serr.Offset != failAfter {
+		t.Errorf("SourceReadError.Offset: got %d, want %d", serr.Offset, failAfter)
+	}
+	if errors.Unwrap(serr) != failErr {
+		t.Errorf("errors.Unwrap: got %v, want %v", errors.Unwrap(serr), failErr)
+	}
 
 	// Verify that only the first chunk was transferred.
 	if got, want := len(tr.buf), 100; got != want {
@@ -627,3 +663,3007 @@ func TestOverallUploadTimeout(t *testing.T) {
 		t.Fatalf("Upload err: got: %v; want: context.Canceled", err)
 	}
 }
+
+func TestDoneAndErr(t *testing.T) {
+	const (
+		chunkSize = 90
+		mediaSize = 100
+	)
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	t.Run("success", func(t *testing.T) {
+		tr := &interruptibleTransport{
+			events: []event{
+				{byteRange: "bytes 0-89/*", responseStatus: 308},
+				{byteRange: "bytes 90-99/100", responseStatus: http.StatusOK},
+			},
+			bodies: bodyTracker{},
+		}
+		rx := &ResumableUpload{
+			Client:    &http.Client{Transport: tr},
+			Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", mediaSize)), chunkSize),
+			MediaType: "text/plain",
+		}
+		// Obtain the channel before Upload starts.
+		done := rx.Done()
+		select {
+		case <-done:
+			t.Fatal("Done closed before Upload started")
+		default:
+		}
+		res, err := rx.Upload(context.Background())
+		if err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		res.Body.Close()
+		select {
+		case <-done:
+		default:
+			t.Fatal("Done not closed after Upload returned")
+		}
+		if err := rx.Err(); err != nil {
+			t.Errorf("Err: got %v, want nil", err)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		rx := &ResumableUpload{
+			Client:    &http.Client{Transport: &interruptibleTransport{bodies: bodyTracker{}}},
+			Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", mediaSize)), chunkSize),
+			MediaType: "text/plain",
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		errc := make(chan error, 1)
+		go func() {
+			<-rx.Done()
+			errc <- rx.Err()
+		}()
+		if _, err := rx.Upload(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Upload err: got %v, want context.Canceled", err)
+		}
+		// Done must also be usable after Upload has returned.
+		<-rx.Done()
+		if err := <-errc; !errors.Is(err, context.Canceled) {
+			t.Errorf("Err: got %v, want context.Canceled", err)
+		}
+	})
+}
+
+func TestParseErrorBody(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	for _, parse := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ParseErrorBody=%v", parse), func(t *testing.T) {
+			tr := &interruptibleTransport{
+				events: []event{
+					{
+						byteRange:      "bytes 0-9/10",
+						responseStatus: http.StatusForbidden,
+						responseBody:   `{"error":{"code":403,"message":"access denied"}}`,
+					},
+				},
+				bodies: bodyTracker{},
+			}
+			rx := &ResumableUpload{
+				Client:         &http.Client{Transport: tr},
+				Media:          NewMediaBuffer(strings.NewReader(strings.Repeat("a", 10)), 100),
+				MediaType:      "text/plain",
+				ParseErrorBody: parse,
+			}
+			res, err := rx.Upload(context.Background())
+			if !parse {
+				if err != nil {
+					t.Fatalf("Upload err: got %v, want nil", err)
+				}
+				if res.StatusCode != http.StatusForbidden {
+					t.Errorf("status: got %d, want %d", res.StatusCode, http.StatusForbidden)
+				}
+				res.Body.Close()
+				return
+			}
+			if res != nil {
+				t.Fatalf("Upload result: got %v, want nil", res)
+			}
+			var gerr *googleapi.Error
+			if !errors.As(err, &gerr) {
+				t.Fatalf("Upload err: got %T, want *googleapi.Error", err)
+			}
+			if gerr.Code != http.StatusForbidden || gerr.Message != "access denied" {
+				t.Errorf("got code %d message %q, want %d %q", gerr.Code, gerr.Message, http.StatusForbidden, "access denied")
+			}
+			if len(tr.bodies) > 0 {
+				t.Errorf("unclosed request bodies: %v", tr.bodies)
+			}
+		})
+	}
+}
+
+func TestMaxResponseBodyBytes(t *testing.T) {
+	body := `{"name":"obj","bucket":"b","padding":"` + strings.Repeat("x", 100) + `"}`
+	for _, tc := range []struct {
+		name   string
+		status int
+	}{
+		{name: "error body", status: http.StatusForbidden},
+		{name: "manifest body", status: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+					return &http.Response{StatusCode: tc.status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}, nil
+				})},
+				Media:                NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:            "text/plain",
+				ParseErrorBody:       true,
+				ProduceManifest:      true,
+				MaxResponseBodyBytes: 64,
+			}
+
+			_, err := rx.Upload(context.Background())
+			var terr *ResponseTooLargeError
+			if !errors.As(err, &terr) {
+				t.Fatalf("Upload err: got %v, want *ResponseTooLargeError", err)
+			}
+			if terr.StatusCode != tc.status || terr.Limit != 64 {
+				t.Errorf("got StatusCode=%d Limit=%d, want %d and 64", terr.StatusCode, terr.Limit, tc.status)
+			}
+
+			// The same body is accepted under the default limit.
+			rx.MaxResponseBodyBytes = 0
+			rx.Media = NewMediaBuffer(strings.NewReader("hello"), 256)
+			res, err := rx.Upload(context.Background())
+			var terr2 *ResponseTooLargeError
+			if errors.As(err, &terr2) {
+				t.Fatalf("Upload with default limit: %v", err)
+			}
+			if res != nil {
+				res.Body.Close()
+			}
+		})
+	}
+}
+
+func TestNoMediaSource(t *testing.T) {
+	rx := &ResumableUpload{
+		Client:    &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) { panic("unexpected request") })},
+		MediaType: "text/plain",
+	}
+	_, err := rx.Upload(context.Background())
+	if !errors.Is(err, ErrNoMediaSource) {
+		t.Fatalf("Upload err: got %v, want ErrNoMediaSource", err)
+	}
+	if got := rx.Err(); !errors.Is(got, ErrNoMediaSource) {
+		t.Errorf("Err: got %v, want ErrNoMediaSource", got)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		limit   int
+		wantErr bool
+	}{
+		{name: "disabled", limit: 0},
+		{name: "within limit", limit: 4096},
+		{name: "exceeded", limit: 64, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sent int
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					sent++
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				Media:          NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:      "text/plain",
+				MaxHeaderBytes: tc.limit,
+			}
+			res, err := rx.Upload(context.Background())
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("Upload: %v", err)
+				}
+				res.Body.Close()
+				return
+			}
+			var herr *HeaderTooLargeError
+			if !errors.As(err, &herr) {
+				t.Fatalf("Upload err: got %v, want *HeaderTooLargeError", err)
+			}
+			if herr.Limit != tc.limit || herr.Size <= tc.limit {
+				t.Errorf("got Size=%d Limit=%d, want Size over %d", herr.Size, herr.Limit, tc.limit)
+			}
+			if sent != 0 {
+				t.Errorf("sent %d requests, want none", sent)
+			}
+		})
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	want := RequestPriority{Urgency: 6, Incremental: true}
+	var got []RequestPriority
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			p, ok := RequestPriorityFromContext(req.Context())
+			if !ok {
+				t.Error("request context carries no priority")
+			}
+			got = append(got, p)
+			status := http.StatusOK
+			if len(got) == 1 {
+				status = http.StatusServiceUnavailable
+			}
+			return &http.Response{StatusCode: status, Header: http.Header{}, Body: http.NoBody}, nil
+		})},
+		Media:           NewMediaBuffer(strings.NewReader("hello"), 256),
+		MediaType:       "text/plain",
+		RequestPriority: &want,
+	}
+
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if len(got) != 2 {
+		t.Fatalf("got %d requests, want 2", len(got))
+	}
+	for i, p := range got {
+		if p != want {
+			t.Errorf("request %d: got priority %+v, want %+v", i, p, want)
+		}
+	}
+}
+
+func TestApproveURI(t *testing.T) {
+	const uri = "https://example.com/upload?upload_id=abc"
+	denied := errors.New("destination not approved")
+	for _, tc := range []struct {
+		name        string
+		approve     error
+		wantMethods []string
+	}{
+		{name: "approved", approve: nil, wantMethods: []string{"POST"}},
+		{name: "denied", approve: denied, wantMethods: []string{"DELETE"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var methods []string
+			var approved []string
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					methods = append(methods, req.Method)
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:       uri,
+				Media:     NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType: "text/plain",
+				ApproveURI: func(u string) error {
+					approved = append(approved, u)
+					return tc.approve
+				},
+			}
+			res, err := rx.Upload(context.Background())
+			if err != tc.approve {
+				t.Fatalf("Upload err: got %v, want %v", err, tc.approve)
+			}
+			if res != nil {
+				res.Body.Close()
+			}
+			if !reflect.DeepEqual(approved, []string{uri}) {
+				t.Errorf("ApproveURI calls: got %q, want %q", approved, []string{uri})
+			}
+			if !reflect.DeepEqual(methods, tc.wantMethods) {
+				t.Errorf("requests: got %v, want %v", methods, tc.wantMethods)
+			}
+		})
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if got := r.Header.Get("Expect"); got != "100-continue" {
+			t.Errorf("request %d: got Expect %q, want 100-continue", requests, got)
+		}
+		if requests == 1 {
+			// Reject without reading the body.
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var bodyBytes []int64
+	tr := &http.Transport{ExpectContinueTimeout: 10 * time.Second}
+	defer tr.CloseIdleConnections()
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			cr := &countingReader{r: req.Body}
+			req.Body = io.NopCloser(cr)
+			resp, err := tr.RoundTrip(req)
+			bodyBytes = append(bodyBytes, cr.n)
+			return resp, err
+		})},
+		URI:            srv.URL,
+		Media:          NewMediaBuffer(strings.NewReader(strings.Repeat("a", 1000)), 1024),
+		MediaType:      "text/plain",
+		ExpectContinue: true,
+	}
+
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if want := []int64{0, 1000}; !reflect.DeepEqual(bodyBytes, want) {
+		t.Errorf("body bytes sent per request: got %v, want %v", bodyBytes, want)
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestChunkRetryDeadlineValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		deadline time.Duration
+		retry    *RetryConfig
+		wantErr  bool
+	}{
+		{name: "default", deadline: 0},
+		{name: "sub-millisecond", deadline: 500 * time.Microsecond, wantErr: true},
+		{name: "negative", deadline: -time.Second, wantErr: true},
+		{name: "below initial backoff", deadline: time.Second, retry: &RetryConfig{Backoff: &gax.Backoff{Initial: 2 * time.Second}}, wantErr: true},
+		{name: "sufficient", deadline: time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sent int
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+					sent++
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				Media:              NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:          "text/plain",
+				ChunkRetryDeadline: tc.deadline,
+				Retry:              tc.retry,
+			}
+			res, err := rx.Upload(context.Background())
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("Upload: %v", err)
+				}
+				res.Body.Close()
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "ChunkRetryDeadline") {
+				t.Fatalf("Upload err: got %v, want a ChunkRetryDeadline configuration error", err)
+			}
+			if sent != 0 {
+				t.Errorf("sent %d requests, want none", sent)
+			}
+		})
+	}
+}
+
+func TestMaxChunks(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		maxChunks int
+		wantErr   bool
+	}{
+		{name: "unlimited", maxChunks: 0},
+		{name: "at limit", maxChunks: 3},
+		{name: "exceeded", maxChunks: 2, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &interruptibleTransport{
+				events: []event{
+					{byteRange: "bytes 0-89/*", responseStatus: 308},
+					{byteRange: "bytes 90-179/*", responseStatus: 308},
+					{byteRange: "bytes 180-199/200", responseStatus: http.StatusOK},
+				},
+				bodies: bodyTracker{},
+			}
+			media := &countingReader{r: strings.NewReader(strings.Repeat("a", 200))}
+			rx := &ResumableUpload{
+				Client:    &http.Client{Transport: tr},
+				Media:     NewMediaBuffer(media, 90),
+				MediaType: "text/plain",
+				MaxChunks: tc.maxChunks,
+			}
+			res, err := rx.Upload(context.Background())
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("Upload: %v", err)
+				}
+				res.Body.Close()
+				return
+			}
+			var cerr *TooManyChunksError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("Upload err: got %v, want *TooManyChunksError", err)
+			}
+			if cerr.Chunks != 2 || cerr.Committed != 180 {
+				t.Errorf("got Chunks=%d Committed=%d, want 2 and 180", cerr.Chunks, cerr.Committed)
+			}
+			// Only a byte of the third chunk is read to tell it is there.
+			if media.n != 181 {
+				t.Errorf("read %d bytes of media, want 181", media.n)
+			}
+		})
+	}
+}
+
+func TestShrinkChunkAfterTimeouts(t *testing.T) {
+	oldAlignment := flushAlignment
+	flushAlignment = 10
+	defer func() { flushAlignment = oldAlignment }()
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	var ranges []string
+	var got []byte
+	tr := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		ranges = append(ranges, req.Header.Get("Content-Range"))
+		if req.ContentLength > 20 {
+			// The link is too slow for large chunks.
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		got = append(got, b...)
+		h := http.Header{}
+		if !strings.HasSuffix(req.Header.Get("Content-Range"), "/60") {
+			h.Set("X-Http-Status-Code-Override", "308")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+	})
+	media := strings.Repeat("abcdefghij", 6)
+	rec := &eventRecorder{}
+	rx := &ResumableUpload{
+		Client:                   &http.Client{Transport: tr},
+		Media:                    NewMediaBuffer(strings.NewReader(media), 80),
+		MediaType:                "text/plain",
+		ChunkTransferTimeout:     20 * time.Millisecond,
+		ShrinkChunkAfterTimeouts: 2,
+		MinChunkSize:             10,
+		ChunkRetryDeadline:       5 * time.Second,
+		Metrics:                  rec,
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+
+	want := []string{
+		"bytes 0-59/60", "bytes 0-59/60", // two timeouts
+		"bytes 0-29/*", "bytes 0-29/*", // halved to 30, two more timeouts
+		"bytes 0-9/*", // halved to 15, aligned down to 10
+		"bytes 10-19/*",
+		"bytes 20-29/*",
+		"bytes 30-39/*",
+		"bytes 40-49/*",
+		"bytes 50-59/60",
+	}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Errorf("got ranges %q, want %q", ranges, want)
+	}
+	if string(got) != media {
+		t.Errorf("server received %q, want %q", got, media)
+	}
+	if n := rx.Summary().ChunkSizeReductions; n != 2 {
+		t.Errorf("got %d chunk size reductions, want 2", n)
+	}
+	var sizes []int
+	for _, ev := range rec.events {
+		if ev.Kind == ChunkSizeReduced {
+			sizes = append(sizes, ev.ChunkSize)
+		}
+	}
+	if !reflect.DeepEqual(sizes, []int{30, 10}) {
+		t.Errorf("got ChunkSizeReduced events with sizes %v, want [30 10]", sizes)
+	}
+}
+
+// resumingReader returns io.EOF after its first read, then more data, as a
+// file appended to after it was read to the end does.
+type resumingReader struct {
+	reads int
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	r.reads++
+	switch r.reads {
+	case 1:
+		return copy(p, "final"), io.EOF
+	case 2:
+		return copy(p, "extra"), nil
+	}
+	return 0, io.EOF
+}
+
+func TestDataAfterFinal(t *testing.T) {
+	tr := &interruptibleTransport{
+		events: []event{
+			// The server does not treat the final chunk as final.
+			{byteRange: "bytes 0-4/5", responseStatus: 308},
+		},
+		bodies: bodyTracker{},
+	}
+	rx := &ResumableUpload{
+		Client:    &http.Client{Transport: tr},
+		Media:     NewMediaBuffer(&resumingReader{}, 100),
+		MediaType: "text/plain",
+	}
+	_, err := rx.Upload(context.Background())
+	var derr *DataAfterFinalError
+	if !errors.As(err, &derr) {
+		t.Fatalf("Upload err: got %v, want *DataAfterFinalError", err)
+	}
+	if derr.Offset != 5 || derr.Size != 5 {
+		t.Errorf("got Offset=%d Size=%d, want 5 and 5", derr.Offset, derr.Size)
+	}
+	if len(tr.bodies) > 0 {
+		t.Errorf("unclosed request bodies: %v", tr.bodies)
+	}
+}
+
+func TestFractionCallback(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		totalSize int64
+		want      []float64
+	}{
+		{name: "known size", totalSize: 200, want: []float64{0.45, 0.9, 1}},
+		{name: "unknown size", totalSize: 0, want: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &interruptibleTransport{
+				events: []event{
+					{byteRange: "bytes 0-89/*", responseStatus: 308},
+					{byteRange: "bytes 90-179/*", responseStatus: 308},
+					{byteRange: "bytes 180-199/200", responseStatus: http.StatusOK},
+				},
+				bodies: bodyTracker{},
+			}
+			var got []float64
+			rx := &ResumableUpload{
+				Client:           &http.Client{Transport: tr},
+				Media:            NewMediaBuffer(strings.NewReader(strings.Repeat("a", 200)), 90),
+				MediaType:        "text/plain",
+				TotalSize:        tc.totalSize,
+				FractionCallback: func(f float64) { got = append(got, f) },
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got fractions %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+type domainError struct{ err error }
+
+func (e *domainError) Error() string { return "upload failed: " + e.err.Error() }
+func (e *domainError) Unwrap() error { return e.err }
+
+func TestErrorMapper(t *testing.T) {
+	rx := &ResumableUpload{
+		Client:      &http.Client{Transport: &interruptibleTransport{bodies: bodyTracker{}}},
+		Media:       NewMediaBuffer(strings.NewReader("data"), 10),
+		MediaType:   "text/plain",
+		ErrorMapper: func(err error) error { return &domainError{err} },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := rx.Upload(ctx)
+	var derr *domainError
+	if !errors.As(err, &derr) {
+		t.Fatalf("Upload err: got %v, want *domainError", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("mapped error %v does not match context.Canceled", err)
+	}
+	if rx.Err() != err {
+		t.Errorf("Err: got %v, want the mapped error", rx.Err())
+	}
+
+	// A mapper returning nil keeps the original error.
+	rx = &ResumableUpload{
+		Client:      &http.Client{Transport: &interruptibleTransport{bodies: bodyTracker{}}},
+		Media:       NewMediaBuffer(strings.NewReader("data"), 10),
+		MediaType:   "text/plain",
+		ErrorMapper: func(error) error { return nil },
+	}
+	if _, err := rx.Upload(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Upload err with nil mapping: got %v, want context.Canceled", err)
+	}
+}
+
+func TestOnRequest(t *testing.T) {
+	tr := &interruptibleTransport{
+		events: []event{
+			{byteRange: "bytes 0-89/*", responseStatus: 308},
+			{byteRange: "bytes 90-179/*", responseStatus: http.StatusServiceUnavailable},
+			{byteRange: "bytes */*", responseStatus: 308, responseHeader: http.Header{"Range": {"bytes=0-89"}}},
+			{byteRange: "bytes 90-179/*", responseStatus: 308},
+			{byteRange: "bytes 180-199/200", responseStatus: http.StatusOK},
+		},
+		bodies: bodyTracker{},
+	}
+	var got []string
+	rx := &ResumableUpload{
+		Client:           &http.Client{Transport: tr},
+		URI:              "https://example.com/upload",
+		Media:            NewMediaBuffer(strings.NewReader(strings.Repeat("a", 200)), 90),
+		MediaType:        "text/plain",
+		ProbeBeforeRetry: true,
+		OnRequest: func(method, url string, attempt int, off, size int64) {
+			got = append(got, fmt.Sprintf("%s %s #%d %d+%d", method, url, attempt, off, size))
+		},
+	}
+
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	want := []string{
+		"POST https://example.com/upload #1 0+90",
+		"POST https://example.com/upload #1 90+90",
+		"POST https://example.com/upload #2 90+0", // status probe
+		"POST https://example.com/upload #2 90+90",
+		"POST https://example.com/upload #1 180+20",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got requests\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestMaxEgressBytes(t *testing.T) {
+	const (
+		chunkSize = 90
+		mediaSize = 300
+	)
+	tr := &interruptibleTransport{
+		events: []event{
+			{byteRange: "bytes 0-89/*", responseStatus: http.StatusServiceUnavailable},
+			// The retry would bring the total to 180 bytes, over the budget.
+		},
+		bodies: bodyTracker{},
+	}
+	rx := &ResumableUpload{
+		Client:         &http.Client{Transport: tr},
+		Media:          NewMediaBuffer(strings.NewReader(strings.Repeat("a", mediaSize)), chunkSize),
+		MediaType:      "text/plain",
+		MaxEgressBytes: 150,
+	}
+
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	_, err := rx.Upload(context.Background())
+	var eerr *EgressBudgetExceededError
+	if !errors.As(err, &eerr) {
+		t.Fatalf("Upload err: got %v, want *EgressBudgetExceededError", err)
+	}
+	if eerr.Transmitted != chunkSize || eerr.Limit != 150 {
+		t.Errorf("got Transmitted=%d Limit=%d, want %d and %d", eerr.Transmitted, eerr.Limit, chunkSize, 150)
+	}
+	if len(tr.bodies) > 0 {
+		t.Errorf("unclosed request bodies: %v", tr.bodies)
+	}
+}
+
+func TestMaxIdleProgress(t *testing.T) {
+	stalled := event{byteRange: "bytes 90-179/*", responseStatus: http.StatusServiceUnavailable, delay: 30 * time.Millisecond}
+	tr := &interruptibleTransport{
+		events: []event{
+			{byteRange: "bytes 0-89/*", responseStatus: 308},
+			stalled,
+			stalled,
+			stalled,
+			stalled,
+		},
+		bodies: bodyTracker{},
+	}
+	rx := &ResumableUpload{
+		Client:          &http.Client{Transport: tr},
+		Media:           NewMediaBuffer(strings.NewReader(strings.Repeat("a", 300)), 90),
+		MediaType:       "text/plain",
+		MaxIdleProgress: 50 * time.Millisecond,
+	}
+
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	_, err := rx.Upload(context.Background())
+	var serr *UploadStalledError
+	if !errors.As(err, &serr) {
+		t.Fatalf("Upload err: got %v, want *UploadStalledError", err)
+	}
+	if serr.Committed != 90 || serr.Idle <= rx.MaxIdleProgress {
+		t.Errorf("got Committed=%d Idle=%v, want 90 and more than %v", serr.Committed, serr.Idle, rx.MaxIdleProgress)
+	}
+	if len(tr.events) == 0 {
+		t.Error("all stalled attempts were made; want the upload to give up early")
+	}
+	if len(tr.bodies) > 0 {
+		t.Errorf("unclosed request bodies: %v", tr.bodies)
+	}
+}
+
+func TestWarnExcessiveChunking(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		totalSize int64
+		logger    bool
+		wantWarn  bool
+	}{
+		{name: "many chunks", totalSize: 1 << 30, logger: true, wantWarn: true},
+		{name: "few chunks", totalSize: 1 << 20, logger: true, wantWarn: false},
+		{name: "unknown size", totalSize: 0, logger: true, wantWarn: false},
+		{name: "no logger", totalSize: 1 << 30, logger: false, wantWarn: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf strings.Builder
+			rx := &ResumableUpload{
+				Client:    &http.Client{Transport: &interruptibleTransport{bodies: bodyTracker{}}},
+				Media:     NewMediaBuffer(strings.NewReader("data"), 1024),
+				MediaType: "text/plain",
+				TotalSize: tc.totalSize,
+			}
+			if tc.logger {
+				rx.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+			}
+			// A canceled context ensures no requests are sent.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			rx.Upload(ctx)
+			if got := strings.Count(buf.String(), "consider a larger chunk size"); got != map[bool]int{true: 1}[tc.wantWarn] {
+				t.Errorf("got %d warnings, want warning: %v; log:\n%s", got, tc.wantWarn, buf.String())
+			}
+		})
+	}
+}
+
+func TestSkipIfExistsMatching(t *testing.T) {
+	hookErr := errors.New("lookup failed")
+	for _, tc := range []struct {
+		name     string
+		skip     bool
+		err      error
+		events   []event
+		wantErr  error
+		wantSent int
+	}{
+		{name: "skip", skip: true},
+		{name: "error", err: hookErr, wantErr: hookErr},
+		{
+			name:     "upload",
+			events:   []event{{byteRange: "bytes 0-9/10", responseStatus: http.StatusOK}},
+			wantSent: 10,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &interruptibleTransport{events: tc.events, bodies: bodyTracker{}}
+			rx := &ResumableUpload{
+				Client:    &http.Client{Transport: tr},
+				Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 10)), 100),
+				MediaType: "text/plain",
+				SkipIfExistsMatching: func(context.Context) (bool, error) {
+					return tc.skip, tc.err
+				},
+			}
+			res, err := rx.Upload(context.Background())
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Upload err: got %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("status: got %d, want %d", res.StatusCode, http.StatusOK)
+			}
+			if got := len(tr.buf); got != tc.wantSent {
+				t.Errorf("bytes sent: got %d, want %d", got, tc.wantSent)
+			}
+		})
+	}
+}
+
+// onlyReader hides any methods of the wrapped reader other than Read.
+type onlyReader struct{ io.Reader }
+
+func TestProbeBeforeRetry(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	committed := func(last int) http.Header {
+		return http.Header{"Range": {fmt.Sprintf("bytes=0-%d", last)}}
+	}
+
+	t.Run("partial resend", func(t *testing.T) {
+		tr := &interruptibleTransport{
+			events: []event{
+				{byteRange: "bytes 0-19/*", responseStatus: http.StatusServiceUnavailable},
+				{byteRange: "bytes */*", responseStatus: 308, responseHeader: committed(9)},
+				{byteRange: "bytes 10-19/*", responseStatus: 308},
+				{byteRange: "bytes 20-29/30", responseStatus: http.StatusOK},
+			},
+			bodies: bodyTracker{},
+		}
+		pr := progressRecorder{}
+		rx := &ResumableUpload{
+			Client:           &http.Client{Transport: tr},
+			Media:            NewMediaBuffer(strings.NewReader(strings.Repeat("a", 30)), 20),
+			MediaType:        "text/plain",
+			Callback:         pr.ProgressUpdate,
+			ProbeBeforeRetry: true,
+		}
+		res, err := rx.Upload(context.Background())
+		if err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		res.Body.Close()
+		if got, want := pr.updates, []int64{20, 30}; !reflect.DeepEqual(got, want) {
+			t.Errorf("progress updates: got %v, want %v", got, want)
+		}
+		if got, want := rx.Summary().BytesTransmitted, int64(40); got != want {
+			t.Errorf("BytesTransmitted: got %d, want %d", got, want)
+		}
+		if len(tr.events) > 0 {
+			t.Errorf("leftover events: %v", tr.events)
+		}
+		if len(tr.bodies) > 0 {
+			t.Errorf("unclosed request bodies: %v", tr.bodies)
+		}
+	})
+
+	t.Run("chunk already committed", func(t *testing.T) {
+		tr := &interruptibleTransport{
+			events: []event{
+				{byteRange: "bytes 0-19/*", responseStatus: http.StatusServiceUnavailable},
+				{byteRange: "bytes */*", responseStatus: 308, responseHeader: committed(19)},
+				{byteRange: "bytes 20-29/30", responseStatus: http.StatusOK},
+			},
+			bodies: bodyTracker{},
+		}
+		rx := &ResumableUpload{
+			Client:           &http.Client{Transport: tr},
+			Media:            NewMediaBuffer(strings.NewReader(strings.Repeat("a", 30)), 20),
+			MediaType:        "text/plain",
+			ProbeBeforeRetry: true,
+		}
+		res, err := rx.Upload(context.Background())
+		if err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		res.Body.Close()
+		if len(tr.events) > 0 {
+			t.Errorf("leftover events: %v", tr.events)
+		}
+		if len(tr.bodies) > 0 {
+			t.Errorf("unclosed request bodies: %v", tr.bodies)
+		}
+	})
+}
+
+func TestProbeDetectsCompletion(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	var methods []string
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Body != nil {
+				io.Copy(io.Discard, req.Body)
+			}
+			methods = append(methods, req.Method)
+			switch cr := req.Header.Get("Content-Range"); {
+			case req.Method == "DELETE":
+				return &http.Response{StatusCode: 499, Header: http.Header{}, Body: http.NoBody}, nil
+			case cr == "bytes */*":
+				// The final chunk was committed, but its response was lost.
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			case strings.HasSuffix(cr, "/*"):
+				return incompleteResponse(), nil
+			}
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: http.NoBody}, nil
+		})},
+		URI:              "https://example.com/upload",
+		Media:            NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+		MediaType:        "text/plain",
+		ProbeBeforeRetry: true,
+		StrictCallbacks:  true,
+		// A callback failing on the final progress must not cancel the
+		// session, which the server has already finalized.
+		Callback: func(n int64) {
+			if n == 25 {
+				panic("callback")
+			}
+		},
+	}
+	res, err := rx.Upload(context.Background())
+	if err == nil {
+		res.Body.Close()
+	}
+	for _, m := range methods {
+		if m == "DELETE" {
+			t.Fatalf("sent %v, want no DELETE of the finalized session", methods)
+		}
+	}
+	if rx.Progress() != 25 || !rx.finalSent {
+		t.Errorf("got progress %d and finalSent %v, want 25 and true", rx.Progress(), rx.finalSent)
+	}
+}
+
+func TestParseCommittedOffset(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	// A backend reporting the committed offset in a header of its own.
+	parse := func(resp *http.Response) (int64, bool, error) {
+		v := resp.Header.Get("X-Committed")
+		if v == "" {
+			return 0, false, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, true, err
+	}
+	tr := &interruptibleTransport{
+		events: []event{
+			{byteRange: "bytes 0-19/*", responseStatus: http.StatusServiceUnavailable},
+			{byteRange: "bytes */*", responseStatus: 308, responseHeader: http.Header{"X-Committed": {"10"}}},
+			{byteRange: "bytes 10-19/*", responseStatus: 308},
+			{byteRange: "bytes 20-29/30", responseStatus: http.StatusOK},
+		},
+		bodies: bodyTracker{},
+	}
+	rx := &ResumableUpload{
+		Client:               &http.Client{Transport: tr},
+		Media:                NewMediaBuffer(strings.NewReader(strings.Repeat("a", 30)), 20),
+		MediaType:            "text/plain",
+		ProbeBeforeRetry:     true,
+		ParseCommittedOffset: parse,
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if len(tr.events) > 0 {
+		t.Errorf("leftover events: %v", tr.events)
+	}
+
+	for _, tc := range []struct {
+		header  string
+		want    int64
+		wantErr string
+	}{
+		{header: "", want: 0},
+		{header: "42", want: 42},
+		{header: "x", wantErr: "invalid syntax"},
+		{header: "-1", wantErr: "negative offset -1"},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tc.header != "" {
+			resp.Header.Set("X-Committed", tc.header)
+		}
+		got, err := rx.committedOffset(context.Background(), resp)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("committedOffset(%q): got error %v, want one containing %q", tc.header, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("committedOffset(%q): got %d, %v; want %d", tc.header, got, err, tc.want)
+		}
+	}
+}
+
+func TestProgressMonotonicOnResume(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	tr := &interruptibleTransport{
+		events: []event{
+			{byteRange: "bytes 0-9/*", responseStatus: 308},
+			{byteRange: "bytes 10-19/*", responseStatus: 308},
+			{byteRange: "bytes 20-24/25", responseStatus: http.StatusServiceUnavailable},
+			// The server lost everything after the first 5 bytes.
+			{byteRange: "bytes */*", responseStatus: 308, responseHeader: http.Header{"Range": {"bytes=0-4"}}},
+			{byteRange: "bytes 5-14/*", responseStatus: 308},
+			{byteRange: "bytes 15-24/*", responseStatus: 308},
+			{byteRange: "bytes */25", responseStatus: http.StatusOK},
+		},
+		bodies: bodyTracker{},
+	}
+	var reported []int64
+	resumedAt := int64(-1)
+	rx := &ResumableUpload{
+		Media:            NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+		MediaType:        "text/plain",
+		ProbeBeforeRetry: true,
+		Callback:         func(n int64) { reported = append(reported, n) },
+	}
+	rx.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Content-Range") == "bytes 5-14/*" {
+			resumedAt = rx.Progress()
+		}
+		return tr.RoundTrip(req)
+	})}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if resumedAt != 5 {
+		t.Errorf("Progress on resume: got %d, want the server offset 5", resumedAt)
+	}
+	// 15 is behind the 20 reported before the server lost data.
+	if want := []int64{10, 20, 25}; !reflect.DeepEqual(reported, want) {
+		t.Errorf("reported progress: got %v, want %v", reported, want)
+	}
+}
+
+func TestOnOffsetRegression(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	events := func() []event {
+		return []event{
+			{byteRange: "bytes 0-9/*", responseStatus: 308},
+			{byteRange: "bytes 10-19/*", responseStatus: http.StatusServiceUnavailable},
+			// The server lost half of the first chunk.
+			{byteRange: "bytes */*", responseStatus: 308, responseHeader: http.Header{"Range": {"bytes=0-4"}}},
+			{byteRange: "bytes 5-14/*", responseStatus: 308},
+			{byteRange: "bytes 15-24/*", responseStatus: 308},
+			{byteRange: "bytes 25-29/30", responseStatus: http.StatusOK},
+		}
+	}
+	data := "0123456789abcdefghijklmnopqrst"
+
+	t.Run("seekable", func(t *testing.T) {
+		tr := &interruptibleTransport{events: events(), bodies: bodyTracker{}}
+		var regressions [][2]int64
+		rx := &ResumableUpload{
+			Client:           &http.Client{Transport: tr},
+			Media:            NewMediaBuffer(strings.NewReader(data), 10),
+			MediaType:        "text/plain",
+			ProbeBeforeRetry: true,
+			OnOffsetRegression: func(local, server int64) {
+				regressions = append(regressions, [2]int64{local, server})
+			},
+		}
+		res, err := rx.Upload(context.Background())
+		if err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		res.Body.Close()
+		if want := [][2]int64{{10, 5}}; !reflect.DeepEqual(regressions, want) {
+			t.Errorf("regressions: got %v, want %v", regressions, want)
+		}
+		if got, want := string(tr.buf), data[:10]+data[5:]; got != want {
+			t.Errorf("transferred contents: got %q, want %q", got, want)
+		}
+		if rx.Progress() != 30 {
+			t.Errorf("Progress: got %d, want 30", rx.Progress())
+		}
+		if len(tr.bodies) > 0 {
+			t.Errorf("unclosed request bodies: %v", tr.bodies)
+		}
+	})
+
+	t.Run("not seekable", func(t *testing.T) {
+		tr := &interruptibleTransport{events: events()[:3], bodies: bodyTracker{}}
+		rx := &ResumableUpload{
+			Client:           &http.Client{Transport: tr},
+			Media:            NewMediaBuffer(onlyReader{strings.NewReader(data)}, 10),
+			MediaType:        "text/plain",
+			ProbeBeforeRetry: true,
+		}
+		if _, err := rx.Upload(context.Background()); err == nil {
+			t.Fatal("Upload succeeded, want error")
+		}
+		if len(tr.bodies) > 0 {
+			t.Errorf("unclosed request bodies: %v", tr.bodies)
+		}
+	})
+}
+
+// roundTripFunc adapts a function to http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// gatedReader returns its first n bytes immediately, then blocks until gate is
+// closed before returning the rest.
+type gatedReader struct {
+	r    io.Reader
+	n    int
+	gate chan struct{}
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	if g.n <= 0 {
+		<-g.gate
+		return g.r.Read(p)
+	}
+	if len(p) > g.n {
+		p = p[:g.n]
+	}
+	n, err := g.r.Read(p)
+	g.n -= n
+	return n, err
+}
+
+// incompleteResponse returns a response signalling an incomplete upload, as
+// Google's upload endpoint does when X-GUploader-No-308 is set.
+func incompleteResponse() *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-Http-Status-Code-Override": {"308"}},
+		Body:       http.NoBody,
+	}
+}
+
+func TestKeepAliveInterval(t *testing.T) {
+	gate := make(chan struct{})
+	var ranges []string
+	var probes int
+	tr := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		cr := req.Header.Get("Content-Range")
+		if cr == "bytes */*" {
+			// Release the media once a keep-alive probe has been seen.
+			if probes++; probes == 1 {
+				close(gate)
+			}
+			return incompleteResponse(), nil
+		}
+		ranges = append(ranges, cr)
+		if req.Body != nil {
+			io.Copy(io.Discard, req.Body)
+		}
+		if strings.HasSuffix(cr, "/*") {
+			return incompleteResponse(), nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+	})
+	rx := &ResumableUpload{
+		Client:            &http.Client{Transport: tr},
+		Media:             NewMediaBuffer(&gatedReader{r: strings.NewReader(strings.Repeat("a", 20)), n: 10, gate: gate}, 10),
+		MediaType:         "text/plain",
+		KeepAliveInterval: 10 * time.Millisecond,
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if want := []string{"bytes 0-9/*", "bytes 10-19/*", "bytes */20"}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("chunk requests: got %v, want %v", ranges, want)
+	}
+	if got := rx.Summary().KeepAliveProbes; got == 0 || got != probes {
+		t.Errorf("KeepAliveProbes: got %d, want %d (and non-zero)", got, probes)
+	}
+}
+
+func TestIdempotencyHeaderName(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		headerName string
+		wantHeader string
+		wantErr    bool
+	}{
+		{name: "default", wantHeader: "X-Goog-Gcs-Idempotency-Token"},
+		{name: "custom", headerName: "Idempotency-Key", wantHeader: "Idempotency-Key"},
+		{name: "invalid", headerName: "Bad Header:", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got http.Header
+			tr := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				got = req.Header.Clone()
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			})
+			rx := &ResumableUpload{
+				Client:                &http.Client{Transport: tr},
+				Media:                 NewMediaBuffer(strings.NewReader("data"), 10),
+				MediaType:             "text/plain",
+				IdempotencyHeaderName: tc.headerName,
+			}
+			res, err := rx.Upload(context.Background())
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Upload succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if token := got.Get(tc.wantHeader); token != rx.invocationID || token == "" {
+				t.Errorf("%s: got %q, want %q", tc.wantHeader, token, rx.invocationID)
+			}
+			if tc.wantHeader != defaultIdempotencyHeaderName && got.Get(defaultIdempotencyHeaderName) != "" {
+				t.Errorf("%s unexpectedly set", defaultIdempotencyHeaderName)
+			}
+		})
+	}
+}
+
+func TestOmitInvocationID(t *testing.T) {
+	for _, omit := range []bool{false, true} {
+		t.Run(fmt.Sprintf("OmitInvocationID=%v", omit), func(t *testing.T) {
+			var got http.Header
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					got = req.Header.Clone()
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				Media:            NewMediaBuffer(strings.NewReader("data"), 10),
+				MediaType:        "text/plain",
+				OmitInvocationID: omit,
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			apiClient := got.Get("X-Goog-Api-Client")
+			if has := strings.Contains(apiClient, "gccl-invocation-id/"+rx.invocationID); has == omit {
+				t.Errorf("X-Goog-Api-Client %q: got invocation ID %v, want %v", apiClient, has, !omit)
+			}
+			if !strings.Contains(apiClient, "gccl-attempt-count/1") {
+				t.Errorf("X-Goog-Api-Client %q: missing attempt count", apiClient)
+			}
+			if got.Get(defaultIdempotencyHeaderName) != rx.invocationID {
+				t.Errorf("idempotency header: got %q, want %q", got.Get(defaultIdempotencyHeaderName), rx.invocationID)
+			}
+		})
+	}
+}
+
+func TestVerifyIdempotencyEcho(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		echo     bool
+		strict   bool
+		wantErr  bool
+		wantWarn bool
+	}{
+		{name: "echoed", echo: true, strict: true},
+		{name: "stripped, warn", echo: false, wantWarn: true},
+		{name: "stripped, strict", echo: false, strict: true, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				h := http.Header{}
+				if tc.echo {
+					h.Set(defaultIdempotencyHeaderName, req.Header.Get(defaultIdempotencyHeaderName))
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+			})
+			var logs strings.Builder
+			rx := &ResumableUpload{
+				Client:                &http.Client{Transport: tr},
+				Media:                 NewMediaBuffer(strings.NewReader("data"), 10),
+				MediaType:             "text/plain",
+				VerifyIdempotencyEcho: true,
+				StrictIdempotencyEcho: tc.strict,
+				Logger:                slog.New(slog.NewTextHandler(&logs, nil)),
+			}
+			res, err := rx.Upload(context.Background())
+			if tc.wantErr {
+				var eerr *IdempotencyEchoError
+				if !errors.As(err, &eerr) {
+					t.Fatalf("Upload err: got %v, want *IdempotencyEchoError", err)
+				}
+				if eerr.Sent != rx.invocationID || eerr.Echoed != "" {
+					t.Errorf("got Sent=%q Echoed=%q, want %q and empty", eerr.Sent, eerr.Echoed, rx.invocationID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if got := strings.Contains(logs.String(), "did not echo the idempotency token"); got != tc.wantWarn {
+				t.Errorf("got warning %v, want %v; log:\n%s", got, tc.wantWarn, logs.String())
+			}
+		})
+	}
+}
+
+func TestOnChunkAck(t *testing.T) {
+	ackErr := errors.New("log unavailable")
+	tr := &interruptibleTransport{
+		events: []event{
+			{byteRange: "bytes 0-9/*", responseStatus: 308},
+			{byteRange: "bytes 10-19/*", responseStatus: 308},
+		},
+		bodies: bodyTracker{},
+	}
+	var acks []int64
+	rx := &ResumableUpload{
+		Client:    &http.Client{Transport: tr},
+		Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 30)), 10),
+		MediaType: "text/plain",
+		OnChunkAck: func(offset int64) error {
+			acks = append(acks, offset)
+			if offset == 20 {
+				return ackErr
+			}
+			return nil
+		},
+	}
+	res, err := rx.Upload(context.Background())
+	if !errors.Is(err, ackErr) || res != nil {
+		t.Fatalf("Upload: got (%v, %v), want (nil, %v)", res, err, ackErr)
+	}
+	if want := []int64{10, 20}; !reflect.DeepEqual(acks, want) {
+		t.Errorf("acks: got %v, want %v", acks, want)
+	}
+	if len(tr.bodies) > 0 {
+		t.Errorf("unclosed request bodies: %v", tr.bodies)
+	}
+}
+
+func TestDrainAndClose(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		contentLength int64
+		body          string
+		wantRead      bool
+	}{
+		{name: "empty", contentLength: 0, wantRead: false},
+		{name: "unknown length", contentLength: -1, body: "leftover", wantRead: true},
+		{name: "known length", contentLength: 8, body: "leftover", wantRead: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &countingReader{r: strings.NewReader(tc.body)}
+			body := &trackingCloser{r, bodyTracker{}}
+			body.Open()
+			drainAndClose(&http.Response{ContentLength: tc.contentLength, Body: body})
+			if got := r.n > 0; got != tc.wantRead {
+				t.Errorf("body read: got %v, want %v", got, tc.wantRead)
+			}
+			if r.n > 0 && r.n != int64(len(tc.body)) {
+				t.Errorf("read %d bytes, want the whole body of %d", r.n, len(tc.body))
+			}
+			if len(body.tracker) > 0 {
+				t.Error("body not closed")
+			}
+		})
+	}
+}
+
+// slowBody is a response body that yields a byte every 10ms, for up to n
+// bytes.
+type slowBody struct {
+	n      int
+	closed atomic.Bool
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if b.n == 0 || b.closed.Load() {
+		return 0, io.EOF
+	}
+	time.Sleep(10 * time.Millisecond)
+	b.n--
+	p[0] = 'x'
+	return 1, nil
+}
+
+func (b *slowBody) Close() error {
+	b.closed.Store(true)
+	return nil
+}
+
+func TestDrainCanceled(t *testing.T) {
+	body := &slowBody{n: 1000}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			io.Copy(io.Discard, req.Body)
+			// Cancel while the body of the response to the first chunk
+			// is drained.
+			time.AfterFunc(50*time.Millisecond, cancel)
+			resp := incompleteResponse()
+			resp.Header.Set("Range", "bytes=0-9")
+			resp.ContentLength = -1
+			resp.Body = body
+			return resp, nil
+		})},
+		URI:       "https://example.com/upload",
+		Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+		MediaType: "text/plain",
+	}
+	start := time.Now()
+	_, err := rx.Upload(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Upload: got %v, want context.Canceled", err)
+	}
+	// Draining the whole body would take 10s.
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Upload returned after %v, want prompt return on cancellation", d)
+	}
+	if !body.closed.Load() {
+		t.Error("body not closed")
+	}
+}
+
+func BenchmarkDrainAndClose(b *testing.B) {
+	for _, cl := range []int64{0, -1} {
+		b.Run(fmt.Sprintf("ContentLength=%d", cl), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				drainAndClose(&http.Response{ContentLength: cl, Body: io.NopCloser(strings.NewReader(""))})
+			}
+		})
+	}
+}
+
+func TestWriteBufferSize(t *testing.T) {
+	media := strings.Repeat("abcdefghij", 100)
+	tr := &interruptibleTransport{
+		events: []event{
+			{byteRange: "bytes 0-399/*", responseStatus: 308},
+			{byteRange: "bytes 400-799/*", responseStatus: 308},
+			{byteRange: "bytes 800-999/1000", responseStatus: http.StatusOK},
+		},
+		bodies: bodyTracker{},
+	}
+	rx := &ResumableUpload{
+		Client:          &http.Client{Transport: tr},
+		Media:           NewMediaBuffer(strings.NewReader(media), 400),
+		MediaType:       "text/plain",
+		WriteBufferSize: 16,
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if string(tr.buf) != media {
+		t.Errorf("server received %d bytes that differ from the media", len(tr.buf))
+	}
+}
+
+func BenchmarkWriteBufferSize(b *testing.B) {
+	const chunkSize = 8 << 20
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	media := bytes.Repeat([]byte{'a'}, chunkSize)
+
+	for _, size := range []int{0, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("WriteBufferSize=%d", size), func(b *testing.B) {
+			b.SetBytes(chunkSize)
+			for i := 0; i < b.N; i++ {
+				rx := &ResumableUpload{
+					Client:          srv.Client(),
+					URI:             srv.URL,
+					Media:           NewMediaBuffer(bytes.NewReader(media), chunkSize+1),
+					MediaType:       "text/plain",
+					WriteBufferSize: size,
+				}
+				res, err := rx.Upload(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				res.Body.Close()
+			}
+		})
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	for _, tc := range []struct {
+		host    string
+		wantErr bool
+	}{
+		{host: "uploads.example.com"},
+		{host: "uploads.example.com:8443"},
+		{host: "10.0.0.1:80"},
+		{host: "[::1]:443"},
+		{host: "[::1]"},
+		{host: "example.com/path", wantErr: true},
+		{host: "user@example.com", wantErr: true},
+		{host: "example.com:port", wantErr: true},
+		{host: "::1", wantErr: true},
+		{host: "exa mple.com", wantErr: true},
+	} {
+		t.Run(tc.host, func(t *testing.T) {
+			var hosts []string
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					hosts = append(hosts, req.Host)
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:        "https://storage.example.com/upload?id=1",
+				Media:      NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:  "text/plain",
+				HostHeader: tc.host,
+			}
+			res, err := rx.Upload(context.Background())
+			if tc.wantErr {
+				if err == nil {
+					res.Body.Close()
+					t.Fatal("Upload succeeded, want an invalid HostHeader error")
+				}
+				if len(hosts) != 0 {
+					t.Errorf("sent %d requests, want none", len(hosts))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if len(hosts) != 1 || hosts[0] != tc.host {
+				t.Errorf("got Host %q, want [%q]", hosts, tc.host)
+			}
+		})
+	}
+}
+
+func TestChunkTimeoutVersusContextDeadline(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	for _, tc := range []struct {
+		name             string
+		transferTimeout  time.Duration
+		retryDeadline    time.Duration
+		ctxTimeout       time.Duration
+		wantChunkTimeout bool
+		maxRequests      int
+	}{
+		{
+			name:             "attempt timeouts exhaust retries",
+			transferTimeout:  20 * time.Millisecond,
+			retryDeadline:    100 * time.Millisecond,
+			wantChunkTimeout: true,
+		},
+		{
+			name:            "parent deadline during first attempt",
+			transferTimeout: time.Hour,
+			ctxTimeout:      50 * time.Millisecond,
+			maxRequests:     1,
+		},
+		{
+			name:            "parent deadline after attempt timeouts",
+			transferTimeout: 30 * time.Millisecond,
+			ctxTimeout:      50 * time.Millisecond,
+			maxRequests:     2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					requests++
+					<-req.Context().Done()
+					return nil, req.Context().Err()
+				})},
+				URI:                  "https://example.com/upload",
+				Media:                NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:            "text/plain",
+				ChunkTransferTimeout: tc.transferTimeout,
+				ChunkRetryDeadline:   tc.retryDeadline,
+			}
+			ctx := context.Background()
+			if tc.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.ctxTimeout)
+				defer cancel()
+			}
+			_, err := rx.Upload(ctx)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Upload err: got %v, want a deadline exceeded error", err)
+			}
+			var terr *ChunkTimeoutError
+			if got := errors.As(err, &terr); got != tc.wantChunkTimeout {
+				t.Fatalf("Upload err %v: got *ChunkTimeoutError %v, want %v", err, got, tc.wantChunkTimeout)
+			}
+			if terr != nil && terr.Timeout != tc.transferTimeout {
+				t.Errorf("got Timeout %v, want %v", terr.Timeout, tc.transferTimeout)
+			}
+			if tc.maxRequests > 0 && requests > tc.maxRequests {
+				t.Errorf("sent %d requests, want at most %d", requests, tc.maxRequests)
+			}
+		})
+	}
+}
+
+func TestChunkTimeoutRetryPredicate(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	for _, tc := range []struct {
+		name         string
+		shouldRetry  func(error) bool
+		wantRequests int
+	}{
+		{name: "rejected", shouldRetry: func(error) bool { return false }, wantRequests: 1},
+		{
+			name: "accepted",
+			shouldRetry: func(err error) bool {
+				var terr *ChunkTimeoutError
+				return errors.As(err, &terr)
+			},
+			wantRequests: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int
+			var got []error
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					if requests++; requests == 1 {
+						<-req.Context().Done()
+						return nil, req.Context().Err()
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:                  "https://example.com/upload",
+				Media:                NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:            "text/plain",
+				ChunkTransferTimeout: 20 * time.Millisecond,
+				Retry: &RetryConfig{ShouldRetry: func(err error) bool {
+					got = append(got, err)
+					return tc.shouldRetry(err)
+				}},
+			}
+			res, err := rx.Upload(context.Background())
+			if requests != tc.wantRequests {
+				t.Errorf("sent %d requests, want %d", requests, tc.wantRequests)
+			}
+			var terr *ChunkTimeoutError
+			if len(got) == 0 || !errors.As(got[0], &terr) {
+				t.Errorf("retry predicate got %v, want a *ChunkTimeoutError first", got)
+			}
+			if tc.wantRequests == 1 {
+				if !errors.As(err, &terr) {
+					t.Errorf("Upload err: got %v, want *ChunkTimeoutError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+		})
+	}
+}
+
+// stallingReader returns the data of r, stalling for delay before reading
+// past offset at.
+type stallingReader struct {
+	r       io.Reader
+	at, off int64
+	delay   time.Duration
+}
+
+func (s *stallingReader) Read(p []byte) (int, error) {
+	if s.off >= s.at && s.delay > 0 {
+		time.Sleep(s.delay)
+		s.delay = 0
+	}
+	n, err := s.r.Read(p)
+	s.off += int64(n)
+	return n, err
+}
+
+func TestChunkThroughputLog(t *testing.T) {
+	var logs bytes.Buffer
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			io.Copy(io.Discard, req.Body)
+			h := http.Header{}
+			if !strings.HasSuffix(req.Header.Get("Content-Range"), "/25") {
+				h.Set("X-Http-Status-Code-Override", "308")
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+		})},
+		URI:       "https://example.com/upload",
+		Media:     NewMediaBuffer(&stallingReader{r: strings.NewReader(strings.Repeat("a", 25)), at: 10, delay: 20 * time.Millisecond}, 10),
+		MediaType: "text/plain",
+		Logger:    slog.New(slog.NewJSONHandler(&logs, nil)),
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+
+	type record struct {
+		Msg        string
+		Offset     int64
+		Size       int64
+		Duration   time.Duration
+		SourceRead time.Duration
+		MiBPerSec  float64 `json:"mibPerSec"`
+	}
+	var chunks []record
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var r record
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Msg == "resumable upload chunk committed" {
+			chunks = append(chunks, r)
+		}
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunk records, want 3:\n%s", len(chunks), logs.String())
+	}
+	for i, r := range chunks {
+		if wantOff, wantSize := int64(i*10), int64(min(10, 25-i*10)); r.Offset != wantOff || r.Size != wantSize {
+			t.Errorf("chunk %d: got offset %d size %d, want %d and %d", i, r.Offset, r.Size, wantOff, wantSize)
+		}
+		if r.Duration <= 0 || r.MiBPerSec <= 0 || r.SourceRead > r.Duration {
+			t.Errorf("chunk %d: inconsistent record %+v", i, r)
+		}
+	}
+	// The source stalled while the second chunk was read.
+	if chunks[1].SourceRead < 20*time.Millisecond || chunks[1].MiBPerSec >= chunks[0].MiBPerSec {
+		t.Errorf("the stall does not show in the second chunk: %+v", chunks)
+	}
+}
+
+func TestCallbackQueueSize(t *testing.T) {
+	finalSent := make(chan struct{})
+	release := make(chan struct{})
+	var got []int64
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			io.Copy(io.Discard, req.Body)
+			h := http.Header{}
+			if strings.HasSuffix(req.Header.Get("Content-Range"), "/45") {
+				close(finalSent)
+			} else {
+				h.Set("X-Http-Status-Code-Override", "308")
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+		})},
+		URI:       "https://example.com/upload",
+		Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 45)), 10),
+		MediaType: "text/plain",
+		Callback: func(n int64) {
+			<-release
+			got = append(got, n)
+		},
+		CallbackQueueSize: 1,
+	}
+	type result struct {
+		res *http.Response
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := rx.Upload(context.Background())
+		done <- result{res, err}
+	}()
+
+	// The upload runs to the final chunk while the callback is blocked.
+	select {
+	case <-finalSent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload stalled behind the blocked callback")
+	}
+	// Upload does not return before the last update is delivered.
+	select {
+	case <-done:
+		t.Fatal("Upload returned with progress updates undelivered")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("Upload: %v", r.err)
+	}
+	r.res.Body.Close()
+
+	if len(got) == 0 || got[len(got)-1] != 45 {
+		t.Fatalf("got updates %v, want the last to be 45", got)
+	}
+	if len(got) >= 5 {
+		t.Errorf("got updates %v, want some coalesced", got)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] <= got[i-1] {
+			t.Errorf("updates %v are not increasing", got)
+		}
+	}
+}
+
+func TestReportPartialProgress(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	for _, tc := range []struct {
+		partial bool
+		want    []int64
+	}{
+		{partial: false, want: []int64{90, 180, 200}},
+		{partial: true, want: []int64{90, 120, 180, 200}},
+	} {
+		t.Run(fmt.Sprint(tc.partial), func(t *testing.T) {
+			tr := &interruptibleTransport{
+				events: []event{
+					{byteRange: "bytes 0-89/*", responseStatus: 308},
+					{byteRange: "bytes 90-179/*", responseStatus: http.StatusServiceUnavailable},
+					{byteRange: "bytes */*", responseStatus: 308, responseHeader: http.Header{"Range": {"bytes=0-119"}}},
+					{byteRange: "bytes 120-179/*", responseStatus: 308},
+					{byteRange: "bytes 180-199/200", responseStatus: http.StatusOK},
+				},
+				bodies: bodyTracker{},
+			}
+			var got []int64
+			var resendProgress int64
+			rx := &ResumableUpload{
+				Client:                &http.Client{Transport: tr},
+				Media:                 NewMediaBuffer(strings.NewReader(strings.Repeat("a", 200)), 90),
+				MediaType:             "text/plain",
+				ProbeBeforeRetry:      true,
+				ReportPartialProgress: tc.partial,
+				Callback:              func(n int64) { got = append(got, n) },
+			}
+			rx.OnRequest = func(_, _ string, _ int, off, size int64) {
+				if off == 120 && size > 0 {
+					resendProgress = rx.Progress()
+				}
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("progress callbacks: got %v, want %v", got, tc.want)
+			}
+			// The accepted bytes are counted whether or not they are reported.
+			if resendProgress != 120 {
+				t.Errorf("Progress when resending the chunk tail: got %d, want 120", resendProgress)
+			}
+		})
+	}
+}
+
+func TestChunkBoundaryFunc(t *testing.T) {
+	oldAlignment := flushAlignment
+	flushAlignment = 10
+	defer func() { flushAlignment = oldAlignment }()
+
+	var ranges []string
+	var offsets []int64
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			ranges = append(ranges, req.Header.Get("Content-Range"))
+			h := http.Header{}
+			if !strings.HasSuffix(req.Header.Get("Content-Range"), "/95") {
+				h.Set("X-Http-Status-Code-Override", "308")
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+		})},
+		URI:       "https://example.com/upload",
+		Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 95)), 50),
+		MediaType: "text/plain",
+		// Records are 30 bytes long.
+		ChunkBoundaryFunc: func(offset, maxChunk int64) int64 {
+			offsets = append(offsets, offset)
+			return maxChunk - maxChunk%30
+		},
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if want := []string{"bytes 0-29/*", "bytes 30-59/*", "bytes 60-89/*", "bytes 90-94/95"}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("got ranges %q, want %q", ranges, want)
+	}
+	if want := []int64{0, 30, 60, 90}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("ChunkBoundaryFunc called at offsets %v, want %v", offsets, want)
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	oldAlignment := flushAlignment
+	flushAlignment = 10
+	defer func() { flushAlignment = oldAlignment }()
+
+	for _, tc := range []struct {
+		name      string
+		max       int64
+		wantSizes []int64
+		wantErr   bool
+	}{
+		{name: "no cap", max: 0, wantSizes: []int64{95}},
+		{name: "above chunk size", max: 200, wantSizes: []int64{95}},
+		{name: "aligned cap", max: 40, wantSizes: []int64{40, 40, 15}},
+		{name: "unaligned cap", max: 35, wantSizes: []int64{30, 30, 30, 5}},
+		{name: "below alignment", max: 5, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sizes []int64
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					sizes = append(sizes, req.ContentLength)
+					h := http.Header{}
+					if !strings.HasSuffix(req.Header.Get("Content-Range"), "/95") {
+						h.Set("X-Http-Status-Code-Override", "308")
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+				})},
+				URI:             "https://example.com/upload",
+				Media:           NewMediaBuffer(strings.NewReader(strings.Repeat("a", 95)), 100),
+				MediaType:       "text/plain",
+				MaxRequestBytes: tc.max,
+			}
+			res, err := rx.Upload(context.Background())
+			if tc.wantErr {
+				if err == nil {
+					res.Body.Close()
+					t.Fatal("Upload succeeded, want an error")
+				}
+				if len(sizes) != 0 {
+					t.Errorf("sent %d requests, want none", len(sizes))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if !reflect.DeepEqual(sizes, tc.wantSizes) {
+				t.Errorf("request sizes: got %v, want %v", sizes, tc.wantSizes)
+			}
+		})
+	}
+}
+
+func TestStep(t *testing.T) {
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			io.Copy(io.Discard, req.Body)
+			h := http.Header{}
+			if !strings.HasSuffix(req.Header.Get("Content-Range"), "/25") {
+				h.Set("X-Http-Status-Code-Override", "308")
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+		})},
+		URI:       "https://example.com/upload",
+		Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+		MediaType: "text/plain",
+	}
+	var progress []int64
+	for {
+		done, res, err := rx.Step(context.Background())
+		if !done {
+			if res != nil || err != nil {
+				t.Fatalf("Step before completion: got %v, %v, want nil response and error", res, err)
+			}
+			select {
+			case <-rx.Done():
+				t.Fatal("Done closed before the upload completed")
+			default:
+			}
+			progress = append(progress, rx.Progress())
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Step: %v", err)
+		}
+		res.Body.Close()
+		break
+	}
+	if want := []int64{10, 20}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("progress between steps: got %v, want %v", progress, want)
+	}
+	select {
+	case <-rx.Done():
+	default:
+		t.Error("Done not closed after the last step")
+	}
+	if s := rx.Summary(); !s.Success || s.Chunks != 3 {
+		t.Errorf("got Summary %+v, want 3 chunks and success", s)
+	}
+}
+
+func TestStepStartOver(t *testing.T) {
+	var requests int
+	failing := true
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			io.Copy(io.Discard, req.Body)
+			requests++
+			if failing && requests == 2 {
+				return &http.Response{StatusCode: http.StatusBadRequest, Header: http.Header{}, Body: http.NoBody}, nil
+			}
+			if strings.HasSuffix(req.Header.Get("Content-Range"), "/*") {
+				return incompleteResponse(), nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+		})},
+		URI:            "https://example.com/upload",
+		Media:          NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+		MediaType:      "text/plain",
+		ParseErrorBody: true,
+	}
+	if _, err := rx.Upload(context.Background()); err == nil {
+		t.Fatal("first Upload: got nil error")
+	}
+	first := rx.Done()
+	if s := rx.Summary(); s.Success || s.Chunks != 1 || s.Requests != 2 {
+		t.Errorf("first Summary: got %+v, want 1 chunk in 2 requests and failure", s)
+	}
+
+	// The upload is started over from the chunk that failed.
+	failing = false
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("second Upload: %v", err)
+	}
+	res.Body.Close()
+	if rx.Err() != nil {
+		t.Errorf("Err: got %v, want nil", rx.Err())
+	}
+	if rx.Done() == first {
+		t.Error("Done: got the channel of the first upload")
+	}
+	select {
+	case <-rx.Done():
+	default:
+		t.Error("Done not closed after the second upload")
+	}
+	if s := rx.Summary(); !s.Success || s.Chunks != 2 || s.Requests != 2 {
+		t.Errorf("second Summary: got %+v, want 2 chunks in 2 requests and success", s)
+	}
+}
+
+func TestAbandon(t *testing.T) {
+	before := goroutines.live.Load()
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			io.Copy(io.Discard, req.Body)
+			return incompleteResponse(), nil
+		})},
+		URI:               "https://example.com/upload",
+		Media:             NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+		MediaType:         "text/plain",
+		Callback:          func(int64) {},
+		CallbackQueueSize: 1,
+		PrefetchNextChunk: true,
+	}
+	if done, _, err := rx.Step(context.Background()); done || err != nil {
+		t.Fatalf("Step: got done=%v, err=%v", done, err)
+	}
+	rx.Abandon(context.Background())
+	if got := goroutines.live.Load() - before; got != 0 {
+		t.Errorf("%d goroutines still running after Abandon", got)
+	}
+	select {
+	case <-rx.Done():
+	default:
+		t.Error("Done not closed after Abandon")
+	}
+	if !errors.Is(rx.Err(), ErrUploadAbandoned) {
+		t.Errorf("Err: got %v, want ErrUploadAbandoned", rx.Err())
+	}
+	if s := rx.Summary(); s.Success || s.Chunks != 1 {
+		t.Errorf("got Summary %+v, want 1 chunk and failure", s)
+	}
+	// Without an upload under way, Abandon does nothing.
+	rx.Abandon(context.Background())
+}
+
+func TestExactChunkBoundary(t *testing.T) {
+	var ranges []string
+	var progress []int64
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			n, _ := io.Copy(io.Discard, req.Body)
+			cr := req.Header.Get("Content-Range")
+			ranges = append(ranges, fmt.Sprintf("%s (%d bytes)", cr, n))
+			h := http.Header{}
+			if strings.HasSuffix(cr, "/*") {
+				h.Set("X-Http-Status-Code-Override", "308")
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+		})},
+		URI:       "https://example.com/upload",
+		MediaType: "text/plain",
+		TotalSize: 30,
+		Callback:  func(n int64) { progress = append(progress, n) },
+		// The zero-byte finalization is not a chunk of media.
+		MaxChunks: 3,
+	}
+	// The source only reports EOF once the writer closes, after the last
+	// full chunk has been read.
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 3; i++ {
+			pw.Write([]byte(strings.Repeat("a", 10)))
+		}
+		pw.Close()
+	}()
+	rx.Media = NewMediaBuffer(pr, 10)
+
+	done := make(chan error, 1)
+	go func() {
+		res, err := rx.Upload(context.Background())
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Upload hung at the chunk boundary")
+	}
+
+	want := []string{
+		"bytes 0-9/* (10 bytes)",
+		"bytes 10-19/* (10 bytes)",
+		"bytes 20-29/* (10 bytes)",
+		"bytes */30 (0 bytes)",
+	}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Errorf("requests:\ngot  %q\nwant %q", ranges, want)
+	}
+	if want := []int64{10, 20, 30}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("progress: got %v, want %v", progress, want)
+	}
+	if rx.Progress() != 30 {
+		t.Errorf("Progress: got %d, want 30", rx.Progress())
+	}
+}
+
+func TestRotateToken(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	for _, tc := range []struct {
+		name          string
+		afterAttempts int
+		after         time.Duration
+		want          []int // token index per attempt of the first chunk
+	}{
+		{name: "stable", want: []int{0, 0, 0, 0, 0}},
+		{name: "every two attempts", afterAttempts: 2, want: []int{0, 0, 1, 1, 2}},
+		{name: "elapsed", after: time.Nanosecond, want: []int{0, 1, 2, 3, 4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var tokens []string
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					tokens = append(tokens, req.Header.Get(defaultIdempotencyHeaderName))
+					if len(tokens) < 5 {
+						return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: http.NoBody}, nil
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:                      "https://example.com/upload",
+				Media:                    NewMediaBuffer(strings.NewReader("data"), 10),
+				MediaType:                "text/plain",
+				RotateTokenAfterAttempts: tc.afterAttempts,
+				RotateTokenAfter:         tc.after,
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+
+			index := map[string]int{}
+			var got []int
+			for _, tok := range tokens {
+				if _, ok := index[tok]; !ok {
+					index[tok] = len(index)
+				}
+				got = append(got, index[tok])
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("token per attempt: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClassifyForbidden(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	forbidden := func(reason string) string {
+		return `{"error":{"code":403,"message":"m","errors":[{"reason":"` + reason + `"}]}}`
+	}
+	for _, tc := range []struct {
+		name         string
+		classify     bool
+		body         string
+		wantRequests int
+		wantReason   string // of a *PermissionDeniedError
+		wantStatus   int    // of the response returned
+	}{
+		{name: "quota", classify: true, body: forbidden("rateLimitExceeded"), wantRequests: 2, wantStatus: http.StatusOK},
+		{name: "permission", classify: true, body: forbidden("forbidden"), wantRequests: 1, wantReason: "forbidden"},
+		{name: "unparseable", classify: true, body: "<html>", wantRequests: 1, wantReason: ""},
+		{name: "not classified", body: forbidden("rateLimitExceeded"), wantRequests: 1, wantStatus: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int
+			rec := &eventRecorder{}
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					requests++
+					if requests == 1 {
+						h := http.Header{"Content-Type": {"application/json"}, "Retry-After": {"1"}}
+						return &http.Response{StatusCode: http.StatusForbidden, Header: h, Body: io.NopCloser(strings.NewReader(tc.body))}, nil
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:               "https://example.com/upload",
+				Media:             NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:         "text/plain",
+				Metrics:           rec,
+				ClassifyForbidden: tc.classify,
+				MaxRetryAfter:     time.Millisecond,
+			}
+			res, err := rx.Upload(context.Background())
+			if requests != tc.wantRequests {
+				t.Errorf("sent %d requests, want %d", requests, tc.wantRequests)
+			}
+			if tc.wantStatus == 0 {
+				var perr *PermissionDeniedError
+				if !errors.As(err, &perr) {
+					t.Fatalf("Upload err: got %v, want *PermissionDeniedError", err)
+				}
+				if perr.Reason != tc.wantReason || perr.Err.Code != http.StatusForbidden {
+					t.Errorf("got %+v, want reason %q and code 403", perr, tc.wantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.wantStatus {
+				t.Errorf("got status %d, want %d", res.StatusCode, tc.wantStatus)
+			}
+			if tc.wantRequests > 1 && rec.events[0].Pause.RetryAfter != time.Millisecond {
+				t.Errorf("got Pause %+v, want Retry-After honored", rec.events[0].Pause)
+			}
+		})
+	}
+}
+
+func TestClassifyForbiddenRetriesExhausted(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	const body = `{"error":{"code":403,"message":"slow down","errors":[{"reason":"rateLimitExceeded"}]}}`
+	for _, parse := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ParseErrorBody=%v", parse), func(t *testing.T) {
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					io.Copy(io.Discard, req.Body)
+					h := http.Header{"Content-Type": {"application/json"}}
+					return &http.Response{StatusCode: http.StatusForbidden, Header: h, Body: io.NopCloser(strings.NewReader(body))}, nil
+				})},
+				URI:                "https://example.com/upload",
+				Media:              NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:          "text/plain",
+				ClassifyForbidden:  true,
+				ChunkRetryDeadline: 150 * time.Millisecond,
+				ParseErrorBody:     parse,
+			}
+			res, err := rx.Upload(context.Background())
+			if parse {
+				var gerr *googleapi.Error
+				if !errors.As(err, &gerr) {
+					t.Fatalf("Upload err: got %v, want *googleapi.Error", err)
+				}
+				if gerr.Code != http.StatusForbidden || gerr.Message != "slow down" || len(gerr.Errors) == 0 || gerr.Errors[0].Reason != "rateLimitExceeded" {
+					t.Errorf("got %+v, want the quota error from the body", gerr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			defer res.Body.Close()
+			got, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			if res.StatusCode != http.StatusForbidden || string(got) != body {
+				t.Errorf("got status %d and body %q, want 403 and %q", res.StatusCode, got, body)
+			}
+		})
+	}
+}
+
+func TestConflict(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	const body = `{"error":{"code":409,"message":"m","errors":[{"reason":"conflict"}]}}`
+	for _, tc := range []struct {
+		name         string
+		retry        bool
+		wantRequests int
+	}{
+		{name: "default", wantRequests: 1},
+		{name: "retried", retry: true, wantRequests: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					requests++
+					if requests == 1 {
+						h := http.Header{"Content-Type": {"application/json"}}
+						return &http.Response{StatusCode: http.StatusConflict, Header: h, Body: io.NopCloser(strings.NewReader(body))}, nil
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:           "https://example.com/upload",
+				Media:         NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:     "text/plain",
+				RetryConflict: tc.retry,
+			}
+			res, err := rx.Upload(context.Background())
+			if requests != tc.wantRequests {
+				t.Errorf("sent %d requests, want %d", requests, tc.wantRequests)
+			}
+			if tc.retry {
+				if err != nil {
+					t.Fatalf("Upload: %v", err)
+				}
+				res.Body.Close()
+				return
+			}
+			var cerr *ConflictError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("Upload err: got %v, want *ConflictError", err)
+			}
+			if cerr.Reason != "conflict" || !cerr.Final || cerr.Err.Code != http.StatusConflict {
+				t.Errorf("got %+v, want reason \"conflict\" on the final chunk with code 409", cerr)
+			}
+		})
+	}
+}
+
+func TestErrorReasonTooLarge(t *testing.T) {
+	const body = `{"error":{"code":0,"message":"m","errors":[{"reason":"rateLimitExceeded"}]}}`
+	for _, status := range []int{http.StatusForbidden, http.StatusConflict} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			var requests int
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					requests++
+					h := http.Header{"Content-Type": {"application/json"}}
+					return &http.Response{StatusCode: status, Header: h, Body: io.NopCloser(strings.NewReader(body))}, nil
+				})},
+				URI:                  "https://example.com/upload",
+				Media:                NewMediaBuffer(strings.NewReader("hello"), 256),
+				MediaType:            "text/plain",
+				ClassifyForbidden:    true,
+				MaxResponseBodyBytes: 16,
+			}
+			_, err := rx.Upload(context.Background())
+			var terr *ResponseTooLargeError
+			if !errors.As(err, &terr) {
+				t.Fatalf("Upload err: got %v, want *ResponseTooLargeError", err)
+			}
+			if terr.StatusCode != status || terr.Limit != 16 {
+				t.Errorf("got %+v, want status %d and limit 16", terr, status)
+			}
+			if requests != 1 {
+				t.Errorf("sent %d requests, want 1", requests)
+			}
+		})
+	}
+}
+
+// atomicCountingReader counts the bytes read from r, and may be inspected
+// while another goroutine reads from it.
+type atomicCountingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *atomicCountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestPrefetchAbandonedOnCancel(t *testing.T) {
+	before := goroutines.live.Load()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			io.Copy(io.Discard, req.Body)
+			// The read ahead of the next chunk blocks on the pipe.
+			cancel()
+			return nil, ctx.Err()
+		})},
+		URI: "https://example.com/upload",
+		// The first chunk is available; the rest never comes.
+		Media:             NewMediaBuffer(io.MultiReader(strings.NewReader(strings.Repeat("a", 10)), pr), 10),
+		MediaType:         "text/plain",
+		PrefetchNextChunk: true,
+	}
+	returned := make(chan error, 1)
+	go func() {
+		_, err := rx.Upload(ctx)
+		returned <- err
+	}()
+	select {
+	case err := <-returned:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Upload: got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload did not return while the read ahead was blocked")
+	}
+	if _, err := rx.Upload(context.Background()); err == nil || !strings.Contains(err.Error(), "abandoned") {
+		t.Errorf("Upload with abandoned media: got %v, want an error", err)
+	}
+
+	// The abandoned read ends when the media returns.
+	pw.Close()
+	for deadline := time.Now().Add(time.Second); goroutines.live.Load() != before && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if live := goroutines.live.Load(); live != before {
+		t.Errorf("%d goroutines still running after the media returned", live-before)
+	}
+}
+
+func TestPrefetchNextChunk(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	media := "0123456789abcdefghijklmno"
+	for _, prefetch := range []bool{false, true} {
+		t.Run(fmt.Sprintf("prefetch=%v", prefetch), func(t *testing.T) {
+			src := &atomicCountingReader{r: strings.NewReader(media)}
+			tr := &interruptibleTransport{
+				events: []event{
+					{byteRange: "bytes 0-9/*", responseStatus: http.StatusServiceUnavailable},
+					{byteRange: "bytes 0-9/*", responseStatus: 308},
+					{byteRange: "bytes 10-19/*", responseStatus: 308},
+					{byteRange: "bytes 20-24/25", responseStatus: http.StatusOK},
+				},
+				bodies: bodyTracker{},
+			}
+			// readAhead records, for each request, how far the media had
+			// been read beyond the chunk being sent.
+			var readAhead []int64
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					var first, last int64
+					fmt.Sscanf(req.Header.Get("Content-Range"), "bytes %d-%d", &first, &last)
+					if prefetch && last+1 < int64(len(media)) {
+						// Give the read ahead time to complete.
+						deadline := time.Now().Add(5 * time.Second)
+						for src.n.Load() <= last+1 && time.Now().Before(deadline) {
+							time.Sleep(time.Millisecond)
+						}
+					}
+					readAhead = append(readAhead, src.n.Load()-(last+1))
+					return tr.RoundTrip(req)
+				})},
+				Media:             NewMediaBuffer(src, 10),
+				MediaType:         "text/plain",
+				PrefetchNextChunk: prefetch,
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if got, want := string(tr.buf), media; got != want {
+				t.Errorf("transferred contents: got %q, want %q", got, want)
+			}
+			want := []int64{0, 0, 0, 0}
+			if prefetch {
+				// The next chunk was read while each chunk was sent, and
+				// survived the retry of the first.
+				want = []int64{10, 10, 5, 0}
+			}
+			if !reflect.DeepEqual(readAhead, want) {
+				t.Errorf("bytes read ahead of each request: got %v, want %v", readAhead, want)
+			}
+		})
+	}
+}
+
+func TestChunkTrace(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		requests++
+		if requests == 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if !strings.HasSuffix(r.Header.Get("Content-Range"), "/25") {
+			w.Header().Set("X-Http-Status-Code-Override", "308")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var indices []int
+	var conns int
+	rx := &ResumableUpload{
+		Client:    srv.Client(),
+		URI:       srv.URL,
+		Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+		MediaType: "text/plain",
+		ChunkTrace: func(chunkIndex int) *httptrace.ClientTrace {
+			indices = append(indices, chunkIndex)
+			return &httptrace.ClientTrace{
+				GotConn: func(httptrace.GotConnInfo) {
+					mu.Lock()
+					conns++
+					mu.Unlock()
+				},
+			}
+		},
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	// The second chunk is sent twice.
+	if want := []int{0, 1, 1, 2}; !reflect.DeepEqual(indices, want) {
+		t.Errorf("ChunkTrace called with %v, want %v", indices, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 4 {
+		t.Errorf("ChunkTrace GotConn called %d times, want 4", conns)
+	}
+	// The library's own trace still sees the connections.
+	if s := rx.Summary(); s.ReusedConns != 3 {
+		t.Errorf("got ReusedConns=%d, want 3", s.ReusedConns)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		io.Copy(io.Discard, req.Body)
+		order = append(order, "base:"+req.Header.Get("X-Chain"))
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+	})
+	layer := func(name string) func(http.RoundTripper) http.RoundTripper {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				order = append(order, name)
+				req.Header.Set("X-Chain", req.Header.Get("X-Chain")+name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	client := &http.Client{Transport: base}
+	rx := &ResumableUpload{
+		Client:     client,
+		URI:        "https://example.com/upload",
+		Media:      NewMediaBuffer(strings.NewReader("hello"), 256),
+		MediaType:  "text/plain",
+		Middleware: []func(http.RoundTripper) http.RoundTripper{layer("a"), layer("b")},
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+
+	if want := []string{"a", "b", "base:ab"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("got call order %q, want %q", order, want)
+	}
+	if _, ok := client.Transport.(roundTripFunc); !ok {
+		t.Errorf("Client.Transport was replaced with %T", client.Transport)
+	}
+}
+
+func TestRecoveryProbeDeadlines(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	for _, tc := range []struct {
+		name string
+		rx   *ResumableUpload
+		// check inspects the result of Upload; probes counts the probes sent.
+		check func(t *testing.T, err error, probes int)
+	}{
+		{
+			name: "ChunkTransferTimeout",
+			rx:   &ResumableUpload{ChunkTransferTimeout: 20 * time.Millisecond},
+			check: func(t *testing.T, err error, probes int) {
+				// The hung probe times out and the chunk is resent in full.
+				if err != nil {
+					t.Errorf("Upload: %v", err)
+				}
+				if probes != 1 {
+					t.Errorf("sent %d probes, want 1", probes)
+				}
+			},
+		},
+		{
+			name: "ChunkRetryDeadline",
+			rx:   &ResumableUpload{ChunkRetryDeadline: 150 * time.Millisecond},
+			check: func(t *testing.T, err error, probes int) {
+				if !errors.Is(err, errProbeDeadline) {
+					t.Errorf("Upload err: got %v, want %v", err, errProbeDeadline)
+				}
+			},
+		},
+		{
+			name: "TotalDeadline",
+			rx:   &ResumableUpload{TotalDeadline: 50 * time.Millisecond},
+			check: func(t *testing.T, err error, probes int) {
+				var derr *TotalDeadlineExceededError
+				if !errors.As(err, &derr) {
+					t.Errorf("Upload err: got %v, want *TotalDeadlineExceededError", err)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var chunks, probes int
+			rx := tc.rx
+			rx.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Header.Get("Content-Range") == "bytes */*" {
+					// The probe hangs until its context is done.
+					probes++
+					<-req.Context().Done()
+					return nil, req.Context().Err()
+				}
+				io.Copy(io.Discard, req.Body)
+				if chunks++; chunks == 1 {
+					return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: http.NoBody}, nil
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			})}
+			rx.URI = "https://example.com/upload"
+			rx.Media = NewMediaBuffer(strings.NewReader("hello"), 256)
+			rx.MediaType = "text/plain"
+			rx.ProbeBeforeRetry = true
+
+			start := time.Now()
+			res, err := rx.Upload(context.Background())
+			if err == nil {
+				res.Body.Close()
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("Upload took %v; the hung probe was not bounded", d)
+			}
+			tc.check(t, err, probes)
+		})
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	rx := &ResumableUpload{
+		FinalizeRetry:           &RetryConfig{Backoff: &gax.Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 3}},
+		TotalDeadline:           time.Hour,
+		ChunkTransferTimeout:    10 * time.Second,
+		RetryAfterSkewTolerance: -1,
+		ClassifyForbidden:       true,
+		RetryConflict:           true,
+	}
+	d := rx.RetryPolicy()
+	want := RetryPolicyDescription{
+		Backoff:                 BackoffDescription{Strategy: "exponential", Initial: 100 * time.Millisecond, Max: 30 * time.Second, Multiplier: 2, Jitter: "full"},
+		RetryableStatuses:       "408, 429, 5xx, 403 for quota, 409",
+		FinalizeBackoff:         &BackoffDescription{Strategy: "exponential", Initial: time.Second, Max: time.Minute, Multiplier: 3, Jitter: "full"},
+		ChunkRetryDeadline:      defaultRetryDeadline,
+		TotalDeadline:           time.Hour,
+		ChunkTransferTimeout:    10 * time.Second,
+		MaxRetryAfter:           defaultMaxRetryAfter,
+		RetryAfterSkewTolerance: 0,
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("got %+v\nwant %+v", d, want)
+	}
+	const wantString = `backoff=exponential initial=100ms max=30s multiplier=2 jitter="full" retryable="408, 429, 5xx, 403 for quota, 409" ` +
+		`finalizeBackoff=exponential finalizeInitial=1s finalizeMax=1m0s finalizeMultiplier=3 ` +
+		`chunkRetryDeadline=32s totalDeadline=1h0m0s chunkTransferTimeout=10s maxRetryAfter=1m0s retryAfterSkewTolerance=0s`
+	if got := d.String(); got != wantString {
+		t.Errorf("String:\ngot  %s\nwant %s", got, wantString)
+	}
+}
+
+func TestProbeOnConnReset(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	reset := &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.ECONNRESET)}
+	for _, tc := range []struct {
+		name       string
+		fail       func() (*http.Response, error)
+		wantRanges []string
+		wantResets int
+	}{
+		{
+			name:       "reset",
+			fail:       func() (*http.Response, error) { return nil, reset },
+			wantRanges: []string{"bytes 0-19/*", "bytes */*", "bytes 10-19/*"},
+			wantResets: 1,
+		},
+		{
+			name: "other failure",
+			fail: func() (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: http.NoBody}, nil
+			},
+			wantRanges: []string{"bytes 0-19/*", "bytes 0-19/*"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ranges []string
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					cr := req.Header.Get("Content-Range")
+					ranges = append(ranges, cr)
+					if cr == "bytes */*" {
+						resp := incompleteResponse()
+						resp.Header.Set("Range", "bytes=0-9")
+						return resp, nil
+					}
+					if len(ranges) == 1 {
+						// The connection fails after half the chunk is sent.
+						io.CopyN(io.Discard, req.Body, 10)
+						return tc.fail()
+					}
+					io.Copy(io.Discard, req.Body)
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:              "https://example.com/upload",
+				Media:            NewMediaBuffer(strings.NewReader(strings.Repeat("a", 20)), 20),
+				MediaType:        "text/plain",
+				ProbeOnConnReset: true,
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if !reflect.DeepEqual(ranges, tc.wantRanges) {
+				t.Errorf("got requests %q, want %q", ranges, tc.wantRanges)
+			}
+			if got := rx.Summary().ConnResets; got != tc.wantResets {
+				t.Errorf("got ConnResets %d, want %d", got, tc.wantResets)
+			}
+		})
+	}
+}
+
+func TestWarnShortChunkTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		timeout  time.Duration
+		wantWarn bool
+	}{
+		{name: "short", timeout: 200 * time.Millisecond, wantWarn: true},
+		{name: "ample", timeout: time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			var requests int
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					io.Copy(io.Discard, req.Body)
+					// Only the first request is slow: later ones must not
+					// change the verdict.
+					if requests++; requests == 1 {
+						time.Sleep(170 * time.Millisecond)
+					}
+					if strings.HasSuffix(req.Header.Get("Content-Range"), "/*") {
+						return incompleteResponse(), nil
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+				})},
+				URI:                  "https://example.com/upload",
+				Media:                NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+				MediaType:            "text/plain",
+				ChunkTransferTimeout: tc.timeout,
+				Logger:               slog.New(slog.NewTextHandler(&logs, nil)),
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if got := strings.Count(logs.String(), "consider a larger timeout"); got != map[bool]int{true: 1}[tc.wantWarn] {
+				t.Errorf("got %d warnings, want warning %v; logs:\n%s", got, tc.wantWarn, logs.String())
+			}
+		})
+	}
+}
+
+func TestChunkReadTimeout(t *testing.T) {
+	tr := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		io.Copy(io.Discard, req.Body)
+		if strings.HasSuffix(req.Header.Get("Content-Range"), "/*") {
+			return incompleteResponse(), nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+	})
+
+	t.Run("in time", func(t *testing.T) {
+		rx := &ResumableUpload{
+			Client:           &http.Client{Transport: tr},
+			URI:              "https://example.com/upload",
+			Media:            NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+			MediaType:        "text/plain",
+			ChunkReadTimeout: time.Minute,
+		}
+		res, err := rx.Upload(context.Background())
+		if err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		res.Body.Close()
+	})
+
+	t.Run("hung source", func(t *testing.T) {
+		// The source produces the first chunk, then hangs until released.
+		gate := make(chan struct{})
+		before := goroutines.live.Load()
+		rx := &ResumableUpload{
+			Client:           &http.Client{Transport: tr},
+			URI:              "https://example.com/upload",
+			Media:            NewMediaBuffer(&gatedReader{r: strings.NewReader(strings.Repeat("a", 25)), n: 10, gate: gate}, 10),
+			MediaType:        "text/plain",
+			ChunkReadTimeout: 20 * time.Millisecond,
+		}
+		start := time.Now()
+		_, err := rx.Upload(context.Background())
+		var terr *SourceReadTimeoutError
+		if !errors.As(err, &terr) {
+			t.Fatalf("Upload err: got %v, want *SourceReadTimeoutError", err)
+		}
+		if terr.Offset != 10 || terr.Timeout != rx.ChunkReadTimeout {
+			t.Errorf("got %+v, want Offset 10 and Timeout %v", terr, rx.ChunkReadTimeout)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("Upload took %v, want it to give up on the source", d)
+		}
+
+		// Once the source returns, the abandoned read ends.
+		close(gate)
+		for goroutines.live.Load() != before {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("the abandoned read did not end after the source returned")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func TestLenientResumeIncomplete(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		lenient      bool
+		wantRequests int
+	}{
+		{name: "strict", wantRequests: 1},
+		{name: "lenient", lenient: true, wantRequests: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ranges []string
+			rx := &ResumableUpload{
+				Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					cr := req.Header.Get("Content-Range")
+					ranges = append(ranges, cr)
+					io.Copy(io.Discard, req.Body)
+					if strings.HasSuffix(cr, "/*") {
+						// An incomplete status without the override header.
+						end := strings.TrimSuffix(cr[strings.Index(cr, "-")+1:], "/*")
+						return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Range": {"bytes=0-" + end}}, Body: http.NoBody}, nil
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, ContentLength: 2, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+				})},
+				URI:                     "https://example.com/upload",
+				Media:                   NewMediaBuffer(strings.NewReader(strings.Repeat("a", 25)), 10),
+				MediaType:               "text/plain",
+				LenientResumeIncomplete: tc.lenient,
+			}
+			res, err := rx.Upload(context.Background())
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			res.Body.Close()
+			if len(ranges) != tc.wantRequests {
+				t.Errorf("sent requests for %q, want %d requests", ranges, tc.wantRequests)
+			}
+			if tc.lenient && rx.Progress() != 25 {
+				t.Errorf("progress: got %d, want 25", rx.Progress())
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gensupport
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// chunkTrace records the points in a chunk request's lifetime needed to split
+// its duration into time on the wire and time waiting for the server, and
+// whether the request reused a connection.
+type chunkTrace struct {
+	mu           sync.Mutex
+	wroteRequest time.Time
+	firstByte    time.Time
+	gotConn      bool
+	reused       bool
+	remoteAddr   string
+}
+
+func newChunkTrace() *chunkTrace {
+	return &chunkTrace{}
+}
+
+// withContext returns a context that reports the request's progress to t.
+func (t *chunkTrace) withContext(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.gotConn = true
+			t.reused = info.Reused
+			if info.Conn != nil {
+				t.remoteAddr = info.Conn.RemoteAddr().String()
+			}
+			t.mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			t.wroteRequest = time.Now()
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.firstByte = time.Now()
+			t.mu.Unlock()
+		},
+	})
+}
+
+// durations returns the time from start until the request was fully written,
+// and the time from then until the first response byte arrived. Either is
+// zero if the transport did not report the corresponding event.
+func (t *chunkTrace) durations(start time.Time) (wire, think time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.wroteRequest.IsZero() {
+		return 0, 0
+	}
+	wire = t.wroteRequest.Sub(start)
+	if !t.firstByte.IsZero() && t.firstByte.After(t.wroteRequest) {
+		think = t.firstByte.Sub(t.wroteRequest)
+	}
+	return wire, think
+}
+
+// connReused reports whether the request was sent over a reused connection.
+// ok is false if the transport did not report obtaining a connection.
+func (t *chunkTrace) connReused() (reused, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reused, t.gotConn
+}
+
+// maxTrackedServers bounds the number of servers counted by noteServer.
+const maxTrackedServers = 64
+
+// noteServer records the server that sent resp, the response to a chunk
+// request traced by t, in UploadSummary.DistinctServers. A server is
+// identified by the Via header of resp if present, and otherwise by the
+// address the request was sent to. Servers beyond maxTrackedServers are not
+// counted.
+func (rx *ResumableUpload) noteServer(resp *http.Response, t *chunkTrace) {
+	if resp == nil || len(rx.servers) >= maxTrackedServers {
+		return
+	}
+	id := resp.Header.Get("Via")
+	if id == "" {
+		t.mu.Lock()
+		id = t.remoteAddr
+		t.mu.Unlock()
+	}
+	if id == "" {
+		return
+	}
+	if rx.servers == nil {
+		rx.servers = make(map[string]bool)
+	}
+	rx.servers[id] = true
+	rx.stats.DistinctServers = len(rx.servers)
+}
+
+// responseStatus returns the status code of resp, or 0 if resp is nil.
+func responseStatus(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
@@ -6,29 +6,215 @@ package gensupport
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/googleapis/gax-go/v2"
 	"google.golang.org/api/googleapi"
 )
 
-// Backoff is an interface around gax.Backoff's Pause method, allowing tests to provide their
-// own implementation.
+// Backoff is an interface around gax.Backoff's Pause method, allowing tests
+// and callers to provide their own implementation.
 type Backoff interface {
+	// Pause returns the duration of the next pause.
 	Pause() time.Duration
+	// Reset returns the backoff to its initial state.
+	Reset()
+}
+
+// intervalBackoff is implemented by backoffs that draw each pause at random
+// from an interval, and can report the interval of the next pause.
+type intervalBackoff interface {
+	nextInterval() time.Duration
+}
+
+// gaxBackoff adapts a gax.Backoff to the Backoff interface.
+type gaxBackoff struct {
+	cfg gax.Backoff // the initial state, restored by Reset
+	bo  gax.Backoff
+	cur time.Duration // the interval of bo, which gax.Backoff does not expose
+}
+
+func newGaxBackoff(cfg gax.Backoff) *gaxBackoff {
+	return &gaxBackoff{cfg: cfg, bo: cfg}
+}
+
+func (b *gaxBackoff) Pause() time.Duration {
+	cfg := withBackoffDefaults(b.cfg)
+	b.cur = time.Duration(float64(b.nextInterval()) * cfg.Multiplier)
+	if b.cur > cfg.Max {
+		b.cur = cfg.Max
+	}
+	return b.bo.Pause()
+}
+
+func (b *gaxBackoff) Reset() {
+	b.bo = b.cfg
+	b.cur = 0
+}
+
+func (b *gaxBackoff) nextInterval() time.Duration {
+	if b.cur == 0 {
+		return withBackoffDefaults(b.cfg).Initial
+	}
+	return b.cur
+}
+
+// withBackoffDefaults returns bo with the defaults applied by gax.Backoff
+// filled in.
+func withBackoffDefaults(bo gax.Backoff) gax.Backoff {
+	if bo.Initial == 0 {
+		bo.Initial = time.Second
+	}
+	if bo.Max == 0 {
+		bo.Max = 30 * time.Second
+	}
+	if bo.Multiplier < 1 {
+		bo.Multiplier = 2
+	}
+	return bo
+}
+
+// jitterMu guards all use of caller-supplied random sources, which may be
+// shared between concurrent uploads.
+var jitterMu sync.Mutex
+
+// jitteredBackoff implements the same algorithm as gax.Backoff, but draws its
+// jitter from a caller-supplied random source.
+type jitteredBackoff struct {
+	cfg  gax.Backoff // with defaults applied
+	cur  time.Duration
+	rand *rand.Rand
+}
+
+func newJitteredBackoff(cfg gax.Backoff, r *rand.Rand) *jitteredBackoff {
+	return &jitteredBackoff{cfg: withBackoffDefaults(cfg), rand: r}
+}
+
+func (b *jitteredBackoff) Pause() time.Duration {
+	if b.cur == 0 {
+		b.cur = b.cfg.Initial
+	}
+	jitterMu.Lock()
+	d := time.Duration(1 + b.rand.Int63n(int64(b.cur)))
+	jitterMu.Unlock()
+	b.cur = time.Duration(float64(b.cur) * b.cfg.Multiplier)
+	if b.cur > b.cfg.Max {
+		b.cur = b.cfg.Max
+	}
+	return d
+}
+
+func (b *jitteredBackoff) Reset() { b.cur = 0 }
+
+func (b *jitteredBackoff) nextInterval() time.Duration {
+	if b.cur == 0 {
+		return b.cfg.Initial
+	}
+	return b.cur
+}
+
+// PauseBreakdown describes how a pause between retries was derived.
+type PauseBreakdown struct {
+	// Raw is the backoff interval, before jitter, from which the pause was
+	// drawn. For a custom Backoff, it is the pause it returned.
+	Raw time.Duration
+	// Jitter is the random adjustment applied to Raw. It is zero or
+	// negative.
+	Jitter time.Duration
+	// Backoff is the pause returned by the backoff: Raw plus Jitter.
+	Backoff time.Duration
+	// RetryAfter is the pause requested by the server in a Retry-After
+	// header, if any, after clamping. See ResumableUpload.MaxRetryAfter.
+	RetryAfter time.Duration
+	// Clamped reports whether the pause was cut short by the chunk retry
+	// deadline.
+	Clamped bool
+	// Final is the pause actually waited before the next attempt, or before
+	// giving up if Clamped is set. Unless Clamped is set, it is the larger of
+	// Backoff and RetryAfter.
+	Final time.Duration
+}
+
+// nextPause takes the next pause from bo, and describes it. deadline is the
+// time at which retries stop, and retryAfter is the pause requested by the
+// server, if any.
+func nextPause(bo Backoff, deadline time.Time, retryAfter time.Duration) PauseBreakdown {
+	var pb PauseBreakdown
+	if ib, ok := bo.(intervalBackoff); ok {
+		pb.Raw = ib.nextInterval()
+	}
+	pb.Backoff = bo.Pause()
+	if pb.Raw == 0 {
+		pb.Raw = pb.Backoff
+	}
+	pb.Jitter = pb.Backoff - pb.Raw
+	pb.RetryAfter = retryAfter
+	pb.Final = max(pb.Backoff, pb.RetryAfter)
+	if remaining := time.Until(deadline); pb.Final > remaining {
+		pb.Final = max(remaining, 0)
+		pb.Clamped = true
+	}
+	return pb
+}
+
+const (
+	// Defaults for ResumableUpload.MaxRetryAfter and
+	// RetryAfterSkewTolerance.
+	defaultMaxRetryAfter           = time.Minute
+	defaultRetryAfterSkewTolerance = 5 * time.Second
+	// retryAfterSoon is the pause for a Retry-After date that has passed,
+	// but by no more than the skew tolerance.
+	retryAfterSoon = time.Second
+)
+
+// retryAfter returns the pause requested by the Retry-After header of resp,
+// or 0 if there is none or it cannot be parsed. An HTTP-date is relative to
+// now: one in the past by up to skew yields retryAfterSoon, and one further
+// in the past is ignored. The pause is at most maxPause.
+func retryAfter(resp *http.Response, now time.Time, skew, maxPause time.Duration) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.ParseUint(v, 10, 63); err == nil {
+		if secs > uint64(maxPause/time.Second) {
+			return maxPause
+		}
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+		if d <= 0 {
+			if -d > skew {
+				return 0
+			}
+			d = retryAfterSoon
+		}
+	}
+	return min(d, maxPause)
 }
 
 // These are declared as global variables so that tests can overwrite them.
 var (
 	// Default per-chunk deadline for resumable uploads.
 	defaultRetryDeadline = 32 * time.Second
-	// Default backoff timer.
-	backoff = func() Backoff {
-		return &gax.Backoff{Initial: 100 * time.Millisecond}
+	// Default backoff configuration and timer.
+	defaultBackoffConfig = gax.Backoff{Initial: 100 * time.Millisecond}
+	backoff              = func() Backoff {
+		return newGaxBackoff(defaultBackoffConfig)
 	}
 )
 
@@ -58,9 +244,29 @@ func shouldRetry(status int, err error) bool {
 	if errors.Is(err, io.ErrUnexpectedEOF) {
 		return true
 	}
+	// A short write leaves the request body partly sent; the whole request
+	// is sent again.
+	if errors.Is(err, io.ErrShortWrite) {
+		return true
+	}
 	if errors.Is(err, net.ErrClosed) {
 		return true
 	}
+	if isDialTimeout(err) {
+		return true
+	}
+	// An attempt cut off by ResumableUpload.ChunkTransferTimeout is retried.
+	var cterr *ChunkTimeoutError
+	if errors.As(err, &cterr) {
+		return true
+	}
+	// A failure to resolve the server's name, such as from a resolver set up
+	// with ClientWithResolver, is retried if the resolver reports it as
+	// transient, but not if the name does not exist.
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
 	switch e := err.(type) {
 	case *net.OpError, *url.Error:
 		// Retry socket-level errors ECONNREFUSED and ECONNRESET (from syscall).
@@ -86,22 +292,246 @@ func shouldRetry(status int, err error) bool {
 	return false
 }
 
+// isDialTimeout reports whether err is a timeout while establishing a
+// connection.
+func isDialTimeout(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout()
+}
+
+// isConnReset reports whether err reports that the connection was reset by
+// the server or broke while the request was being written.
+func isConnReset(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	s := err.Error()
+	return strings.Contains(s, "connection reset") || strings.Contains(s, "broken pipe")
+}
+
+// TimeoutKind classifies the timeout, if any, behind a failed request.
+type TimeoutKind int
+
+const (
+	// NoTimeout means that the request did not time out.
+	NoTimeout TimeoutKind = iota
+	// DialTimeout means that establishing the connection timed out: the
+	// server could not be reached.
+	DialTimeout
+	// TransferTimeout means that the request timed out once connected, such
+	// as by ChunkTransferTimeout: the connection stalled mid-transfer.
+	TransferTimeout
+)
+
+func (k TimeoutKind) String() string {
+	switch k {
+	case NoTimeout:
+		return "NoTimeout"
+	case DialTimeout:
+		return "DialTimeout"
+	case TransferTimeout:
+		return "TransferTimeout"
+	}
+	return "TimeoutKind(unknown)"
+}
+
+// classifyTimeout returns the kind of timeout behind err. attemptTimedOut
+// reports whether the request's own deadline expired.
+func classifyTimeout(err error, attemptTimedOut bool) TimeoutKind {
+	if isDialTimeout(err) {
+		return DialTimeout
+	}
+	if attemptTimedOut {
+		return TransferTimeout
+	}
+	var te interface{ Timeout() bool }
+	if errors.As(err, &te) && te.Timeout() {
+		return TransferTimeout
+	}
+	return NoTimeout
+}
+
 // RetryConfig allows configuration of backoff timing and retryable errors.
 type RetryConfig struct {
 	Backoff     *gax.Backoff
 	ShouldRetry func(err error) bool
+
+	// Rand, if set, is the source of the random jitter applied to Backoff
+	// pauses, allowing reproducible backoff sequences. It may be shared by
+	// concurrent uploads. It is ignored if BackoffFactory is set. By default,
+	// the shared source of math/rand is used.
+	Rand *rand.Rand
+
+	// BackoffFactory, if set, takes precedence over Backoff and is called to
+	// obtain a backoff for each chunk of a resumable upload, and for each
+	// request sent with SendRequestWithRetry. The returned Backoff is Reset
+	// before use.
+	BackoffFactory func() Backoff
 }
 
 // Get a new backoff object based on the configured values.
 func (r *RetryConfig) backoff() Backoff {
-	if r == nil || r.Backoff == nil {
-		return backoff()
+	var bo Backoff
+	switch {
+	case r != nil && r.BackoffFactory != nil:
+		bo = r.BackoffFactory()
+	case r != nil && r.Rand != nil:
+		cfg := defaultBackoffConfig
+		if r.Backoff != nil {
+			cfg = *r.Backoff
+		}
+		bo = newJitteredBackoff(cfg, r.Rand)
+	case r != nil && r.Backoff != nil:
+		bo = newGaxBackoff(gax.Backoff{
+			Initial:    r.Backoff.Initial,
+			Max:        r.Backoff.Max,
+			Multiplier: r.Backoff.Multiplier,
+		})
+	default:
+		bo = backoff()
 	}
-	return &gax.Backoff{
-		Initial:    r.Backoff.Initial,
-		Max:        r.Backoff.Max,
-		Multiplier: r.Backoff.Multiplier,
+	bo.Reset()
+	return bo
+}
+
+// BackoffDescription describes the effective backoff of a RetryConfig, with
+// defaults filled in.
+type BackoffDescription struct {
+	// Strategy is "exponential" for a gax.Backoff configuration, or "custom"
+	// if BackoffFactory is set, in which case the other fields are zero.
+	Strategy string
+	// Initial, Max and Multiplier are the parameters of the exponential
+	// backoff.
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// Jitter is "full" if each pause is drawn uniformly from (0, current
+	// interval] using the shared source of math/rand, or "full, seeded" if
+	// it uses RetryConfig.Rand.
+	Jitter string
+}
+
+// describeBackoff returns the description of the backoff used by r.
+func (r *RetryConfig) describeBackoff() BackoffDescription {
+	if r != nil && r.BackoffFactory != nil {
+		return BackoffDescription{Strategy: "custom"}
+	}
+	cfg := defaultBackoffConfig
+	if r != nil && r.Backoff != nil {
+		cfg = *r.Backoff
+	}
+	cfg = withBackoffDefaults(cfg)
+	d := BackoffDescription{
+		Strategy:   "exponential",
+		Initial:    cfg.Initial,
+		Max:        cfg.Max,
+		Multiplier: cfg.Multiplier,
+		Jitter:     "full",
+	}
+	if r != nil && r.Rand != nil {
+		d.Jitter = "full, seeded"
+	}
+	return d
+}
+
+// RetryPolicyDescription describes an effective retry policy, with defaults
+// filled in, for logging. RetryConfig.Describe fills in Backoff and
+// RetryableStatuses; ResumableUpload.RetryPolicy fills in the rest.
+type RetryPolicyDescription struct {
+	// Backoff describes the pauses between attempts.
+	Backoff BackoffDescription
+	// RetryableStatuses lists the response statuses that are retried, such
+	// as "408, 429, 5xx", or starts with "custom" if RetryConfig.ShouldRetry
+	// decides. Transient network errors are also retried by default.
+	RetryableStatuses string
+
+	// FinalizeBackoff describes the pauses between attempts at the final
+	// chunk, if they differ from Backoff because FinalizeRetry is set.
+	FinalizeBackoff *BackoffDescription
+	// ChunkRetryDeadline is the time after which a chunk is no longer
+	// retried, and TotalDeadline that after which the upload fails; zero
+	// means no total deadline.
+	ChunkRetryDeadline time.Duration
+	TotalDeadline      time.Duration
+	// ChunkTransferTimeout bounds each chunk request; zero means no bound.
+	ChunkTransferTimeout time.Duration
+	// MaxRetryAfter caps the pause requested by Retry-After, and
+	// RetryAfterSkewTolerance is the tolerance for Retry-After dates in the
+	// past; zero means no tolerance.
+	MaxRetryAfter           time.Duration
+	RetryAfterSkewTolerance time.Duration
+}
+
+// String formats d on a single line.
+func (d RetryPolicyDescription) String() string {
+	b := d.Backoff
+	s := fmt.Sprintf("backoff=%s", b.Strategy)
+	if b.Strategy != "custom" {
+		s += fmt.Sprintf(" initial=%v max=%v multiplier=%v jitter=%q", b.Initial, b.Max, b.Multiplier, b.Jitter)
+	}
+	s += fmt.Sprintf(" retryable=%q", d.RetryableStatuses)
+	if f := d.FinalizeBackoff; f != nil {
+		s += fmt.Sprintf(" finalizeBackoff=%s", f.Strategy)
+		if f.Strategy != "custom" {
+			s += fmt.Sprintf(" finalizeInitial=%v finalizeMax=%v finalizeMultiplier=%v", f.Initial, f.Max, f.Multiplier)
+		}
+	}
+	if d.ChunkRetryDeadline > 0 {
+		s += fmt.Sprintf(" chunkRetryDeadline=%v totalDeadline=%v chunkTransferTimeout=%v maxRetryAfter=%v retryAfterSkewTolerance=%v",
+			d.ChunkRetryDeadline, d.TotalDeadline, d.ChunkTransferTimeout, d.MaxRetryAfter, d.RetryAfterSkewTolerance)
+	}
+	return s
+}
+
+// Describe returns the effective backoff and retry predicate of r, with
+// defaults filled in. r may be nil, in which case the defaults are described.
+func (r *RetryConfig) Describe() RetryPolicyDescription {
+	d := RetryPolicyDescription{Backoff: r.describeBackoff(), RetryableStatuses: "408, 429, 5xx"}
+	if r != nil && r.ShouldRetry != nil {
+		d.RetryableStatuses = "custom"
+	}
+	return d
+}
+
+// PreviewBackoff returns the first n pauses of the backoff sequence that r
+// would produce, so that a configuration can be checked without running a
+// failing upload. r may be nil, in which case the default configuration is
+// previewed.
+//
+// Jitter is disabled in the preview: for a gax.Backoff configuration, each
+// returned pause is the ceiling from which the actual, randomly jittered pause
+// is drawn. If BackoffFactory is set, the pauses of a fresh Backoff from it
+// are returned as-is.
+func (r *RetryConfig) PreviewBackoff(n int) []time.Duration {
+	if n <= 0 {
+		return nil
+	}
+	pauses := make([]time.Duration, n)
+	if r != nil && r.BackoffFactory != nil {
+		bo := r.BackoffFactory()
+		bo.Reset()
+		for i := range pauses {
+			pauses[i] = bo.Pause()
+		}
+		return pauses
+	}
+	cfg := defaultBackoffConfig
+	if r != nil && r.Backoff != nil {
+		cfg = *r.Backoff
+	}
+	cfg = withBackoffDefaults(cfg)
+	cur := cfg.Initial
+	for i := range pauses {
+		pauses[i] = cur
+		cur = time.Duration(float64(cur) * cfg.Multiplier)
+		if cur > cfg.Max {
+			cur = cfg.Max
+		}
 	}
+	return pauses
 }
 
 // This is kind of hacky; it is necessary because ShouldRetry expects to
@@ -5,12 +5,23 @@
 package gensupport
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/googleapis/gax-go/v2"
 )
 
 func TestShouldRetry(t *testing.T) {
@@ -66,6 +77,21 @@ func TestShouldRetry(t *testing.T) {
 			inputErr:    &net.OpError{Op: "blah", Net: "tcp", Err: errors.New("connection reset by peer")},
 			shouldRetry: true,
 		},
+		{
+			desc:        "temporary DNS failure",
+			inputErr:    &url.Error{Op: "Post", URL: "blah", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "server misbehaving", Name: "blah", IsTemporary: true}}},
+			shouldRetry: true,
+		},
+		{
+			desc:        "DNS timeout",
+			inputErr:    &net.DNSError{Err: "i/o timeout", Name: "blah", IsTimeout: true},
+			shouldRetry: true,
+		},
+		{
+			desc:        "DNS name not found",
+			inputErr:    &url.Error{Op: "Post", URL: "blah", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "blah", IsNotFound: true}}},
+			shouldRetry: false,
+		},
 		{
 			desc:        "io.ErrUnexpectedEOF",
 			inputErr:    io.ErrUnexpectedEOF,
@@ -81,11 +107,26 @@ func TestShouldRetry(t *testing.T) {
 			inputErr:    fmt.Errorf("Test unwrapping of a non-retriable error: %w", io.EOF),
 			shouldRetry: false,
 		},
+		{
+			desc:        "short write",
+			inputErr:    &url.Error{Op: "Post", URL: "blah", Err: io.ErrShortWrite},
+			shouldRetry: true,
+		},
 		{
 			desc:        "wrapped net.ErrClosed",
 			inputErr:    &net.OpError{Err: net.ErrClosed},
 			shouldRetry: true,
 		},
+		{
+			desc:        "dial timeout",
+			inputErr:    &url.Error{Op: "Post", URL: "blah", Err: &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}},
+			shouldRetry: true,
+		},
+		{
+			desc:        "read timeout",
+			inputErr:    &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}},
+			shouldRetry: false,
+		},
 	} {
 		t.Run(test.desc, func(s *testing.T) {
 			got := shouldRetry(test.code, test.inputErr)
@@ -95,3 +136,435 @@ func TestShouldRetry(t *testing.T) {
 		})
 	}
 }
+
+// timeoutError is a network timeout that is not reported as temporary.
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "i/o timeout" }
+func (timeoutError) Timeout() bool { return true }
+
+func TestClassifyTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		desc            string
+		err             error
+		attemptTimedOut bool
+		want            TimeoutKind
+	}{
+		{desc: "no error", want: NoTimeout},
+		{desc: "other error", err: io.ErrUnexpectedEOF, want: NoTimeout},
+		{desc: "dial timeout", err: &url.Error{Op: "Post", URL: "blah", Err: &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}}, want: DialTimeout},
+		{desc: "dial timeout on attempt deadline", err: &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, attemptTimedOut: true, want: DialTimeout},
+		{desc: "read timeout", err: &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, want: TransferTimeout},
+		{desc: "attempt deadline", err: context.DeadlineExceeded, attemptTimedOut: true, want: TransferTimeout},
+		{desc: "dial refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, want: NoTimeout},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := classifyTimeout(tc.err, tc.attemptTimedOut); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// countingBackoff records how it is used, and never pauses.
+type countingBackoff struct {
+	pauses, resets int
+}
+
+func (bo *countingBackoff) Pause() time.Duration { bo.pauses++; return 0 }
+
+func (bo *countingBackoff) Reset() { bo.resets++ }
+
+func TestRetryConfigBackoffFactory(t *testing.T) {
+	var made []*countingBackoff
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: &interruptibleTransport{
+			events: []event{
+				{byteRange: "bytes 0-9/*", responseStatus: http.StatusServiceUnavailable},
+				{byteRange: "bytes 0-9/*", responseStatus: 308},
+				{byteRange: "bytes 10-19/*", responseStatus: 308},
+				{byteRange: "bytes */20", responseStatus: http.StatusOK},
+			},
+			bodies: bodyTracker{},
+		}},
+		Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 20)), 10),
+		MediaType: "text/plain",
+		Retry: &RetryConfig{
+			// BackoffFactory takes precedence over Backoff.
+			Backoff: &gax.Backoff{Initial: time.Hour},
+			BackoffFactory: func() Backoff {
+				bo := &countingBackoff{}
+				made = append(made, bo)
+				return bo
+			},
+		},
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+
+	// One backoff per chunk, each Reset before use.
+	if got, want := len(made), 3; got != want {
+		t.Fatalf("factory calls: got %d, want %d", got, want)
+	}
+	for i, bo := range made {
+		if bo.resets != 1 {
+			t.Errorf("backoff %d: got %d resets, want 1", i, bo.resets)
+		}
+	}
+	if got := made[0].pauses; got != 1 {
+		t.Errorf("first chunk pauses: got %d, want 1", got)
+	}
+}
+
+func TestGaxBackoffReset(t *testing.T) {
+	bo := newGaxBackoff(gax.Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2})
+	for i := 0; i < 5; i++ {
+		bo.Pause()
+	}
+	bo.Reset()
+	// After Reset, the first pause is bounded by Initial again.
+	if got := bo.Pause(); got > time.Second {
+		t.Errorf("Pause after Reset: got %v, want <= %v", got, time.Second)
+	}
+}
+
+func TestRetryConfigRand(t *testing.T) {
+	sequence := func(seed int64) []time.Duration {
+		rc := &RetryConfig{
+			Backoff: &gax.Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2},
+			Rand:    rand.New(rand.NewSource(seed)),
+		}
+		bo := rc.backoff()
+		var got []time.Duration
+		for i := 0; i < 8; i++ {
+			got = append(got, bo.Pause())
+		}
+		return got
+	}
+	a, b := sequence(42), sequence(42)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("same seed produced different sequences:\n%v\n%v", a, b)
+	}
+	if c := sequence(43); reflect.DeepEqual(a, c) {
+		t.Errorf("different seeds produced the same sequence: %v", a)
+	}
+	ceiling := time.Second
+	for i, d := range a {
+		if d <= 0 || d > ceiling {
+			t.Errorf("pause %d: got %v, want in (0, %v]", i, d, ceiling)
+		}
+		if ceiling *= 2; ceiling > 10*time.Second {
+			ceiling = 10 * time.Second
+		}
+	}
+}
+
+func TestRetryConfigRandConcurrent(t *testing.T) {
+	rc := &RetryConfig{Rand: rand.New(rand.NewSource(1))}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bo := rc.backoff()
+			for j := 0; j < 100; j++ {
+				bo.Pause()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRetryConfigPreviewBackoff(t *testing.T) {
+	ms := func(n ...int) []time.Duration {
+		var ds []time.Duration
+		for _, v := range n {
+			ds = append(ds, time.Duration(v)*time.Millisecond)
+		}
+		return ds
+	}
+	for _, tc := range []struct {
+		name string
+		r    *RetryConfig
+		n    int
+		want []time.Duration
+	}{
+		{name: "nil config", r: nil, n: 3, want: ms(100, 200, 400)},
+		{name: "zero n", r: &RetryConfig{}, n: 0, want: nil},
+		{
+			name: "capped",
+			r:    &RetryConfig{Backoff: &gax.Backoff{Initial: 100 * time.Millisecond, Max: 250 * time.Millisecond, Multiplier: 3}},
+			n:    4,
+			want: ms(100, 250, 250, 250),
+		},
+		{
+			name: "factory",
+			r:    &RetryConfig{BackoffFactory: func() Backoff { return new(PauseOneSecond) }},
+			n:    2,
+			want: []time.Duration{time.Second, time.Second},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.r.PreviewBackoff(tc.n); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRetryConfigDescribeBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		r    *RetryConfig
+		want BackoffDescription
+	}{
+		{
+			name: "default",
+			want: BackoffDescription{Strategy: "exponential", Initial: 100 * time.Millisecond, Max: 30 * time.Second, Multiplier: 2, Jitter: "full"},
+		},
+		{
+			name: "partial with seeded jitter",
+			r:    &RetryConfig{Backoff: &gax.Backoff{Max: time.Minute}, Rand: rand.New(rand.NewSource(1))},
+			want: BackoffDescription{Strategy: "exponential", Initial: time.Second, Max: time.Minute, Multiplier: 2, Jitter: "full, seeded"},
+		},
+		{
+			name: "custom",
+			r:    &RetryConfig{BackoffFactory: func() Backoff { return new(NoPauseBackoff) }},
+			want: BackoffDescription{Strategy: "custom"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.r.describeBackoff(); got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsConnReset(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{err: nil},
+		{err: io.ErrUnexpectedEOF},
+		{err: &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.ECONNRESET)}, want: true},
+		{err: &url.Error{Op: "Post", Err: os.NewSyscallError("write", syscall.EPIPE)}, want: true},
+		{err: errors.New("read tcp: connection reset by peer"), want: true},
+	} {
+		if got := isConnReset(tc.err); got != tc.want {
+			t.Errorf("isConnReset(%v): got %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRetryConfigDescribe(t *testing.T) {
+	d := (*RetryConfig)(nil).Describe()
+	if d.RetryableStatuses != "408, 429, 5xx" || d.Backoff.Strategy != "exponential" {
+		t.Errorf("nil config: got %+v", d)
+	}
+	d = (&RetryConfig{ShouldRetry: func(error) bool { return false }}).Describe()
+	if d.RetryableStatuses != "custom" {
+		t.Errorf("custom predicate: got RetryableStatuses %q, want \"custom\"", d.RetryableStatuses)
+	}
+	want := `backoff=exponential initial=100ms max=30s multiplier=2 jitter="full" retryable="custom"`
+	if got := d.String(); got != want {
+		t.Errorf("String:\ngot  %s\nwant %s", got, want)
+	}
+}
+
+func TestNextPause(t *testing.T) {
+	far := time.Now().Add(time.Hour)
+	for _, bo := range []Backoff{
+		newGaxBackoff(gax.Backoff{Initial: 100 * time.Millisecond, Max: 250 * time.Millisecond, Multiplier: 2}),
+		newJitteredBackoff(gax.Backoff{Initial: 100 * time.Millisecond, Max: 250 * time.Millisecond, Multiplier: 2}, rand.New(rand.NewSource(1))),
+	} {
+		t.Run(fmt.Sprintf("%T", bo), func(t *testing.T) {
+			for i, wantRaw := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond} {
+				pb := nextPause(bo, far, 0)
+				if pb.Raw != wantRaw {
+					t.Errorf("pause %d: got Raw %v, want %v", i, pb.Raw, wantRaw)
+				}
+				if pb.Backoff <= 0 || pb.Backoff > pb.Raw || pb.Jitter != pb.Backoff-pb.Raw {
+					t.Errorf("pause %d: inconsistent breakdown %+v", i, pb)
+				}
+				if pb.Clamped || pb.Final != pb.Backoff {
+					t.Errorf("pause %d: got Clamped=%v Final=%v, want unclamped", i, pb.Clamped, pb.Final)
+				}
+			}
+		})
+	}
+
+	t.Run("custom", func(t *testing.T) {
+		pb := nextPause(new(PauseOneSecond), far, 0)
+		if want := (PauseBreakdown{Raw: time.Second, Backoff: time.Second, Final: time.Second}); pb != want {
+			t.Errorf("got %+v, want %+v", pb, want)
+		}
+	})
+
+	t.Run("retry after", func(t *testing.T) {
+		pb := nextPause(new(PauseOneSecond), far, 3*time.Second)
+		if pb.RetryAfter != 3*time.Second || pb.Final != 3*time.Second || pb.Backoff != time.Second {
+			t.Errorf("got %+v, want the server's 3s pause to win over the 1s backoff", pb)
+		}
+	})
+
+	t.Run("clamped", func(t *testing.T) {
+		pb := nextPause(new(PauseOneSecond), time.Now().Add(100*time.Millisecond), 0)
+		if !pb.Clamped || pb.Final > 100*time.Millisecond || pb.Backoff != time.Second {
+			t.Errorf("got %+v, want a clamped pause of at most 100ms", pb)
+		}
+	})
+}
+
+func TestFinalizeRetry(t *testing.T) {
+	var chunkBackoffs, finalBackoffs int
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: &interruptibleTransport{
+			events: []event{
+				{byteRange: "bytes 0-9/*", responseStatus: http.StatusServiceUnavailable},
+				{byteRange: "bytes 0-9/*", responseStatus: 308},
+				{byteRange: "bytes 10-14/15", responseStatus: http.StatusForbidden},
+				{byteRange: "bytes 10-14/15", responseStatus: http.StatusOK},
+			},
+			bodies: bodyTracker{},
+		}},
+		Media:     NewMediaBuffer(strings.NewReader(strings.Repeat("a", 15)), 10),
+		MediaType: "text/plain",
+		Retry: &RetryConfig{
+			BackoffFactory: func() Backoff { chunkBackoffs++; return new(NoPauseBackoff) },
+		},
+		FinalizeRetry: &RetryConfig{
+			BackoffFactory: func() Backoff { finalBackoffs++; return new(NoPauseBackoff) },
+			// Be more patient with finalization: retry even a 403.
+			ShouldRetry: func(error) bool { return true },
+		},
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if chunkBackoffs != 1 || finalBackoffs != 1 {
+		t.Errorf("got %d chunk and %d finalization backoffs, want 1 and 1", chunkBackoffs, finalBackoffs)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	date := func(d time.Duration) string { return now.Add(d).Format(http.TimeFormat) }
+	const skew, maxPause = 5 * time.Second, time.Minute
+	for _, tc := range []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{name: "absent", value: "", want: 0},
+		{name: "seconds", value: "7", want: 7 * time.Second},
+		{name: "zero seconds", value: "0", want: 0},
+		{name: "seconds above max", value: "86400", want: maxPause},
+		{name: "seconds overflowing", value: "99999999999999999999", want: 0},
+		{name: "negative seconds", value: "-5", want: 0},
+		{name: "future date", value: date(30 * time.Second), want: 30 * time.Second},
+		{name: "far future date", value: date(365 * 24 * time.Hour), want: maxPause},
+		{name: "date now", value: date(0), want: retryAfterSoon},
+		{name: "date just past", value: date(-3 * time.Second), want: retryAfterSoon},
+		{name: "date past beyond skew", value: date(-10 * time.Second), want: 0},
+		{name: "date long past", value: date(-24 * time.Hour), want: 0},
+		{name: "garbage", value: "soon", want: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tc.value != "" {
+				resp.Header.Set("Retry-After", tc.value)
+			}
+			if got := retryAfter(resp, now, skew, maxPause); got != tc.want {
+				t.Errorf("Retry-After %q: got %v, want %v", tc.value, got, tc.want)
+			}
+		})
+	}
+	if got := retryAfter(nil, now, skew, maxPause); got != 0 {
+		t.Errorf("nil response: got %v, want 0", got)
+	}
+}
+
+func TestRetryAfterHonored(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	rec := &eventRecorder{}
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: &interruptibleTransport{
+			events: []event{
+				{byteRange: "bytes 0-9/10", responseStatus: http.StatusTooManyRequests, responseHeader: http.Header{"Retry-After": {"3600"}}},
+				{byteRange: "bytes 0-9/10", responseStatus: http.StatusOK},
+			},
+			bodies: bodyTracker{},
+		}},
+		Media:         NewMediaBuffer(strings.NewReader(strings.Repeat("a", 10)), 100),
+		MediaType:     "text/plain",
+		Metrics:       rec,
+		MaxRetryAfter: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Upload took %v, want a pause of at least 50ms", elapsed)
+	}
+	if len(rec.events) == 0 || rec.events[0].Kind != AttemptRetried {
+		t.Fatalf("got events %v, want a retried attempt first", rec.kinds())
+	}
+	if pb := rec.events[0].Pause; pb.RetryAfter != 50*time.Millisecond || pb.Final != 50*time.Millisecond {
+		t.Errorf("got Pause %+v, want a Retry-After pause clamped to 50ms", pb)
+	}
+}
+
+func TestShortWriteRetried(t *testing.T) {
+	oldBackoff := backoff
+	backoff = func() Backoff { return new(NoPauseBackoff) }
+	defer func() { backoff = oldBackoff }()
+
+	var ranges, bodies []string
+	rx := &ResumableUpload{
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			b, err := io.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, req.Header.Get("Content-Range"))
+			bodies = append(bodies, string(b))
+			h := http.Header{}
+			switch len(ranges) {
+			case 1:
+				h.Set("X-Http-Status-Code-Override", "308")
+			case 2:
+				// The second chunk was only partly written.
+				return nil, io.ErrShortWrite
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+		})},
+		URI:       "https://example.com/upload",
+		Media:     NewMediaBuffer(strings.NewReader("0123456789abcde"), 10),
+		MediaType: "text/plain",
+	}
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	res.Body.Close()
+	if want := []string{"bytes 0-9/*", "bytes 10-14/15", "bytes 10-14/15"}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("got ranges %q, want %q", ranges, want)
+	}
+	if bodies[2] != "abcde" {
+		t.Errorf("retried chunk: got %q, want the whole chunk %q", bodies[2], "abcde")
+	}
+}
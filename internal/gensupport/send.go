@@ -15,7 +15,6 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/googleapis/gax-go/v2"
 	"github.com/googleapis/gax-go/v2/callctx"
 )
 
@@ -105,6 +104,12 @@ func send(ctx context.Context, client *http.Client, req *http.Request) (*http.Re
 // req.WithContext, then calls any functions returned by the hooks in
 // reverse order.
 func SendRequestWithRetry(ctx context.Context, client *http.Client, req *http.Request, retry *RetryConfig) (*http.Response, error) {
+	return sendRequestWithRetry(ctx, client, req, retry, defaultIdempotencyHeaderName)
+}
+
+// sendRequestWithRetry is SendRequestWithRetry, sending the idempotency token
+// in the header idempotencyHeader.
+func sendRequestWithRetry(ctx context.Context, client *http.Client, req *http.Request, retry *RetryConfig, idempotencyHeader string) (*http.Response, error) {
 	// Add headers set in context metadata.
 	if ctx != nil {
 		headers := callctx.HeadersFromContext(ctx)
@@ -123,10 +128,10 @@ func SendRequestWithRetry(ctx context.Context, client *http.Client, req *http.Re
 	if ctx == nil {
 		return client.Do(req)
 	}
-	return sendAndRetry(ctx, client, req, retry)
+	return sendAndRetry(ctx, client, req, retry, idempotencyHeader)
 }
 
-func sendAndRetry(ctx context.Context, client *http.Client, req *http.Request, retry *RetryConfig) (*http.Response, error) {
+func sendAndRetry(ctx context.Context, client *http.Client, req *http.Request, retry *RetryConfig, idempotencyHeader string) (*http.Response, error) {
 	if client == nil {
 		client = http.DefaultClient
 	}
@@ -141,16 +146,7 @@ func sendAndRetry(ctx context.Context, client *http.Client, req *http.Request, r
 
 	// Loop to retry the request, up to the context deadline.
 	var pause time.Duration
-	var bo Backoff
-	if retry != nil && retry.Backoff != nil {
-		bo = &gax.Backoff{
-			Initial:    retry.Backoff.Initial,
-			Max:        retry.Backoff.Max,
-			Multiplier: retry.Backoff.Multiplier,
-		}
-	} else {
-		bo = backoff()
-	}
+	bo := retry.backoff()
 
 	var errorFunc = retry.errorFunc()
 
@@ -185,7 +181,7 @@ func sendAndRetry(ctx context.Context, client *http.Client, req *http.Request, r
 		invocationHeader := fmt.Sprintf("gccl-invocation-id/%s gccl-attempt-count/%d", invocationID, attempts)
 		xGoogHeader := strings.Join([]string{invocationHeader, baseXGoogHeader}, " ")
 		req.Header.Set("X-Goog-Api-Client", xGoogHeader)
-		req.Header.Set("X-Goog-Gcs-Idempotency-Token", invocationID)
+		req.Header.Set(idempotencyHeader, invocationID)
 
 		resp, err = client.Do(req.WithContext(ctx))
 
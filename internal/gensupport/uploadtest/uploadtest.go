@@ -0,0 +1,92 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package uploadtest provides utilities for testing resumable uploads.
+package uploadtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/internal/gensupport"
+)
+
+// ReplayTransport is an http.RoundTripper that answers requests with the
+// responses recorded by gensupport.ResumableUpload.RecordTo, in order. Each
+// request must match the method and Content-Range of the recorded request.
+type ReplayTransport struct {
+	mu        sync.Mutex
+	exchanges []gensupport.RecordedExchange
+}
+
+// NewReplayTransport reads a recording from r.
+func NewReplayTransport(r io.Reader) (*ReplayTransport, error) {
+	t := &ReplayTransport{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if len(strings.TrimSpace(sc.Text())) == 0 {
+			continue
+		}
+		var ex gensupport.RecordedExchange
+		if err := json.Unmarshal(sc.Bytes(), &ex); err != nil {
+			return nil, fmt.Errorf("uploadtest: parsing recording: %w", err)
+		}
+		t.exchanges = append(t.exchanges, ex)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Remaining returns the number of recorded exchanges not yet replayed.
+func (t *ReplayTransport) Remaining() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.exchanges)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	t.mu.Lock()
+	if len(t.exchanges) == 0 {
+		t.mu.Unlock()
+		return nil, errors.New("uploadtest: no recorded exchanges left")
+	}
+	ex := t.exchanges[0]
+	t.exchanges = t.exchanges[1:]
+	t.mu.Unlock()
+
+	if req.Method != ex.Method {
+		return nil, fmt.Errorf("uploadtest: got %s request, recording has %s", req.Method, ex.Method)
+	}
+	if got, want := req.Header.Get("Content-Range"), ex.RequestHeader.Get("Content-Range"); got != want {
+		return nil, fmt.Errorf("uploadtest: got Content-Range %q, recording has %q", got, want)
+	}
+	if ex.Error != "" {
+		return nil, errors.New(ex.Error)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.StatusCode, http.StatusText(ex.StatusCode)),
+		StatusCode:    ex.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        ex.ResponseHeader.Clone(),
+		Body:          http.NoBody,
+		ContentLength: 0,
+		Request:       req,
+	}, nil
+}
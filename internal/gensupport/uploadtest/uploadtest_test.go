@@ -0,0 +1,88 @@
+// Copyright 2025 Google LLC.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uploadtest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/internal/gensupport"
+)
+
+// scriptedTransport answers requests with the given status codes in order.
+// A status of 308 is reported as Google's upload endpoint does.
+type scriptedTransport struct {
+	statuses []int
+}
+
+func (t *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	status := t.statuses[0]
+	t.statuses = t.statuses[1:]
+	h := http.Header{}
+	if status == 308 {
+		status = http.StatusOK
+		h.Set("X-Http-Status-Code-Override", "308")
+	}
+	return &http.Response{StatusCode: status, Header: h, Body: http.NoBody}, nil
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	const data = "0123456789abcdefghij"
+	newUpload := func(rt http.RoundTripper) *gensupport.ResumableUpload {
+		return &gensupport.ResumableUpload{
+			Client:    &http.Client{Transport: rt},
+			URI:       "https://example.com/upload?upload_id=x",
+			Media:     gensupport.NewMediaBuffer(strings.NewReader(data), 10),
+			MediaType: "text/plain",
+			Retry: &gensupport.RetryConfig{
+				BackoffFactory: func() gensupport.Backoff { return noPause{} },
+			},
+		}
+	}
+
+	var rec bytes.Buffer
+	rx := newUpload(&scriptedTransport{statuses: []int{503, 308, 308, 200}})
+	rx.RecordTo = &rec
+	rx.UserAgent = "test"
+	res, err := rx.Upload(context.Background())
+	if err != nil {
+		t.Fatalf("recording Upload: %v", err)
+	}
+	res.Body.Close()
+	if strings.Contains(rec.String(), data[:10]) {
+		t.Errorf("recording contains media bytes:\n%s", rec.String())
+	}
+
+	rt, err := NewReplayTransport(&rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rt.Remaining(); got != 4 {
+		t.Fatalf("recorded exchanges: got %d, want 4", got)
+	}
+	res, err = newUpload(rt).Upload(context.Background())
+	if err != nil {
+		t.Fatalf("replayed Upload: %v", err)
+	}
+	res.Body.Close()
+	if got := rt.Remaining(); got != 0 {
+		t.Errorf("exchanges left after replay: got %d, want 0", got)
+	}
+}
+
+type noPause struct{}
+
+func (noPause) Pause() time.Duration { return 0 }
+
+func (noPause) Reset() {}
@@ -32,7 +32,11 @@ type NoPauseBackoff struct{}
 
 func (bo *NoPauseBackoff) Pause() time.Duration { return 0 }
 
+func (bo *NoPauseBackoff) Reset() {}
+
 // PauseOneSecond implements backoff with infinite 1s pauses.
 type PauseOneSecond struct{}
 
 func (bo *PauseOneSecond) Pause() time.Duration { return time.Second }
+
+func (bo *PauseOneSecond) Reset() {}